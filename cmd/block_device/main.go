@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
+)
+
+func main() {
+	// get device address from CLI args
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: %s <device-id>", os.Args[0])
+	}
+	macAddr, err := bluetooth.ParseMacAddress(os.Args[1])
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
+	blocker, ok := bluetooth.Capability[bluetooth.DeviceBlocker](btm)
+	if !ok {
+		log.Fatalf("error: %v", bluetooth.ErrUnsupported)
+	}
+
+	log.Printf("blocking %q", macAddr)
+	ctx := context.Background()
+	if err := blocker.Block(ctx, macAddr); err != nil {
+		log.Fatalf("failed to block: %v", err)
+	}
+}
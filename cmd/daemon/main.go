@@ -2,22 +2,61 @@ package main
 
 import (
 	"context"
+	"log"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
 	"github.com/pushittoprod/bt-daemon/pkg/daemon"
 )
 
 func main() {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	slog.SetLogLoggerLevel(cfg.SlogLevel())
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
+
+	// Peers and local users can ask for the same device at the same time, so make sure their requests don't race.
+	btm = bluetooth.NewSerializingBluetoothManager(btm)
+
 	ctx, cancel := context.WithCancel(context.Background())
+	// Peers poll our device list, so serve it from a cache rather than asking the backend every time.
+	btm = bluetooth.NewCachingBluetoothManager(ctx, btm, cfg.CacheRefreshInterval())
+
+	// Peers use our instance ID to tell when they've been pointed at themselves. If we can't save one, LoadInstanceID
+	// still returns a new one, which works until the next restart.
+	instanceID, err := config.LoadInstanceID()
+	if err != nil {
+		slog.Warn("failed to load instance ID", "err", err)
+	}
+
+	var peers []daemon.Peer
+	for _, peer := range cfg.Peers {
+		peers = append(peers, daemon.Peer{Addr: peer.Addr, DisplayName: peer.DisplayName, AuthKey: peer.AuthKey})
+	}
 
+	// RunServer returns once the server has shut down and running operations have finished, or ShutdownTimeout has
+	// passed.
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		d := daemon.Daemon{
-			ServeAddr:        ":0", // TODO: set a default port and take an optional flag to change it
-			BluetoothManager: bluetooth.NewBluetoothManager(),
+			ServeAddr:        cfg.ServeAddr,
+			InstanceID:       instanceID,
+			BluetoothManager: btm,
+			Peers:            peers,
+			AuthKey:          cfg.AuthKey,
+			HealthPath:       cfg.HealthPath,
+			Connect:          cfg.BluetoothOptions().Connect,
 		}
 		d.RunServer(ctx)
 	}()
@@ -28,4 +67,9 @@ func main() {
 	sig := <-sigChan
 	slog.Info("got shutdown signal - stopping server", "sig", sig)
 	cancel()
+	select {
+	case <-done:
+	case <-time.After(daemon.DefaultShutdownTimeout + time.Second):
+		slog.Warn("server didn't shut down in time")
+	}
 }
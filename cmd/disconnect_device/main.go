@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
 )
 
 func main() {
@@ -13,9 +14,19 @@ func main() {
 	if len(os.Args) != 2 {
 		log.Fatalf("usage: %s <device-id>", os.Args[0])
 	}
-	macAddr := os.Args[1]
+	macAddr, err := bluetooth.ParseMacAddress(os.Args[1])
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
 
-	btm := bluetooth.NewBluetoothManager()
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
 
 	log.Printf("disconnecting %q", macAddr)
 	ctx := context.Background()
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
 )
 
 func main() {
@@ -14,13 +15,42 @@ func main() {
 	if len(os.Args) != 2 {
 		log.Fatalf("usage: %s <device-id>", os.Args[0])
 	}
-	macAddr := os.Args[1]
+	macAddr, err := bluetooth.ParseMacAddress(os.Args[1])
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
 
-	btm := bluetooth.NewBluetoothManager()
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
 	ctx := context.Background()
 	btd, err := btm.Get(ctx, macAddr)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
-	fmt.Println(btd)
+
+	fmt.Printf("%s (%s)\n", btd.Name, btd.MacAddr)
+	if btd.Alias != "" && btd.Alias != btd.Name {
+		fmt.Printf("  Alias: %s\n", btd.Alias)
+	}
+	if btd.Class != 0 {
+		fmt.Printf("  Class: %#08x\n", btd.Class)
+	}
+	if btd.Icon != "" {
+		fmt.Printf("  Icon: %s\n", btd.Icon)
+	}
+	fmt.Printf("  Connected: %t\n  Paired: %t\n  Trusted: %t\n  Blocked: %t\n",
+		btd.Connected, btd.Paired, btd.Trusted, btd.Blocked)
+	switch {
+	case btd.Battery == nil:
+	case btd.BatteryLow():
+		fmt.Printf("  Battery: \x1b[1;91m%d%% [low battery]\x1b[0m\n", *btd.Battery)
+	default:
+		fmt.Printf("  Battery: %d%%\n", *btd.Battery)
+	}
 }
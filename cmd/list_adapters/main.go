@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
+)
+
+func main() {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
+	adapterManager, ok := bluetooth.Capability[bluetooth.AdapterManager](btm)
+	if !ok {
+		log.Fatalf("error: %v", bluetooth.ErrUnsupported)
+	}
+
+	adapters, err := adapterManager.Adapters(context.Background())
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	for _, adapter := range adapters {
+		devinfo := fmt.Sprintf("%s (%s)", adapter.Name, adapter.MacAddr)
+		var flags []string
+		for _, flag := range []struct {
+			set  bool
+			name string
+		}{
+			{adapter.Selected, "selected"},
+			{adapter.Powered, "powered"},
+			{adapter.Discoverable, "discoverable"},
+			{adapter.Pairable, "pairable"},
+		} {
+			if flag.set {
+				flags = append(flags, flag.name)
+			}
+		}
+		if adapter.Selected {
+			fmt.Printf("\x1b[97m%s\x1b[0m %v\n", devinfo, flags)
+		} else {
+			fmt.Printf("%s %v\n", devinfo, flags)
+		}
+	}
+}
@@ -5,10 +5,20 @@ import (
 	"fmt"
 
 	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
 )
 
 func main() {
-	btm := bluetooth.NewBluetoothManager()
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Printf("error: failed to load config: %v\n", err)
+		return
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		fmt.Printf("error: failed to set up bluetooth: %v\n", err)
+		return
+	}
 
 	ctx := context.Background()
 	devices, err := btm.List(ctx)
@@ -24,6 +34,18 @@ func main() {
 		} else {
 			fmt.Printf("%s", devinfo)
 		}
+		if device.Battery != nil {
+			fmt.Printf(" %s", formatBattery(device))
+		}
 		fmt.Println()
 	}
 }
+
+// formatBattery returns the device's battery level, highlighted in red if it's low.
+func formatBattery(device bluetooth.BluetoothDevice) string {
+	battery := fmt.Sprintf("%d%%", *device.Battery)
+	if device.BatteryLow() {
+		return "\x1b[1;91m" + battery + " [low battery]\x1b[0m"
+	}
+	return battery
+}
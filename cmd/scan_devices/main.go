@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
+)
+
+func main() {
+	duration := flag.Duration("duration", 5*time.Second, "how long to scan for")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
+	scanner, ok := bluetooth.Capability[bluetooth.Scanner](btm)
+	if !ok {
+		log.Fatalf("error: %v", bluetooth.ErrUnsupported)
+	}
+
+	log.Printf("scanning for %s", *duration)
+	// Give the backend a little longer than the scan itself to start up and report back.
+	ctx, cancel := context.WithTimeout(context.Background(), *duration+10*time.Second)
+	defer cancel()
+	devices, err := scanner.Scan(ctx, *duration)
+	if err != nil {
+		log.Fatalf("failed to scan: %v", err)
+	}
+
+	for _, device := range devices {
+		name := device.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		devinfo := fmt.Sprintf("%s (%s)", name, device.MacAddr)
+		if device.RSSI != nil {
+			devinfo += fmt.Sprintf(" %d dBm", *device.RSSI)
+		}
+		fmt.Println(devinfo)
+	}
+}
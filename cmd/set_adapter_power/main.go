@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
+)
+
+func main() {
+	// get adapter address and state from CLI args
+	if len(os.Args) != 3 || (os.Args[2] != "on" && os.Args[2] != "off") {
+		log.Fatalf("usage: %s <adapter-id> on|off", os.Args[0])
+	}
+	macAddr, err := bluetooth.ParseMacAddress(os.Args[1])
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	powered := os.Args[2] == "on"
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
+	adapterManager, ok := bluetooth.Capability[bluetooth.AdapterManager](btm)
+	if !ok {
+		log.Fatalf("error: %v", bluetooth.ErrUnsupported)
+	}
+
+	log.Printf("powering %s %q", os.Args[2], macAddr)
+	ctx := context.Background()
+	if err := adapterManager.SetAdapterPowered(ctx, macAddr, powered); err != nil {
+		log.Fatalf("failed to set adapter power: %v", err)
+	}
+}
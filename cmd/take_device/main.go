@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
+	"github.com/pushittoprod/bt-daemon/pkg/daemon"
+)
+
+// Moving a device means talking to the local daemon, which talks to its peers, so unlike the other commands this one
+// needs the daemon to be running.
+func main() {
+	// get device address from CLI args
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: %s <device-id>", os.Args[0])
+	}
+	macAddr, err := bluetooth.ParseMacAddress(os.Args[1])
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	addr := cfg.ServeAddr
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+
+	log.Printf("taking %q", macAddr)
+	// Give the daemon time to report its own timeout rather than giving up first.
+	client := daemon.NewSigningClient(cfg.AuthKey)
+	client.Timeout = daemon.DefaultTakeTimeout(cfg.BluetoothOptions().Connect) + 5*time.Second
+	resp, err := client.PostForm("http://"+addr+"/take", url.Values{"macAddr": {macAddr.String()}})
+	if err != nil {
+		log.Fatalf("failed to reach the daemon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("failed to read the daemon's response (%s): %v", resp.Status, err)
+	}
+	var take daemon.TakeResponse
+	if err := json.Unmarshal(body, &take); err != nil {
+		// Errors from outside the handler, like the daemon's own timeout, are plain text.
+		log.Fatalf("error from the daemon (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	for _, step := range take.Steps {
+		if step.OK {
+			fmt.Printf("  %s %s: ok\n", step.Step, step.Host)
+		} else {
+			fmt.Printf("  %s %s: \x1b[1;91mfailed\x1b[0m: %s\n", step.Step, step.Host, step.Error)
+		}
+	}
+	if !take.Taken {
+		log.Fatalf("error: %s", take.Message)
+	}
+	fmt.Printf("took %s\n", macAddr)
+}
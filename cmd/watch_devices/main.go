@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/config"
+)
+
+func main() {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(cfg.BluetoothOptions())
+	if err != nil {
+		log.Fatalf("failed to set up bluetooth: %v", err)
+	}
+	// Every manager from NewBluetoothManager can watch, falling back to polling if the backend can't push events.
+	watcher := btm.(bluetooth.DeviceWatcher)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	events, err := watcher.Watch(ctx)
+	if err != nil {
+		log.Fatalf("failed to watch devices: %v", err)
+	}
+
+	log.Print("watching for device changes, press Ctrl-C to stop")
+	for event := range events {
+		devinfo := fmt.Sprintf("%s (%s)", event.Name, event.MacAddr)
+		if event.Type == bluetooth.DevicePropertyChanged {
+			fmt.Printf("%s %s: %v\n", devinfo, event.Property, event.Value)
+		} else {
+			fmt.Printf("%s %s\n", devinfo, event.Type)
+		}
+	}
+}
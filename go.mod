@@ -1,3 +1,5 @@
 module github.com/pushittoprod/bt-daemon
 
 go 1.23.1
+
+require github.com/godbus/dbus/v5 v5.1.0
@@ -2,43 +2,43 @@ package bluetooth
 
 import (
 	"context"
-	"fmt"
-	"runtime"
 )
 
 // A BluetoothDevice represents a single Bluetooth device connected to or known by a host.
 type BluetoothDevice struct {
 	Name      string
-	MacAddr   string
+	MacAddr   MacAddress
 	Connected bool
+
+	// Alias is the user-assigned name for the device, if the backend supports aliases. It's usually the same as Name.
+	Alias string `json:",omitempty"`
+	// Class is the Bluetooth Class of Device, which encodes what kind of device this is (headphones, keyboard, etc.).
+	// It's 0 if the backend doesn't report it.
+	Class uint32 `json:",omitempty"`
+	// Icon is a freedesktop icon name describing the device, e.g. "audio-headset" or "input-keyboard". It's only
+	// reported on Linux.
+	Icon    string `json:",omitempty"`
+	Paired  bool
+	Trusted bool
+	Blocked bool
+	// Battery is the device's battery level as a percentage, or nil if it isn't known. Only some devices report it,
+	// usually only while they're connected, and only on Linux.
+	Battery *int `json:",omitempty"`
+}
+
+// LowBattery is the battery percentage at or below which a device's battery counts as low.
+const LowBattery = 20
+
+// BatteryLow returns true if the device reports a battery level of LowBattery or less.
+func (d BluetoothDevice) BatteryLow() bool {
+	return d.Battery != nil && *d.Battery <= LowBattery
 }
 
 // A BluetoothManager provides some means of managing Bluetooth devices connected to the host.
 type BluetoothManager interface {
-	Connect(ctx context.Context, macAddr string) error
-	Disconnect(ctx context.Context, macAddr string) error
+	Connect(ctx context.Context, macAddr MacAddress) error
+	Disconnect(ctx context.Context, macAddr MacAddress) error
 	List(ctx context.Context) ([]BluetoothDevice, error)
-	Get(ctx context.Context, macAddr string) (BluetoothDevice, error)
-	IsConnected(ctx context.Context, macAddr string) (bool, error)
-}
-
-// NewBluetoothManager returns an appropriate BluetoothManager for the current platform.
-func NewBluetoothManager() BluetoothManager {
-	// XXX: Instead of hardcoding the OS detection here, we could have a registry of managers with a function that
-	// determines whether the manager is appropriate for the current platform. Then we could iterate over the registry
-	// and return the first manager that is appropriate. This would let us have more flexibility, e.g. in case a
-	// particular platform has multiple possible managers. That said, this current approach is easy to understand and
-	// allows us to easily tell the user if they don't have the required command installed.
-	var manager BluetoothManager
-	switch os := runtime.GOOS; os {
-	case "darwin":
-		manager = newMacosBlueutilBluetoothManager()
-	case "linux":
-		manager = newLinuxBluetoothctlBluetoothManager()
-	default:
-		panic(fmt.Sprintf("unsupported OS: %s", os))
-	}
-	// Wrap the manager in a normalizing manager to ensure all MAC addresses are validated and formatted consistently.
-	// This saves us from having to do this in every implementation.
-	return saferBluetoothManager{inner: manager}
+	Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error)
+	IsConnected(ctx context.Context, macAddr MacAddress) (bool, error)
 }
@@ -0,0 +1,318 @@
+// Package bluetoothtest provides an in-memory BluetoothManager for tests and demos that need to run without Bluetooth
+// hardware.
+package bluetoothtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+// Names of the operations FakeManager records and can delay or fail. They match the method names.
+const (
+	OpConnect     = "Connect"
+	OpDisconnect  = "Disconnect"
+	OpList        = "List"
+	OpGet         = "Get"
+	OpIsConnected = "IsConnected"
+	OpPair        = "Pair"
+	OpTrust       = "Trust"
+	OpUntrust     = "Untrust"
+	OpRemove      = "Remove"
+	OpBlock       = "Block"
+	OpUnblock     = "Unblock"
+	OpScan        = "Scan"
+)
+
+// A Call is one call made to a FakeManager. MacAddr is zero for operations that don't take one.
+type Call struct {
+	Op      string
+	MacAddr bluetooth.MacAddress
+}
+
+type failureKey struct {
+	op      string
+	macAddr bluetooth.MacAddress
+}
+
+// FakeManager is a BluetoothManager that keeps its devices in memory. Connect, Disconnect and the other operations
+// change the devices' state the way a real backend would, and every call is recorded so tests can check what was
+// asked of it. Operations can be slowed down with SetLatency and made to fail with FailOn.
+//
+// It implements DevicePairer, DeviceTruster, DeviceRemover, DeviceBlocker and Scanner, but not AdapterManager or
+// DeviceWatcher. It's safe for concurrent use.
+type FakeManager struct {
+	mu       sync.Mutex
+	devices  []bluetooth.BluetoothDevice
+	nearby   []bluetooth.DiscoveredDevice
+	latency  map[string]time.Duration
+	failures map[failureKey]error
+	calls    []Call
+}
+
+// NewFakeManager returns a FakeManager that knows about devices.
+func NewFakeManager(devices ...bluetooth.BluetoothDevice) *FakeManager {
+	return &FakeManager{
+		devices:  slices.Clone(devices),
+		latency:  map[string]time.Duration{},
+		failures: map[failureKey]error{},
+	}
+}
+
+// AddDevice adds a device to the ones the manager knows about, replacing any device with the same address.
+func (f *FakeManager) AddDevice(device bluetooth.BluetoothDevice) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i := f.index(device.MacAddr); i >= 0 {
+		f.devices[i] = device
+		return
+	}
+	f.devices = append(f.devices, device)
+}
+
+// AddNearbyDevice adds a device for Scan to find. Pairing with it adds it to the known devices.
+func (f *FakeManager) AddNearbyDevice(device bluetooth.DiscoveredDevice) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nearby = append(f.nearby, device)
+}
+
+// Devices returns the devices the manager knows about, in their current state. Unlike List, it isn't recorded and
+// can't be delayed or failed.
+func (f *FakeManager) Devices() []bluetooth.BluetoothDevice {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.devices)
+}
+
+// SetLatency makes op take d before it does anything. If the context is done first, op returns an error wrapping
+// bluetooth.ErrBackendTimeout (for a deadline) or the context's error. An op of "" sets the latency for every
+// operation that doesn't have its own.
+func (f *FakeManager) SetLatency(op string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency[op] = d
+}
+
+// FailOn makes op return err when it's called for macAddr. A zero macAddr makes it fail for every device, and for
+// operations that don't take a device. Passing a nil err clears the failure.
+func (f *FakeManager) FailOn(op string, macAddr bluetooth.MacAddress, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := failureKey{op, macAddr}
+	if err == nil {
+		delete(f.failures, key)
+		return
+	}
+	f.failures[key] = err
+}
+
+// Calls returns every call made to the manager so far, in order.
+func (f *FakeManager) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+// ResetCalls forgets the calls made so far.
+func (f *FakeManager) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// begin records a call, waits out its latency and returns the failure it's been set up with, if any.
+func (f *FakeManager) begin(ctx context.Context, op string, macAddr bluetooth.MacAddress) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, Call{Op: op, MacAddr: macAddr})
+	latency, ok := f.latency[op]
+	if !ok {
+		latency = f.latency[""]
+	}
+	err, ok := f.failures[failureKey{op, macAddr}]
+	if !ok {
+		err = f.failures[failureKey{op, bluetooth.MacAddress{}}]
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%w: %w", bluetooth.ErrBackendTimeout, ctx.Err())
+			}
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// index returns the index of the device with the given address, or -1. f.mu must be held.
+func (f *FakeManager) index(macAddr bluetooth.MacAddress) int {
+	return slices.IndexFunc(f.devices, func(d bluetooth.BluetoothDevice) bool { return d.MacAddr == macAddr })
+}
+
+// update applies fn to the device with the given address, or returns bluetooth.ErrDeviceNotFound if there isn't one.
+func (f *FakeManager) update(macAddr bluetooth.MacAddress, fn func(*bluetooth.BluetoothDevice) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := f.index(macAddr)
+	if i < 0 {
+		return fmt.Errorf("%w: %v", bluetooth.ErrDeviceNotFound, macAddr)
+	}
+	return fn(&f.devices[i])
+}
+
+// Connect connects the device. Like a real backend, it refuses devices that are blocked.
+func (f *FakeManager) Connect(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	if err := f.begin(ctx, OpConnect, macAddr); err != nil {
+		return err
+	}
+	return f.update(macAddr, func(d *bluetooth.BluetoothDevice) error {
+		if d.Blocked {
+			return fmt.Errorf("%w: %v is blocked", bluetooth.ErrConnectionRefused, macAddr)
+		}
+		d.Connected = true
+		return nil
+	})
+}
+
+func (f *FakeManager) Disconnect(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	if err := f.begin(ctx, OpDisconnect, macAddr); err != nil {
+		return err
+	}
+	return f.update(macAddr, func(d *bluetooth.BluetoothDevice) error {
+		d.Connected = false
+		return nil
+	})
+}
+
+func (f *FakeManager) List(ctx context.Context) ([]bluetooth.BluetoothDevice, error) {
+	if err := f.begin(ctx, OpList, bluetooth.MacAddress{}); err != nil {
+		return nil, err
+	}
+	devices := f.Devices()
+	if devices == nil {
+		devices = []bluetooth.BluetoothDevice{}
+	}
+	return devices, nil
+}
+
+func (f *FakeManager) Get(ctx context.Context, macAddr bluetooth.MacAddress) (bluetooth.BluetoothDevice, error) {
+	if err := f.begin(ctx, OpGet, macAddr); err != nil {
+		return bluetooth.BluetoothDevice{}, err
+	}
+	var device bluetooth.BluetoothDevice
+	err := f.update(macAddr, func(d *bluetooth.BluetoothDevice) error {
+		device = *d
+		return nil
+	})
+	return device, err
+}
+
+func (f *FakeManager) IsConnected(ctx context.Context, macAddr bluetooth.MacAddress) (bool, error) {
+	if err := f.begin(ctx, OpIsConnected, macAddr); err != nil {
+		return false, err
+	}
+	var connected bool
+	err := f.update(macAddr, func(d *bluetooth.BluetoothDevice) error {
+		connected = d.Connected
+		return nil
+	})
+	return connected, err
+}
+
+// Pair pairs with a known device or one added with AddNearbyDevice, which then becomes known.
+func (f *FakeManager) Pair(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	if err := f.begin(ctx, OpPair, macAddr); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i := f.index(macAddr); i >= 0 {
+		f.devices[i].Paired = true
+		return nil
+	}
+	for _, nearby := range f.nearby {
+		if nearby.MacAddr == macAddr {
+			f.devices = append(f.devices, bluetooth.BluetoothDevice{
+				Name:    nearby.Name,
+				MacAddr: nearby.MacAddr,
+				Class:   nearby.Class,
+				Paired:  true,
+			})
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", bluetooth.ErrDeviceNotFound, macAddr)
+}
+
+func (f *FakeManager) Trust(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	return f.set(ctx, OpTrust, macAddr, func(d *bluetooth.BluetoothDevice) { d.Trusted = true })
+}
+
+func (f *FakeManager) Untrust(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	return f.set(ctx, OpUntrust, macAddr, func(d *bluetooth.BluetoothDevice) { d.Trusted = false })
+}
+
+// Block blocks the device, disconnecting it if it's connected.
+func (f *FakeManager) Block(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	return f.set(ctx, OpBlock, macAddr, func(d *bluetooth.BluetoothDevice) {
+		d.Blocked = true
+		d.Connected = false
+	})
+}
+
+func (f *FakeManager) Unblock(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	return f.set(ctx, OpUnblock, macAddr, func(d *bluetooth.BluetoothDevice) { d.Blocked = false })
+}
+
+// set runs an operation that changes a known device.
+func (f *FakeManager) set(
+	ctx context.Context, op string, macAddr bluetooth.MacAddress, fn func(*bluetooth.BluetoothDevice),
+) error {
+	if err := f.begin(ctx, op, macAddr); err != nil {
+		return err
+	}
+	return f.update(macAddr, func(d *bluetooth.BluetoothDevice) error {
+		fn(d)
+		return nil
+	})
+}
+
+// Remove forgets the device.
+func (f *FakeManager) Remove(ctx context.Context, macAddr bluetooth.MacAddress) error {
+	if err := f.begin(ctx, OpRemove, macAddr); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := f.index(macAddr)
+	if i < 0 {
+		return fmt.Errorf("%w: %v", bluetooth.ErrDeviceNotFound, macAddr)
+	}
+	f.devices = slices.Delete(f.devices, i, i+1)
+	return nil
+}
+
+// Scan returns the devices added with AddNearbyDevice. It doesn't wait for duration; use SetLatency to slow it down.
+func (f *FakeManager) Scan(ctx context.Context, duration time.Duration) ([]bluetooth.DiscoveredDevice, error) {
+	if err := f.begin(ctx, OpScan, bluetooth.MacAddress{}); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	devices := slices.Clone(f.nearby)
+	if devices == nil {
+		devices = []bluetooth.DiscoveredDevice{}
+	}
+	return devices, nil
+}
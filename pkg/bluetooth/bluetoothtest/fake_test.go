@@ -0,0 +1,101 @@
+package bluetoothtest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+var (
+	headphones = bluetooth.BluetoothDevice{Name: "WF-1000XM4", MacAddr: bluetooth.MustParseMacAddress("f8:4e:17:66:e8:55"), Paired: true}
+	speaker    = bluetooth.BluetoothDevice{Name: "Bose QC35 II", MacAddr: bluetooth.MustParseMacAddress("cc:98:8b:20:7d:db"), Paired: true}
+)
+
+func TestFakeManagerState(t *testing.T) {
+	f := NewFakeManager(headphones, speaker)
+	ctx := context.Background()
+
+	if err := f.Connect(ctx, headphones.MacAddr); err != nil {
+		t.Fatal(err)
+	}
+	if connected, err := f.IsConnected(ctx, headphones.MacAddr); err != nil || !connected {
+		t.Errorf("got (%v, %v), wanted (true, nil)", connected, err)
+	}
+	if err := f.Block(ctx, headphones.MacAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Connect(ctx, headphones.MacAddr); !errors.Is(err, bluetooth.ErrConnectionRefused) {
+		t.Errorf("connecting a blocked device: got %v, wanted ErrConnectionRefused", err)
+	}
+	if err := f.Remove(ctx, speaker.MacAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Get(ctx, speaker.MacAddr); !errors.Is(err, bluetooth.ErrDeviceNotFound) {
+		t.Errorf("getting a removed device: got %v, wanted ErrDeviceNotFound", err)
+	}
+
+	blocked := headphones
+	blocked.Blocked = true
+	if got, want := f.Devices(), []bluetooth.BluetoothDevice{blocked}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	wantCalls := []Call{
+		{OpConnect, headphones.MacAddr},
+		{OpIsConnected, headphones.MacAddr},
+		{OpBlock, headphones.MacAddr},
+		{OpConnect, headphones.MacAddr},
+		{OpRemove, speaker.MacAddr},
+		{OpGet, speaker.MacAddr},
+	}
+	if got := f.Calls(); !reflect.DeepEqual(got, wantCalls) {
+		t.Errorf("got %v, wanted %v", got, wantCalls)
+	}
+}
+
+func TestFakeManagerPairNearby(t *testing.T) {
+	f := NewFakeManager()
+	f.AddNearbyDevice(bluetooth.DiscoveredDevice{Name: speaker.Name, MacAddr: speaker.MacAddr})
+	if err := f.Pair(context.Background(), speaker.MacAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Devices(), []bluetooth.BluetoothDevice{speaker}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestFakeManagerFailures(t *testing.T) {
+	f := NewFakeManager(headphones, speaker)
+	f.FailOn(OpConnect, headphones.MacAddr, bluetooth.ErrAdapterPoweredOff)
+	ctx := context.Background()
+
+	if err := f.Connect(ctx, headphones.MacAddr); !errors.Is(err, bluetooth.ErrAdapterPoweredOff) {
+		t.Errorf("got %v, wanted ErrAdapterPoweredOff", err)
+	}
+	if err := f.Connect(ctx, speaker.MacAddr); err != nil {
+		t.Errorf("failure leaked to another device: %v", err)
+	}
+	f.FailOn(OpConnect, headphones.MacAddr, nil)
+	if err := f.Connect(ctx, headphones.MacAddr); err != nil {
+		t.Errorf("failure wasn't cleared: %v", err)
+	}
+
+	f.FailOn(OpList, bluetooth.MacAddress{}, bluetooth.ErrBackendTimeout)
+	if _, err := f.List(ctx); !errors.Is(err, bluetooth.ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+}
+
+func TestFakeManagerLatency(t *testing.T) {
+	f := NewFakeManager(headphones)
+	f.SetLatency("", time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := f.List(ctx); !errors.Is(err, bluetooth.ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+}
@@ -0,0 +1,394 @@
+package bluetooth
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultCacheInterval is how often the manager returned by NewCachingBluetoothManager refreshes its snapshot if it
+// isn't given an interval.
+const DefaultCacheInterval = 30 * time.Second
+
+// A DeviceCache serves device state from a snapshot instead of asking the backend every time.
+type DeviceCache interface {
+	// Refresh replaces the snapshot with the backend's current list of devices.
+	Refresh(ctx context.Context) error
+	// SnapshotAge returns how long ago the snapshot was taken. ok is false if there isn't a usable snapshot, in which
+	// case the next call to List will fetch one.
+	SnapshotAge() (age time.Duration, ok bool)
+}
+
+// cachingBluetoothManager serves List, Get and IsConnected from a snapshot of the inner manager's devices. The
+// snapshot is refreshed every interval and kept up to date between refreshes by the backend's events, if it pushes
+// them. The manager's own Connect and Disconnect calls update it straight away, and anything else that changes a
+// device throws it away so the next read fetches a new one.
+//
+// If refreshes keep failing, the snapshot is only served for maxAge, after which reads go to the backend again and
+// report its errors.
+//
+// Devices served from the snapshot never reach the inner manager, so the cache applies the DevicePolicy of the
+// saferBluetoothManager it wraps itself. Devices that aren't in the snapshot are left to the inner manager's checks.
+type cachingBluetoothManager struct {
+	inner    BluetoothManager
+	policy   DevicePolicy
+	interval time.Duration
+	maxAge   time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	devices []BluetoothDevice
+	taken   time.Time
+	valid   bool
+	// version is bumped every time the snapshot changes, so a refresh that started before the change doesn't
+	// overwrite it with older results.
+	version int
+}
+
+// NewCachingBluetoothManager wraps m in a DeviceCache that refreshes itself every interval (DefaultCacheInterval if
+// interval is 0) until ctx is done. m is usually the manager returned by NewBluetoothManager; the returned manager
+// implements the same capabilities, forwarding the ones that don't read device state.
+func NewCachingBluetoothManager(ctx context.Context, m BluetoothManager, interval time.Duration) BluetoothManager {
+	c := newCachingBluetoothManager(m, interval)
+	go c.run(ctx)
+	return c
+}
+
+func newCachingBluetoothManager(m BluetoothManager, interval time.Duration) *cachingBluetoothManager {
+	if interval == 0 {
+		interval = DefaultCacheInterval
+	}
+	policy, _ := devicePolicy(m)
+	return &cachingBluetoothManager{inner: m, policy: policy, interval: interval, maxAge: 2 * interval, now: time.Now}
+}
+
+// run refreshes the snapshot every interval and applies the backend's events to it until ctx is done.
+func (m *cachingBluetoothManager) run(ctx context.Context) {
+	var events <-chan DeviceEvent
+	if watcher, ok := eventSource(m.inner); ok {
+		var err error
+		events, err = watcher.Watch(ctx)
+		if err != nil {
+			log.Printf("watching for device changes, falling back to refreshing every %v: %v", m.interval, err)
+		}
+	}
+
+	// There's no snapshot until the first tick, so the first read fetches one itself.
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Refresh(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("refreshing device cache: %v", err)
+			}
+		case event, ok := <-events:
+			if !ok {
+				// The backend stopped reporting events, so the ticker is all that's left.
+				events = nil
+				continue
+			}
+			m.apply(event)
+		}
+	}
+}
+
+// eventSource returns the DeviceWatcher for m's backend, if it pushes events. The managers wrapping the backend always
+// implement DeviceWatcher, but saferBluetoothManager falls back to polling List for backends that don't, which would
+// only duplicate the refresh loop, so this looks through them with Unwrap.
+func eventSource(m BluetoothManager) (DeviceWatcher, bool) {
+	watcher, ok := unwrapBackend(m).(DeviceWatcher)
+	return watcher, ok
+}
+
+// devicePolicy returns the DevicePolicy of the saferBluetoothManager that m wraps, if there is one.
+func devicePolicy(m BluetoothManager) (DevicePolicy, bool) {
+	for w, ok := m.(wrapper); ok; w, ok = m.(wrapper) {
+		if safer, ok := m.(saferBluetoothManager); ok {
+			return safer.policy, true
+		}
+		m = w.Unwrap()
+	}
+	return DevicePolicy{}, false
+}
+
+func (m *cachingBluetoothManager) Refresh(ctx context.Context) error {
+	_, err := m.refresh(ctx)
+	return err
+}
+
+// refresh fetches the inner manager's devices and stores them as the snapshot, unless the snapshot changed while
+// they were being fetched. It returns the devices either way, since they're still the backend's latest answer.
+func (m *cachingBluetoothManager) refresh(ctx context.Context) ([]BluetoothDevice, error) {
+	m.mu.Lock()
+	version := m.version
+	m.mu.Unlock()
+
+	devices, err := m.inner.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.version == version {
+		m.devices = slices.Clone(devices)
+		m.taken = m.now()
+		m.valid = true
+		m.version++
+	}
+	return devices, nil
+}
+
+func (m *cachingBluetoothManager) SnapshotAge() (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.fresh() {
+		return 0, false
+	}
+	return m.now().Sub(m.taken), true
+}
+
+// fresh returns true if the snapshot can be served. m.mu must be held.
+func (m *cachingBluetoothManager) fresh() bool {
+	return m.valid && m.now().Sub(m.taken) <= m.maxAge
+}
+
+// snapshot returns a copy of the snapshot, fetching a new one first if it can't be served.
+func (m *cachingBluetoothManager) snapshot(ctx context.Context) ([]BluetoothDevice, error) {
+	m.mu.Lock()
+	if m.fresh() {
+		defer m.mu.Unlock()
+		return slices.Clone(m.devices), nil
+	}
+	m.mu.Unlock()
+	return m.refresh(ctx)
+}
+
+// update applies fn to the device with the given address in the snapshot. If the device isn't in the snapshot, the
+// snapshot is invalidated instead, since it's missing something.
+func (m *cachingBluetoothManager) update(macAddr MacAddress, fn func(*BluetoothDevice)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.version++
+	i := slices.IndexFunc(m.devices, func(d BluetoothDevice) bool { return d.MacAddr == macAddr })
+	if i < 0 {
+		m.valid = false
+		return
+	}
+	fn(&m.devices[i])
+}
+
+// invalidate throws the snapshot away, so the next read fetches a new one.
+func (m *cachingBluetoothManager) invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.version++
+	m.valid = false
+}
+
+// apply updates the snapshot with an event from the backend.
+func (m *cachingBluetoothManager) apply(event DeviceEvent) {
+	switch event.Type {
+	case DeviceConnected, DeviceDisconnected:
+		connected := event.Type == DeviceConnected
+		m.update(event.MacAddr, func(d *BluetoothDevice) { d.Connected = connected })
+	case DeviceRemoved:
+		m.mu.Lock()
+		m.devices = slices.DeleteFunc(m.devices, func(d BluetoothDevice) bool { return d.MacAddr == event.MacAddr })
+		m.version++
+		m.mu.Unlock()
+	case DevicePropertyChanged:
+		m.update(event.MacAddr, func(d *BluetoothDevice) {
+			if !setDeviceProperty(d, event.Property, event.Value) {
+				log.Printf("ignoring change to unknown property %q of %v", event.Property, event.MacAddr)
+			}
+		})
+	default:
+		// Added devices need their full state, which only a refresh can provide.
+		m.invalidate()
+	}
+}
+
+// setDeviceProperty sets the BluetoothDevice field named by a DevicePropertyChanged event. It returns false if the
+// property or the type of its value isn't one diffDevice would report.
+func setDeviceProperty(d *BluetoothDevice, property string, value any) bool {
+	var ok bool
+	switch property {
+	case "Name":
+		d.Name, ok = value.(string)
+	case "Alias":
+		d.Alias, ok = value.(string)
+	case "Class":
+		d.Class, ok = value.(uint32)
+	case "Icon":
+		d.Icon, ok = value.(string)
+	case "Paired":
+		d.Paired, ok = value.(bool)
+	case "Trusted":
+		d.Trusted, ok = value.(bool)
+	case "Blocked":
+		d.Blocked, ok = value.(bool)
+	case "Battery":
+		if value == nil {
+			d.Battery, ok = nil, true
+		} else if battery, isInt := value.(int); isInt {
+			d.Battery, ok = &battery, true
+		}
+	}
+	return ok
+}
+
+func (m *cachingBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	return m.snapshot(ctx)
+}
+
+// Get serves the device from the snapshot, and asks the backend about devices that aren't in it, since some backends
+// know about more devices than they list.
+func (m *cachingBluetoothManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	return m.get(ctx, "get", macAddr)
+}
+
+// get is Get, with op naming the operation if the policy rejects the device.
+func (m *cachingBluetoothManager) get(ctx context.Context, op string, macAddr MacAddress) (BluetoothDevice, error) {
+	devices, err := m.snapshot(ctx)
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+	for _, device := range devices {
+		if device.MacAddr == macAddr {
+			if err := m.policy.check(macAddr, &device); err != nil {
+				slog.Warn("rejected device operation", "op", op, "macAddr", macAddr, "err", err)
+				return BluetoothDevice{}, err
+			}
+			return device, nil
+		}
+	}
+	return m.inner.Get(ctx, macAddr)
+}
+
+func (m *cachingBluetoothManager) IsConnected(ctx context.Context, macAddr MacAddress) (bool, error) {
+	device, err := m.get(ctx, "is-connected", macAddr)
+	if err != nil {
+		return false, err
+	}
+	return device.Connected, nil
+}
+
+func (m *cachingBluetoothManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	if err := m.inner.Connect(ctx, macAddr); err != nil {
+		// The connection might have got partway, so we don't know what state the device is in now.
+		m.invalidate()
+		return err
+	}
+	m.update(macAddr, func(d *BluetoothDevice) { d.Connected = true })
+	return nil
+}
+
+func (m *cachingBluetoothManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	if err := m.inner.Disconnect(ctx, macAddr); err != nil {
+		m.invalidate()
+		return err
+	}
+	m.update(macAddr, func(d *BluetoothDevice) { d.Connected = false })
+	return nil
+}
+
+// invalidating calls op and then invalidates the snapshot, whether op succeeded or not.
+func (m *cachingBluetoothManager) invalidating(op func() error) error {
+	defer m.invalidate()
+	return op()
+}
+
+func (m *cachingBluetoothManager) Pair(ctx context.Context, macAddr MacAddress) error {
+	pairer, ok := m.inner.(DevicePairer)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return pairer.Pair(ctx, macAddr) })
+}
+
+func (m *cachingBluetoothManager) Trust(ctx context.Context, macAddr MacAddress) error {
+	truster, ok := m.inner.(DeviceTruster)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return truster.Trust(ctx, macAddr) })
+}
+
+func (m *cachingBluetoothManager) Untrust(ctx context.Context, macAddr MacAddress) error {
+	truster, ok := m.inner.(DeviceTruster)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return truster.Untrust(ctx, macAddr) })
+}
+
+func (m *cachingBluetoothManager) Remove(ctx context.Context, macAddr MacAddress) error {
+	remover, ok := m.inner.(DeviceRemover)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return remover.Remove(ctx, macAddr) })
+}
+
+func (m *cachingBluetoothManager) Block(ctx context.Context, macAddr MacAddress) error {
+	blocker, ok := m.inner.(DeviceBlocker)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return blocker.Block(ctx, macAddr) })
+}
+
+func (m *cachingBluetoothManager) Unblock(ctx context.Context, macAddr MacAddress) error {
+	blocker, ok := m.inner.(DeviceBlocker)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return blocker.Unblock(ctx, macAddr) })
+}
+
+// Scan invalidates the snapshot because some backends list the devices they discover.
+func (m *cachingBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	scanner, ok := m.inner.(Scanner)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	defer m.invalidate()
+	return scanner.Scan(ctx, duration)
+}
+
+func (m *cachingBluetoothManager) Adapters(ctx context.Context) ([]Adapter, error) {
+	adapterManager, ok := m.inner.(AdapterManager)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return adapterManager.Adapters(ctx)
+}
+
+// SetAdapterPowered invalidates the snapshot because powering an adapter off disconnects its devices.
+func (m *cachingBluetoothManager) SetAdapterPowered(ctx context.Context, adapter MacAddress, powered bool) error {
+	adapterManager, ok := m.inner.(AdapterManager)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.invalidating(func() error { return adapterManager.SetAdapterPowered(ctx, adapter, powered) })
+}
+
+// Unwrap returns the manager the cache wraps.
+func (m *cachingBluetoothManager) Unwrap() BluetoothManager {
+	return m.inner
+}
+
+// Watch forwards to the inner manager's DeviceWatcher, or polls the snapshot, which is cheap, if there isn't one.
+func (m *cachingBluetoothManager) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	if watcher, ok := m.inner.(DeviceWatcher); ok {
+		return watcher.Watch(ctx)
+	}
+	return pollDevices(ctx, m, defaultPollInterval)
+}
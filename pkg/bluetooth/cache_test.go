@@ -0,0 +1,201 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingManager lists a fixed set of devices and counts how often it's asked to.
+type countingManager struct {
+	BluetoothManager
+
+	mu         sync.Mutex
+	devices    []BluetoothDevice
+	listCalls  int
+	connectErr error
+}
+
+func (m *countingManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listCalls++
+	return append([]BluetoothDevice(nil), m.devices...), nil
+}
+
+func (m *countingManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	return m.connectErr
+}
+
+func (m *countingManager) calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.listCalls
+}
+
+func TestCachingManager(t *testing.T) {
+	headphones := BluetoothDevice{Name: "WF-1000XM4", MacAddr: MustParseMacAddress("f8:4e:17:66:e8:55"), Paired: true}
+	connected := headphones
+	connected.Connected = true
+	lowBattery := 15
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// prepare runs after the first List and before the second.
+		prepare   func(m *cachingBluetoothManager, inner *countingManager, clock *time.Time)
+		want      []BluetoothDevice
+		wantCalls int
+	}{
+		{"served from the snapshot", func(*cachingBluetoothManager, *countingManager, *time.Time) {},
+			[]BluetoothDevice{headphones}, 1},
+		{"connect updates the snapshot", func(m *cachingBluetoothManager, _ *countingManager, _ *time.Time) {
+			if err := m.Connect(ctx, headphones.MacAddr); err != nil {
+				t.Fatal(err)
+			}
+		}, []BluetoothDevice{connected}, 1},
+		{"failed connect invalidates the snapshot", func(m *cachingBluetoothManager, inner *countingManager, _ *time.Time) {
+			inner.connectErr = ErrConnectionRefused
+			if err := m.Connect(ctx, headphones.MacAddr); !errors.Is(err, ErrConnectionRefused) {
+				t.Fatalf("got %v, wanted ErrConnectionRefused", err)
+			}
+		}, []BluetoothDevice{headphones}, 2},
+		{"refresh", func(m *cachingBluetoothManager, inner *countingManager, _ *time.Time) {
+			inner.devices = []BluetoothDevice{connected}
+			if err := m.Refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}, []BluetoothDevice{connected}, 2},
+		{"stale snapshot is refetched", func(_ *cachingBluetoothManager, _ *countingManager, clock *time.Time) {
+			*clock = clock.Add(3 * time.Minute)
+		}, []BluetoothDevice{headphones}, 2},
+		{"connected event", func(m *cachingBluetoothManager, _ *countingManager, _ *time.Time) {
+			m.apply(DeviceEvent{Type: DeviceConnected, MacAddr: headphones.MacAddr})
+		}, []BluetoothDevice{connected}, 1},
+		{"property changed event", func(m *cachingBluetoothManager, _ *countingManager, _ *time.Time) {
+			m.apply(DeviceEvent{Type: DevicePropertyChanged, MacAddr: headphones.MacAddr, Property: "Name", Value: "Buds"})
+		}, []BluetoothDevice{{Name: "Buds", MacAddr: headphones.MacAddr, Paired: true}}, 1},
+		{"battery changed event", func(m *cachingBluetoothManager, _ *countingManager, _ *time.Time) {
+			m.apply(DeviceEvent{Type: DevicePropertyChanged, MacAddr: headphones.MacAddr, Property: "Battery", Value: 15})
+		}, []BluetoothDevice{{Name: headphones.Name, MacAddr: headphones.MacAddr, Paired: true, Battery: &lowBattery}}, 1},
+		{"removed event", func(m *cachingBluetoothManager, _ *countingManager, _ *time.Time) {
+			m.apply(DeviceEvent{Type: DeviceRemoved, MacAddr: headphones.MacAddr})
+		}, []BluetoothDevice{}, 1},
+		{"added event invalidates the snapshot", func(m *cachingBluetoothManager, _ *countingManager, _ *time.Time) {
+			m.apply(DeviceEvent{Type: DeviceAdded, MacAddr: MustParseMacAddress("cc:98:8b:20:7d:db")})
+		}, []BluetoothDevice{headphones}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &countingManager{devices: []BluetoothDevice{headphones}}
+			m := newCachingBluetoothManager(inner, time.Minute)
+			clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			m.now = func() time.Time { return clock }
+
+			if _, err := m.List(ctx); err != nil {
+				t.Fatal(err)
+			}
+			tt.prepare(m, inner, &clock)
+			got, err := m.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, wanted %v", got, tt.want)
+			}
+			if calls := inner.calls(); calls != tt.wantCalls {
+				t.Errorf("got %d List calls, wanted %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCachingManagerPolicy(t *testing.T) {
+	headphones := BluetoothDevice{Name: "WF-1000XM4", Alias: "Work Buds", MacAddr: MustParseMacAddress("f8:4e:17:66:e8:55")}
+	speaker := BluetoothDevice{Name: "Bose QC35 II", MacAddr: MustParseMacAddress("cc:98:8b:20:7d:db")}
+	inner := &countingManager{devices: []BluetoothDevice{headphones, speaker}}
+	safer := newSaferBluetoothManager(inner, DevicePolicy{Deny: []string{"work buds"}})
+	m := newCachingBluetoothManager(NewSerializingBluetoothManager(safer), time.Minute)
+	ctx := context.Background()
+
+	if err := m.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, headphones.MacAddr); !errors.Is(err, ErrDeviceNotAllowed) {
+		t.Errorf("Get: got %v, wanted ErrDeviceNotAllowed", err)
+	}
+	if _, err := m.IsConnected(ctx, headphones.MacAddr); !errors.Is(err, ErrDeviceNotAllowed) {
+		t.Errorf("IsConnected: got %v, wanted ErrDeviceNotAllowed", err)
+	}
+	if got, err := m.Get(ctx, speaker.MacAddr); err != nil || got != speaker {
+		t.Errorf("Get: got (%v, %v), wanted (%v, nil)", got, err, speaker)
+	}
+}
+
+func TestCachingManagerSnapshotAge(t *testing.T) {
+	m := newCachingBluetoothManager(&countingManager{}, time.Minute)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return clock }
+
+	if _, ok := m.SnapshotAge(); ok {
+		t.Errorf("got a snapshot age before the first List")
+	}
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(10 * time.Second)
+	if age, ok := m.SnapshotAge(); !ok || age != 10*time.Second {
+		t.Errorf("got (%v, %v), wanted (10s, true)", age, ok)
+	}
+	m.invalidate()
+	if _, ok := m.SnapshotAge(); ok {
+		t.Errorf("got a snapshot age after invalidating")
+	}
+}
+
+// watchingManager pushes events.
+type watchingManager struct {
+	countingManager
+}
+
+func (m *watchingManager) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	return make(chan DeviceEvent), nil
+}
+
+// decoratingManager is a wrapper from outside the package, which only knows to implement Unwrap.
+type decoratingManager struct {
+	BluetoothManager
+}
+
+func (m decoratingManager) Unwrap() BluetoothManager {
+	return m.BluetoothManager
+}
+
+func TestEventSource(t *testing.T) {
+	wrap := func(m BluetoothManager) BluetoothManager {
+		return decoratingManager{NewSerializingBluetoothManager(newSaferBluetoothManager(m, DevicePolicy{}))}
+	}
+	watching := &watchingManager{}
+
+	tests := []struct {
+		name string
+		m    BluetoothManager
+		want DeviceWatcher
+	}{
+		{"backend", watching, watching},
+		{"wrapped backend", wrap(watching), watching},
+		{"polling backend", wrap(&countingManager{}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := eventSource(tt.m)
+			if ok != (tt.want != nil) || got != tt.want {
+				t.Errorf("got (%v, %v), wanted %v", got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package bluetooth
+
+import (
+	"context"
+	"time"
+)
+
+// Optional capabilities a BluetoothManager can implement on top of the basic interface. Not every backend supports
+// every operation (blueutil has no concept of trusting or blocking a device, for example). The manager returned by
+// NewBluetoothManager implements all of them and returns ErrUnsupported if the backend doesn't, so callers that want
+// to know up front should check with Capability rather than a type assertion.
+
+// A DevicePairer can pair with a device that's in range and discoverable.
+type DevicePairer interface {
+	Pair(ctx context.Context, macAddr MacAddress) error
+}
+
+// A DeviceTruster can mark a device as trusted, which lets it connect to the host without asking for authorization.
+type DeviceTruster interface {
+	Trust(ctx context.Context, macAddr MacAddress) error
+	Untrust(ctx context.Context, macAddr MacAddress) error
+}
+
+// A DeviceRemover can forget a device, removing its pairing and any other state the host keeps about it.
+type DeviceRemover interface {
+	Remove(ctx context.Context, macAddr MacAddress) error
+}
+
+// A DeviceBlocker can block a device, preventing it from connecting to the host at all.
+type DeviceBlocker interface {
+	Block(ctx context.Context, macAddr MacAddress) error
+	Unblock(ctx context.Context, macAddr MacAddress) error
+}
+
+// A DiscoveredDevice is a device found by a Scanner. Fields other than MacAddr are only set if the device advertised
+// them during the scan.
+type DiscoveredDevice struct {
+	Name    string
+	MacAddr MacAddress
+	// RSSI is the received signal strength in dBm. Closer to zero is stronger.
+	RSSI *int `json:",omitempty"`
+	// Class is the Bluetooth Class of Device. See BluetoothDevice.Class.
+	Class uint32 `json:",omitempty"`
+}
+
+// A Scanner can search for nearby devices, including ones that haven't been paired yet.
+type Scanner interface {
+	// Scan runs device discovery for the given duration and returns the devices that were found. ctx must allow at
+	// least that long.
+	Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error)
+}
+
+// An Adapter is a Bluetooth controller attached to this host.
+type Adapter struct {
+	Name         string
+	MacAddr      MacAddress
+	Powered      bool
+	Discoverable bool
+	Pairable     bool
+	// Selected is true for the adapter the manager operates on: the one it's pinned to (see Options.Adapter), or the
+	// system's default adapter if it isn't pinned.
+	Selected bool
+}
+
+// An AdapterManager can list the host's Bluetooth adapters and turn them on and off.
+type AdapterManager interface {
+	Adapters(ctx context.Context) ([]Adapter, error)
+	SetAdapterPowered(ctx context.Context, adapter MacAddress, powered bool) error
+}
@@ -0,0 +1,140 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A ConnectPolicy controls how backends make sure Connect worked. A connect command that exits cleanly doesn't mean
+// the device is connected: it can take a few seconds to come up, or drop straight back off. So after connecting,
+// backends wait for the device to report itself connected, and retry transient failures (ErrDeviceBusy, or the device
+// not coming up in time) with exponential backoff. Zero fields take their value from DefaultConnectPolicy.
+type ConnectPolicy struct {
+	// Attempts is how many times to try connecting before giving up.
+	Attempts int
+	// Backoff is how long to wait before the first retry. It doubles for each retry after that, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// VerifyTimeout is how long to wait for the device to report itself connected after each attempt.
+	VerifyTimeout time.Duration
+	// PollInterval is how often to check whether the device is connected while waiting.
+	PollInterval time.Duration
+}
+
+// DefaultConnectPolicy is the ConnectPolicy backends use unless Options.Connect says otherwise.
+var DefaultConnectPolicy = ConnectPolicy{
+	Attempts:      3,
+	Backoff:       500 * time.Millisecond,
+	MaxBackoff:    4 * time.Second,
+	VerifyTimeout: 5 * time.Second,
+	PollInterval:  250 * time.Millisecond,
+}
+
+// withDefaults fills in the zero fields of p from DefaultConnectPolicy.
+func (p ConnectPolicy) withDefaults() ConnectPolicy {
+	if p.Attempts <= 0 {
+		p.Attempts = DefaultConnectPolicy.Attempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = DefaultConnectPolicy.Backoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultConnectPolicy.MaxBackoff
+	}
+	if p.VerifyTimeout <= 0 {
+		p.VerifyTimeout = DefaultConnectPolicy.VerifyTimeout
+	}
+	if p.PollInterval <= 0 {
+		p.PollInterval = DefaultConnectPolicy.PollInterval
+	}
+	return p
+}
+
+// MaxDuration returns the longest a backend's Connect can take with the policy, if each attempt to connect takes at
+// most callTimeout before it's verified: every attempt, its VerifyTimeout and the backoff after it.
+func (p ConnectPolicy) MaxDuration(callTimeout time.Duration) time.Duration {
+	p = p.withDefaults()
+	total := time.Duration(p.Attempts) * (callTimeout + p.VerifyTimeout)
+	backoff := p.Backoff
+	for retry := 1; retry < p.Attempts; retry++ {
+		total += backoff
+		backoff = min(backoff*2, p.MaxBackoff)
+	}
+	return total
+}
+
+// connectVerified connects to a device with connect, then waits for isConnected to report it connected, following
+// the policy. If every attempt fails, the error says how many were made and wraps the last attempt's error.
+func connectVerified(
+	ctx context.Context, policy ConnectPolicy, macAddr MacAddress,
+	connect func(context.Context) error, isConnected func(context.Context) (bool, error),
+) error {
+	policy = policy.withDefaults()
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := connect(ctx)
+		if err == nil {
+			err = waitConnected(ctx, policy, macAddr, isConnected)
+		}
+		if err == nil {
+			return nil
+		}
+		if !retryableConnectError(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt == policy.Attempts {
+			return fmt.Errorf("giving up on connecting to %v after %d attempts: %w", macAddr, attempt, err)
+		}
+
+		log.Printf("connecting to %v failed (attempt %d of %d), retrying in %v: %v",
+			macAddr, attempt, policy.Attempts, backoff, err)
+		if err := sleepContext(ctx, backoff); err != nil {
+			return fmt.Errorf("%w: waiting to retry connecting to %v: %w", ErrBackendTimeout, macAddr, err)
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+// retryableConnectError returns true for errors that another connection attempt might get past.
+func retryableConnectError(err error) bool {
+	return errors.Is(err, ErrDeviceBusy) || errors.Is(err, ErrConnectTimeout)
+}
+
+// waitConnected polls isConnected until it reports the device connected, returning ErrConnectTimeout if that doesn't
+// happen within the policy's VerifyTimeout.
+func waitConnected(
+	ctx context.Context, policy ConnectPolicy, macAddr MacAddress, isConnected func(context.Context) (bool, error),
+) error {
+	deadline := time.Now().Add(policy.VerifyTimeout)
+	for {
+		connected, err := isConnected(ctx)
+		if err != nil {
+			return fmt.Errorf("checking whether %v connected: %w", macAddr, err)
+		}
+		if connected {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %v still wasn't connected %v after connecting", ErrConnectTimeout, macAddr,
+				policy.VerifyTimeout)
+		}
+		if err := sleepContext(ctx, min(policy.PollInterval, time.Until(deadline))); err != nil {
+			return fmt.Errorf("%w: waiting for %v to connect: %w", ErrBackendTimeout, macAddr, err)
+		}
+	}
+}
+
+// sleepContext sleeps for d, returning ctx's error if it's done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectVerified(t *testing.T) {
+	mac := MustParseMacAddress("f8:4e:17:66:e8:55")
+	busy := fmt.Errorf("%w: br-connection-busy", ErrDeviceBusy)
+	policy := ConnectPolicy{
+		Attempts:      3,
+		Backoff:       time.Millisecond,
+		VerifyTimeout: 20 * time.Millisecond,
+		PollInterval:  time.Millisecond,
+	}
+
+	tests := []struct {
+		name string
+		// connectErrs are returned by successive connect calls, which succeed once they run out.
+		connectErrs []error
+		// connectedAfter is how many IsConnected checks report false before the device comes up, or -1 for never.
+		connectedAfter int
+		wantErr        error
+		wantErrText    string
+		wantConnects   int
+	}{
+		{name: "connects", wantConnects: 1},
+		{name: "takes a while to come up", connectedAfter: 3, wantConnects: 1},
+		{name: "busy then connects", connectErrs: []error{busy, busy}, wantConnects: 3},
+		{
+			name:         "always busy",
+			connectErrs:  []error{busy, busy, busy},
+			wantErr:      ErrDeviceBusy,
+			wantErrText:  "after 3 attempts",
+			wantConnects: 3,
+		},
+		{
+			name:           "never comes up",
+			connectedAfter: -1,
+			wantErr:        ErrConnectTimeout,
+			wantErrText:    "after 3 attempts",
+			wantConnects:   3,
+		},
+		{
+			name:         "refused",
+			connectErrs:  []error{ErrConnectionRefused},
+			wantErr:      ErrConnectionRefused,
+			wantConnects: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connects, checks := 0, 0
+			connect := func(context.Context) error {
+				connects++
+				if connects <= len(tt.connectErrs) {
+					return tt.connectErrs[connects-1]
+				}
+				return nil
+			}
+			isConnected := func(context.Context) (bool, error) {
+				checks++
+				return tt.connectedAfter >= 0 && checks > tt.connectedAfter, nil
+			}
+
+			err := connectVerified(context.Background(), policy, mac, connect, isConnected)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("got %v, wanted no error", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, wanted %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrText) {
+				t.Errorf("got %q, wanted it to contain %q", err, tt.wantErrText)
+			}
+			if connects != tt.wantConnects {
+				t.Errorf("got %d connects, wanted %d", connects, tt.wantConnects)
+			}
+		})
+	}
+}
+
+func TestConnectVerifiedCanceled(t *testing.T) {
+	mac := MustParseMacAddress("f8:4e:17:66:e8:55")
+	ctx, cancel := context.WithCancel(context.Background())
+	connects := 0
+	connect := func(context.Context) error {
+		connects++
+		cancel()
+		return ErrDeviceBusy
+	}
+	isConnected := func(context.Context) (bool, error) { return true, nil }
+
+	err := connectVerified(ctx, ConnectPolicy{Attempts: 3, Backoff: time.Hour}, mac, connect, isConnected)
+	if !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("got %v, wanted ErrDeviceBusy", err)
+	}
+	if connects != 1 {
+		t.Errorf("got %d connects, wanted 1", connects)
+	}
+}
+
+func TestConnectPolicyMaxDuration(t *testing.T) {
+	policy := ConnectPolicy{
+		Attempts: 3, Backoff: time.Second, MaxBackoff: 1500 * time.Millisecond, VerifyTimeout: 2 * time.Second,
+	}
+	// Three attempts of 1s+2s, and backoffs of 1s and 1.5s between them.
+	if got, want := policy.MaxDuration(time.Second), 11500*time.Millisecond; got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package bluetooth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by BluetoothManager implementations. Backends wrap the underlying error (usually a *CommandError or
+// a D-Bus error) so callers can use errors.Is to check which of these they got and errors.As to dig out the details.
+var (
+	ErrDeviceNotFound    = errors.New("device not found")
+	ErrNotPaired         = errors.New("device not paired")
+	ErrAdapterPoweredOff = errors.New("bluetooth adapter is powered off")
+	// ErrAdapterNotFound is returned when there's no Bluetooth adapter, or when the one we're pinned to (see
+	// Options.Adapter) isn't present.
+	ErrAdapterNotFound   = errors.New("bluetooth adapter not found")
+	ErrBackendTimeout    = errors.New("timed out waiting for bluetooth backend")
+	ErrConnectionRefused = errors.New("connection refused by device")
+	// ErrUnsupported is returned when the backend doesn't implement an optional capability like DevicePairer.
+	ErrUnsupported = errors.New("operation not supported by this bluetooth backend")
+	// ErrDeviceBusy is returned when the device or adapter is busy with another operation, e.g. a connection that's
+	// already in progress. It's usually worth trying again shortly.
+	ErrDeviceBusy = errors.New("device busy")
+	// ErrConnectTimeout is returned when a connect command succeeded but the device didn't report itself connected in
+	// time. See ConnectPolicy.
+	ErrConnectTimeout = errors.New("device didn't connect in time")
+	// ErrUnknownDevice is returned when asked to operate on a device the backend doesn't list, which is never
+	// allowed (see saferBluetoothManager).
+	ErrUnknownDevice = errors.New("device isn't known to this host")
+	// ErrDeviceNotAllowed is returned when the DevicePolicy doesn't allow operating on a device.
+	ErrDeviceNotAllowed = errors.New("device not allowed")
+)
+
+// A CommandError describes an external command that failed, either by exiting non-zero or by printing output that we
+// recognize as a failure.
+type CommandError struct {
+	Command string
+	Args    []string
+	// ExitCode is the command's exit code, or -1 if it didn't exit normally (e.g. it couldn't be started or was killed
+	// when its context expired).
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Command, strings.Join(e.Args, " "), e.Err)
+	// Most of our commands print a single line explaining what went wrong, so include it if there is one.
+	if detail := firstLine(e.Stderr); detail != "" {
+		msg += ": " + detail
+	} else if detail := firstLine(e.Stdout); detail != "" {
+		msg += ": " + detail
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func firstLine(b []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(b), []byte("\n"))
+	return string(bytes.TrimSpace(line))
+}
+
+// An errorPattern maps a substring of a backend's output to one of our sentinel errors.
+type errorPattern struct {
+	substr string
+	err    error
+}
+
+// classifyOutput returns the sentinel error for the first pattern found in output, or nil if none match. Matching is
+// case-insensitive since the tools we wrap aren't consistent about capitalization.
+func classifyOutput(patterns []errorPattern, output ...[]byte) error {
+	for _, o := range output {
+		lower := bytes.ToLower(o)
+		for _, p := range patterns {
+			if bytes.Contains(lower, []byte(strings.ToLower(p.substr))) {
+				return p.err
+			}
+		}
+	}
+	return nil
+}
+
+// classifyCommandError turns the result of runCmd into one of our sentinel errors where possible.
+//
+// Some tools print an error and still exit zero, so the output is checked even if err is nil. If the output doesn't
+// match any pattern and the command succeeded, classifyCommandError returns nil.
+func classifyCommandError(patterns []errorPattern, output []byte, err error) error {
+	var cmdErr *CommandError
+	if err != nil && !errors.As(err, &cmdErr) {
+		// runCmd always returns a *CommandError, so this shouldn't happen, but don't throw the error away if it does.
+		return err
+	}
+
+	var stderr []byte
+	if cmdErr != nil {
+		if errors.Is(cmdErr.Err, context.DeadlineExceeded) {
+			return fmt.Errorf("%w: %w", ErrBackendTimeout, cmdErr)
+		}
+		stderr = cmdErr.Stderr
+	}
+
+	sentinel := classifyOutput(patterns, stderr, output)
+	switch {
+	case sentinel == nil && err == nil:
+		return nil
+	case sentinel == nil:
+		return err
+	case err == nil:
+		// The command exited zero but printed an error, so there's no *CommandError to wrap yet.
+		return fmt.Errorf("%w: %s", sentinel, firstLine(output))
+	default:
+		return fmt.Errorf("%w: %w", sentinel, err)
+	}
+}
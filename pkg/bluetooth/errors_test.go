@@ -0,0 +1,88 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExecRunnerCommandError(t *testing.T) {
+	_, err := ExecRunner{}.Run(context.Background(), nil, "sh", "-c", "echo out; echo oops >&2; exit 3")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("got %v, wanted a *CommandError", err)
+	}
+	if cmdErr.ExitCode != 3 {
+		t.Errorf("got exit code %d, wanted 3", cmdErr.ExitCode)
+	}
+	if string(cmdErr.Stdout) != "out\n" || string(cmdErr.Stderr) != "oops\n" {
+		t.Errorf("got stdout %q and stderr %q", cmdErr.Stdout, cmdErr.Stderr)
+	}
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	output, err := ExecRunner{}.Run(ctx, nil, "sleep", "5")
+	err = bluetoothctlError(output, err)
+	if !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+}
+
+func TestBluetoothctlError(t *testing.T) {
+	failed := &CommandError{Command: "bluetoothctl", ExitCode: 1, Err: errors.New("exit status 1")}
+	tests := []struct {
+		name   string
+		output string
+		err    error
+		want   error
+	}{
+		{"success", "Attempting to connect to F8:4E:17:66:E8:55\nConnection successful\n", nil, nil},
+		{"unknown device", "Device F8:4E:17:66:E8:55 not available\n", failed, ErrDeviceNotFound},
+		// Older versions of bluetoothctl exit zero even when the device doesn't exist.
+		{"unknown device exit zero", "Device F8:4E:17:66:E8:55 not available\n", nil, ErrDeviceNotFound},
+		{"powered off", "Attempting to connect to F8:4E:17:66:E8:55\nFailed to connect: org.bluez.Error.NotReady\n", failed, ErrAdapterPoweredOff},
+		{"refused", "Failed to connect: org.bluez.Error.Failed br-connection-refused\n", failed, ErrConnectionRefused},
+		{"auth rejected", "Failed to connect: org.bluez.Error.AuthenticationRejected\n", failed, ErrNotPaired},
+		{"no adapter", "No default controller available\n", failed, ErrAdapterNotFound},
+		{"select missing adapter", "Controller 5C:F3:70:9B:2E:01 not available\n", nil, ErrAdapterNotFound},
+		{"unrecognized", "something else entirely\n", failed, failed},
+		// Device names are printed along with everything else, and mustn't be mistaken for errors.
+		{"device names", "Device F8:4E:17:66:E8:55 Not Available\nDevice CC:98:8B:20:7D:DB Connection refused\n" +
+			"Device 4C:87:5D:2A:11:9F not available (lounge)\n", nil, nil},
+		{"device info", "Device F8:4E:17:66:E8:55 (public)\n\tName: Connection refused\n\tAlias: not available\n" +
+			"\tConnected: no\n", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := bluetoothctlError([]byte(tt.output), tt.err)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("got %v, wanted nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, wanted %v", err, tt.want)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, wanted it to wrap %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBlueutilError(t *testing.T) {
+	err := blueutilError(nil, &CommandError{
+		Command:  "blueutil",
+		ExitCode: 1,
+		Stderr:   []byte("Device not found by address: cc-98-8b-20-7d-db\n"),
+		Err:      errors.New("exit status 1"),
+	})
+	if !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("got %v, wanted ErrDeviceNotFound", err)
+	}
+}
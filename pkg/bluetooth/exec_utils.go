@@ -1,8 +1,16 @@
 package bluetooth
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os/exec"
+	"strconv"
+	"time"
 )
 
 // onPath returns true if the named executable is on the $PATH. This will return
@@ -13,6 +21,175 @@ func onPath(executable string) bool {
 	return err == nil
 }
 
-func runCmd(ctx context.Context, cmd string, args ...string) ([]byte, error) {
-	return exec.CommandContext(ctx, cmd, args...).Output()
+// requireExecutable returns an error if the named executable isn't on the $PATH.
+func requireExecutable(executable string) error {
+	if _, err := exec.LookPath(executable); err != nil {
+		return fmt.Errorf("couldn't find %s on the path: %w", executable, err)
+	}
+	return nil
+}
+
+// wholeSeconds formats d as a whole number of seconds, rounding up and never returning less than one, for commands
+// that take a duration in seconds.
+func wholeSeconds(d time.Duration) string {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// A CommandRunner runs an external command, feeding it stdin if that isn't nil, and returns its stdout. If the
+// command fails, the error should be a *CommandError carrying its exit code and output so the backend can work out
+// what went wrong.
+//
+// The backends that shell out take one when they're constructed (see Options.Runner), so tests can substitute canned
+// output for the real command. ExecRunner is the real implementation.
+type CommandRunner interface {
+	Run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error)
+}
+
+// CommandRunnerFunc adapts an ordinary function to a CommandRunner.
+type CommandRunnerFunc func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error)
+
+func (f CommandRunnerFunc) Run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+	return f(ctx, stdin, cmd, args...)
+}
+
+// ExecRunner is the CommandRunner that actually runs commands, with exec.CommandContext so they're killed when the
+// context is done.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+	c := exec.CommandContext(ctx, cmd, args...)
+	if stdin != nil {
+		c.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	output := stdout.Bytes()
+	if err != nil {
+		cmdErr := &CommandError{Command: cmd, Args: args, ExitCode: -1, Stdout: output, Stderr: stderr.Bytes(), Err: err}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			cmdErr.ExitCode = exitErr.ExitCode()
+		}
+		// If the context expired, the process was killed, and the "signal: killed" error it produced isn't very
+		// helpful, so report the context's error instead.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			cmdErr.Err = ctxErr
+		}
+		return output, cmdErr
+	}
+	return output, nil
+}
+
+// traceOutputLimit is how much of a command's stdin, stdout and stderr TracingRunner logs.
+const traceOutputLimit = 512
+
+// TracingRunner wraps another CommandRunner and logs every command it runs through slog at debug level, with its
+// argv, how long it took, its exit code and the start of its output. Backends trace their commands this way, so
+// setting the log level to debug is usually the first step in working out why a backend is misbehaving.
+type TracingRunner struct {
+	Runner CommandRunner
+	// Logger is the logger to use. If it's nil, slog.Default() is used.
+	Logger *slog.Logger
+}
+
+func (r TracingRunner) Run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+	logger := r.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return r.Runner.Run(ctx, stdin, cmd, args...)
+	}
+
+	start := time.Now()
+	output, err := r.Runner.Run(ctx, stdin, cmd, args...)
+	duration := time.Since(start)
+
+	exitCode := 0
+	var stderr []byte
+	if err != nil {
+		exitCode = -1
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			exitCode = cmdErr.ExitCode
+			stderr = cmdErr.Stderr
+		}
+	}
+	attrs := []any{
+		"argv", append([]string{cmd}, args...),
+		"duration", duration,
+		"exitCode", exitCode,
+		"stdout", truncateOutput(output),
+	}
+	if stdin != nil {
+		attrs = append(attrs, "stdin", truncateOutput(stdin))
+	}
+	if stderr != nil {
+		attrs = append(attrs, "stderr", truncateOutput(stderr))
+	}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	logger.DebugContext(ctx, "ran command", attrs...)
+	return output, err
+}
+
+// truncateOutput returns the start of a command's output for logging.
+func truncateOutput(output []byte) string {
+	if len(output) <= traceOutputLimit {
+		return string(output)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", output[:traceOutputLimit], len(output))
+}
+
+// A streamRunner starts a long-running command and returns its stdout to read as it's produced. stdin is written to
+// the command's input, which is then left open so interactive tools like bluetoothctl don't exit when they reach the
+// end of it. Closing the returned reader stops the command. streamCmd is the real implementation.
+type streamRunner func(ctx context.Context, stdin []byte, cmd string, args ...string) (io.ReadCloser, error)
+
+func streamCmd(ctx context.Context, stdin []byte, cmd string, args ...string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := exec.CommandContext(ctx, cmd, args...)
+	input, err := c.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	output, err := c.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		cancel()
+		return nil, &CommandError{Command: cmd, Args: args, ExitCode: -1, Err: err}
+	}
+	if _, err := input.Write(stdin); err != nil {
+		cancel()
+		_ = c.Wait()
+		return nil, &CommandError{Command: cmd, Args: args, ExitCode: -1, Err: err}
+	}
+	return &streamedCmd{ReadCloser: output, cmd: c, stdin: input, cancel: cancel}, nil
+}
+
+// streamedCmd is the stdout of a command started by streamCmd.
+type streamedCmd struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	cancel context.CancelFunc
+}
+
+func (s *streamedCmd) Close() error {
+	_ = s.stdin.Close()
+	s.cancel()
+	// The command was killed, so the error from Wait isn't interesting.
+	_ = s.cmd.Wait()
+	return nil
 }
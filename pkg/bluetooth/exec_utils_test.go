@@ -0,0 +1,96 @@
+package bluetooth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWholeSeconds(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "1",
+		500 * time.Millisecond:  "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+		10 * time.Second:        "10",
+	} {
+		if got := wholeSeconds(d); got != want {
+			t.Errorf("%v: got %q, wanted %q", d, got, want)
+		}
+	}
+}
+
+func TestStreamCmd(t *testing.T) {
+	if !onPath("cat") {
+		t.Skip("cat not found on the path")
+	}
+	stream, err := streamCmd(context.Background(), []byte("hello\n"), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cat would wait for more input forever, so this also checks that Close stops it.
+	defer stream.Close()
+
+	line, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("got (%q, %v), wanted %q", line, err, "hello\n")
+	}
+}
+
+func TestTracingRunner(t *testing.T) {
+	fake := CommandRunnerFunc(func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		return []byte("Attempting to connect\n"), &CommandError{
+			Command: cmd, Args: args, ExitCode: 3, Stderr: []byte("oops\n"), Err: errors.New("exit status 3"),
+		}
+	})
+
+	tests := []struct {
+		name  string
+		level slog.Level
+		want  []string
+	}{
+		{"debug", slog.LevelDebug, []string{
+			`"msg":"ran command"`,
+			`"argv":["bluetoothctl","connect","F8:4E:17:66:E8:55"]`,
+			`"exitCode":3`,
+			`"stdout":"Attempting to connect\n"`,
+			`"stderr":"oops\n"`,
+		}},
+		{"info", slog.LevelInfo, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: tt.level}))
+			run := TracingRunner{Runner: fake, Logger: logger}
+			output, err := run.Run(context.Background(), nil, "bluetoothctl", "connect", "F8:4E:17:66:E8:55")
+			if string(output) != "Attempting to connect\n" || err == nil {
+				t.Errorf("got (%q, %v), wanted the wrapped runner's result", output, err)
+			}
+
+			logged := buf.String()
+			if tt.want == nil && logged != "" {
+				t.Errorf("got %q, wanted nothing logged", logged)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(logged, want) {
+					t.Errorf("got %q, wanted it to contain %q", logged, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), traceOutputLimit+10)
+	want := strings.Repeat("x", traceOutputLimit) + fmt.Sprintf("... (%d bytes)", len(long))
+	if got := truncateOutput(long); got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
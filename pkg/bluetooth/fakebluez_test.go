@@ -0,0 +1,412 @@
+package bluetooth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startTestBus starts a private dbus-daemon for the duration of the test and returns its address. The test is skipped
+// if dbus-daemon isn't installed.
+func startTestBus(t *testing.T) string {
+	t.Helper()
+	if !onPath("dbus-daemon") {
+		t.Skip("dbus-daemon not found on the path")
+	}
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(configPath, []byte(fmt.Sprintf(testBusConfig, dir)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("dbus-daemon", "--config-file="+configPath, "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading dbus-daemon address: %v", err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+// connectTestBus opens a new connection to the bus at addr that's closed when the test finishes.
+func connectTestBus(t *testing.T, addr string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatalf("connecting to test bus: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// fakeBluez serves a minimal imitation of the org.bluez object tree: an ObjectManager at / plus whatever adapters and
+// devices the test adds.
+type fakeBluez struct {
+	t    *testing.T
+	conn *dbus.Conn
+
+	mu      sync.Mutex
+	objects map[dbus.ObjectPath]*fakeBluezObject
+	// nearby holds devices that appear under an adapter once discovery starts on it.
+	nearby map[dbus.ObjectPath][]fakeNearbyDevice
+}
+
+type fakeNearbyDevice struct {
+	address string
+	name    string
+	rssi    int16
+}
+
+type fakeBluezObject struct {
+	ifaces []string
+	props  *prop.Properties
+}
+
+// fakeBluezDevice implements the org.bluez.Device1 methods for a single device.
+type fakeBluezDevice struct {
+	bluez *fakeBluez
+	path  dbus.ObjectPath
+
+	// connectErr, if set, is returned from Connect instead of connecting the device. It's guarded by bluez.mu, since
+	// Connect runs on the bus's goroutine; use SetConnectErr.
+	connectErr *dbus.Error
+}
+
+// startFakeBluez claims the org.bluez name on the bus at addr and returns a fake with no adapters or devices.
+func startFakeBluez(t *testing.T, addr string) *fakeBluez {
+	t.Helper()
+	conn := connectTestBus(t, addr)
+	f := &fakeBluez{
+		t:       t,
+		conn:    conn,
+		objects: map[dbus.ObjectPath]*fakeBluezObject{},
+		nearby:  map[dbus.ObjectPath][]fakeNearbyDevice{},
+	}
+
+	if err := conn.ExportMethodTable(map[string]any{
+		"GetManagedObjects": f.getManagedObjects,
+	}, "/", dbusObjectManager); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := conn.RequestName(bluezBusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("couldn't claim %s: reply %v", bluezBusName, reply)
+	}
+	return f
+}
+
+func (f *fakeBluez) getManagedObjects() (bluezObjects, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	objects := bluezObjects{}
+	for path, obj := range f.objects {
+		objects[path] = map[string]map[string]dbus.Variant{}
+		for _, iface := range obj.ifaces {
+			props, err := obj.props.GetAll(iface)
+			if err != nil {
+				return nil, err
+			}
+			objects[path][iface] = props
+		}
+	}
+	return objects, nil
+}
+
+func (f *fakeBluez) export(path dbus.ObjectPath, iface string, props map[string]any) *prop.Properties {
+	f.t.Helper()
+	propMap := map[string]*prop.Prop{}
+	for name, value := range props {
+		propMap[name] = &prop.Prop{Value: value, Writable: true, Emit: prop.EmitTrue}
+	}
+	p, err := prop.Export(f.conn, path, prop.Map{iface: propMap})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[path] = &fakeBluezObject{ifaces: []string{iface}, props: p}
+	return p
+}
+
+// fakeBluezAdapter implements the org.bluez.Adapter1 methods for a single adapter.
+type fakeBluezAdapter struct {
+	bluez *fakeBluez
+	path  dbus.ObjectPath
+}
+
+// AddAdapter adds an adapter object such as /org/bluez/hci0.
+func (f *fakeBluez) AddAdapter(name, address string) dbus.ObjectPath {
+	path := dbus.ObjectPath("/org/bluez/" + name)
+	f.export(path, bluezAdapterIface, map[string]any{
+		"Address":      address,
+		"Name":         name,
+		"Alias":        name,
+		"Powered":      true,
+		"Discoverable": false,
+		"Pairable":     true,
+		"Discovering":  false,
+	})
+	if err := f.conn.Export(&fakeBluezAdapter{bluez: f, path: path}, path, bluezAdapterIface); err != nil {
+		f.t.Fatal(err)
+	}
+	return path
+}
+
+// Has returns true if there's an object at path.
+func (f *fakeBluez) Has(path dbus.ObjectPath) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects[path]
+	return ok
+}
+
+func (a *fakeBluezAdapter) RemoveDevice(device dbus.ObjectPath) *dbus.Error {
+	f := a.bluez
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.objects[device]; !ok {
+		return dbus.NewError("org.bluez.Error.DoesNotExist", []any{"Does Not Exist"})
+	}
+	delete(f.objects, device)
+	_ = f.conn.Export(nil, device, bluezDeviceIface)
+	_ = f.conn.Export(nil, device, dbusPropertiesIface)
+	_ = f.conn.Emit("/", dbusObjectManager+".InterfacesRemoved", device, []string{bluezDeviceIface})
+	return nil
+}
+
+// AddNearbyDevice adds an unpaired device that only shows up once discovery is started on the adapter, like a real
+// device that's in range but that BlueZ hasn't seen yet.
+func (f *fakeBluez) AddNearbyDevice(adapter dbus.ObjectPath, address, name string, rssi int16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nearby[adapter] = append(f.nearby[adapter], fakeNearbyDevice{address: address, name: name, rssi: rssi})
+}
+
+func (a *fakeBluezAdapter) StartDiscovery() *dbus.Error {
+	f := a.bluez
+	if f.Prop(a.path, bluezAdapterIface, "Discovering") == true {
+		return dbus.NewError("org.bluez.Error.InProgress", []any{"Operation already in progress"})
+	}
+	f.setProp(a.path, bluezAdapterIface, "Discovering", true)
+
+	f.mu.Lock()
+	nearby := f.nearby[a.path]
+	delete(f.nearby, a.path)
+	f.mu.Unlock()
+	for _, d := range nearby {
+		f.addDevice(a.path, d.address, map[string]any{
+			"Name":      d.name,
+			"Alias":     d.name,
+			"Class":     uint32(0x240404),
+			"Paired":    false,
+			"Trusted":   false,
+			"Blocked":   false,
+			"Connected": false,
+			"RSSI":      d.rssi,
+		})
+	}
+	return nil
+}
+
+func (a *fakeBluezAdapter) StopDiscovery() *dbus.Error {
+	if a.bluez.Prop(a.path, bluezAdapterIface, "Discovering") != true {
+		return dbus.NewError("org.bluez.Error.Failed", []any{"No discovery started"})
+	}
+	a.bluez.setProp(a.path, bluezAdapterIface, "Discovering", false)
+	return nil
+}
+
+// AddDevice adds a device under the given adapter and returns a handle to its method implementations.
+func (f *fakeBluez) AddDevice(adapter dbus.ObjectPath, address, name string, connected bool) *fakeBluezDevice {
+	return f.addDevice(adapter, address, map[string]any{
+		"Name":      name,
+		"Alias":     name,
+		"Class":     uint32(0x240404),
+		"Icon":      "audio-headset",
+		"Paired":    true,
+		"Trusted":   false,
+		"Blocked":   false,
+		"Connected": connected,
+	})
+}
+
+func (f *fakeBluez) addDevice(adapter dbus.ObjectPath, address string, props map[string]any) *fakeBluezDevice {
+	path := dbus.ObjectPath(fmt.Sprintf("%s/dev_%s", adapter, strings.ReplaceAll(strings.ToUpper(address), ":", "_")))
+	props["Address"] = strings.ToUpper(address)
+	props["Adapter"] = adapter
+	p := f.export(path, bluezDeviceIface, props)
+
+	device := &fakeBluezDevice{bluez: f, path: path}
+	if err := f.conn.Export(device, path, bluezDeviceIface); err != nil {
+		f.t.Fatal(err)
+	}
+	all, _ := p.GetAll(bluezDeviceIface)
+	if err := f.conn.Emit("/", dbusObjectManager+".InterfacesAdded", path, map[string]map[string]dbus.Variant{
+		bluezDeviceIface: all,
+	}); err != nil {
+		f.t.Fatal(err)
+	}
+	return device
+}
+
+// Prop returns the current value of a property on the object at path.
+func (f *fakeBluez) Prop(path dbus.ObjectPath, iface, name string) any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[path].props.GetMust(iface, name)
+}
+
+func (f *fakeBluez) setProp(path dbus.ObjectPath, iface, name string, value any) {
+	f.mu.Lock()
+	obj := f.objects[path]
+	f.mu.Unlock()
+	obj.props.SetMust(iface, name, value)
+}
+
+// SetConnectErr makes Connect fail with err, or connect the device again if err is nil.
+func (d *fakeBluezDevice) SetConnectErr(err *dbus.Error) {
+	d.bluez.mu.Lock()
+	defer d.bluez.mu.Unlock()
+	d.connectErr = err
+}
+
+func (d *fakeBluezDevice) Connect() *dbus.Error {
+	d.bluez.mu.Lock()
+	err := d.connectErr
+	d.bluez.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.bluez.setProp(d.path, bluezDeviceIface, "Connected", true)
+	return nil
+}
+
+func (d *fakeBluezDevice) Pair() *dbus.Error {
+	if d.bluez.Prop(d.path, bluezDeviceIface, "Paired") == true {
+		return dbus.NewError("org.bluez.Error.AlreadyExists", []any{"Already Exists"})
+	}
+	d.bluez.setProp(d.path, bluezDeviceIface, "Paired", true)
+	return nil
+}
+
+func (d *fakeBluezDevice) Disconnect() *dbus.Error {
+	d.bluez.setProp(d.path, bluezDeviceIface, "Connected", false)
+	return nil
+}
+
+// SetBattery sets the device's Battery1 Percentage, adding the interface if it doesn't have one yet.
+func (f *fakeBluez) SetBattery(path dbus.ObjectPath, percentage byte) {
+	f.t.Helper()
+	f.mu.Lock()
+	obj := f.objects[path]
+	f.mu.Unlock()
+	if slices.Contains(obj.ifaces, bluezBatteryIface) {
+		obj.props.SetMust(bluezBatteryIface, "Percentage", percentage)
+		return
+	}
+
+	// prop.Export can't add an interface to an object, so export it again with both.
+	device, dbusErr := obj.props.GetAll(bluezDeviceIface)
+	if dbusErr != nil {
+		f.t.Fatal(dbusErr)
+	}
+	propMap := prop.Map{
+		bluezDeviceIface:  map[string]*prop.Prop{},
+		bluezBatteryIface: {"Percentage": {Value: percentage, Emit: prop.EmitTrue}},
+	}
+	for name, value := range device {
+		propMap[bluezDeviceIface][name] = &prop.Prop{Value: value.Value(), Writable: true, Emit: prop.EmitTrue}
+	}
+	p, err := prop.Export(f.conn, path, propMap)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.objects[path] = &fakeBluezObject{ifaces: []string{bluezDeviceIface, bluezBatteryIface}, props: p}
+	f.mu.Unlock()
+	if err := f.conn.Emit("/", dbusObjectManager+".InterfacesAdded", path, map[string]map[string]dbus.Variant{
+		bluezBatteryIface: {"Percentage": dbus.MakeVariant(percentage)},
+	}); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// A fakeUPowerDevice is a device for startFakeUPower to serve.
+type fakeUPowerDevice struct {
+	NativePath string
+	Serial     string
+	Percentage float64
+}
+
+// startFakeUPower claims the org.freedesktop.UPower name on the bus at addr and serves the given devices.
+func startFakeUPower(t *testing.T, addr string, devices ...fakeUPowerDevice) {
+	t.Helper()
+	conn := connectTestBus(t, addr)
+	var paths []dbus.ObjectPath
+	for i, device := range devices {
+		path := dbus.ObjectPath(fmt.Sprintf("%s/devices/battery_%d", upowerPath, i))
+		_, err := prop.Export(conn, path, prop.Map{upowerDeviceIface: {
+			"NativePath": {Value: device.NativePath},
+			"Serial":     {Value: device.Serial},
+			"Percentage": {Value: device.Percentage},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	if err := conn.ExportMethodTable(map[string]any{
+		"EnumerateDevices": func() ([]dbus.ObjectPath, *dbus.Error) { return paths, nil },
+	}, upowerPath, upowerIface); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := conn.RequestName(upowerBusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("couldn't claim %s: reply %v", upowerBusName, reply)
+	}
+}
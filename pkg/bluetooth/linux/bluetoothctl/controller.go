@@ -0,0 +1,124 @@
+package bluetoothctl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ControllerListEntry is one adapter from the output of `bluetoothctl list`.
+type ControllerListEntry struct {
+	MacAddr string
+	Name    string
+	// Default is true for the controller bluetoothctl uses unless told otherwise.
+	Default bool
+}
+
+// ParseControllers parses the output of `bluetoothctl list`, which looks like:
+//
+//	Controller 00:1A:7D:DA:71:13 thinkpad [default]
+//	Controller 5C:F3:70:9B:2E:01 thinkpad #2
+//
+// Lines that aren't controller entries are ignored, as are events. If a controller appears more than once, only its
+// first appearance is kept.
+func ParseControllers(output []byte) []ControllerListEntry {
+	entries := []ControllerListEntry{}
+	seen := map[string]bool{}
+	for _, line := range Lines(output) {
+		if line.Event != EventNone {
+			continue
+		}
+		mac, rest, ok := parseHeader("Controller", line.Text)
+		if !ok {
+			continue
+		}
+		key := strings.ToUpper(mac)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		name, isDefault := strings.CutSuffix(rest, "[default]")
+		entries = append(entries, ControllerListEntry{MacAddr: mac, Name: strings.TrimSpace(name), Default: isDefault})
+	}
+	return entries
+}
+
+// ControllerInfo represents the data parsed from the output of `bluetoothctl show <macAddr>`.
+//
+// MacAddr, Powered, Discoverable and Pairable are always present in valid output (see Validate). The rest are nil when
+// missing.
+type ControllerInfo struct {
+	MacAddr      *string
+	Powered      *bool
+	Discoverable *bool
+	Pairable     *bool
+
+	Name        *string
+	Alias       *string
+	Discovering *bool
+}
+
+// Validate checks that all required fields are present.
+func (i ControllerInfo) Validate() error {
+	var missingFields []string
+	if i.MacAddr == nil {
+		missingFields = append(missingFields, "MacAddr")
+	}
+	if i.Powered == nil {
+		missingFields = append(missingFields, "Powered")
+	}
+	if i.Discoverable == nil {
+		missingFields = append(missingFields, "Discoverable")
+	}
+	if i.Pairable == nil {
+		missingFields = append(missingFields, "Pairable")
+	}
+
+	if len(missingFields) > 0 {
+		return fmt.Errorf("missing fields: %s", strings.Join(missingFields, ", "))
+	}
+
+	return nil
+}
+
+// ParseControllerInfo parses the output of `bluetoothctl show <macAddr>`. Like `info`, it's a
+// `Controller <mac> (public)` header followed by `Key: value` lines.
+func ParseControllerInfo(output []byte) (ControllerInfo, error) {
+	var controller ControllerInfo
+	for _, line := range Lines(output) {
+		if line.Event != EventNone {
+			continue
+		}
+
+		if mac, _, ok := parseHeader("Controller", line.Text); ok {
+			if controller.MacAddr != nil {
+				break
+			}
+			controller.MacAddr = &mac
+			continue
+		}
+		if controller.MacAddr == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line.Text, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Name":
+			controller.Name = &value
+		case "Alias":
+			controller.Alias = &value
+		case "Powered":
+			controller.Powered = parseYesNo(value)
+		case "Discoverable":
+			controller.Discoverable = parseYesNo(value)
+		case "Pairable":
+			controller.Pairable = parseYesNo(value)
+		case "Discovering":
+			controller.Discovering = parseYesNo(value)
+		}
+	}
+	return controller, controller.Validate()
+}
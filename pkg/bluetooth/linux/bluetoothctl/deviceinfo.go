@@ -1,17 +1,41 @@
 package bluetoothctl
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
-// DeviceInfo represents a subset of data parsed from the output of `bluetoothctl info <macAddr>`.
+// DeviceInfo represents the data parsed from the output of `bluetoothctl info <macAddr>`.
+//
+// Name, MacAddr and Connected are always present in valid output (see Validate). The rest of the fields are only
+// printed by bluetoothctl when BlueZ knows them, so they're nil or empty when missing.
 type DeviceInfo struct {
 	Name      *string
 	MacAddr   *string
 	Connected *bool
+
+	// AddressType is "public" or "random", from the `Device <mac> (public)` header line.
+	AddressType   *string
+	Alias         *string
+	Class         *uint32
+	Icon          *string
+	Paired        *bool
+	Trusted       *bool
+	Blocked       *bool
+	LegacyPairing *bool
+	UUIDs         []UUID
+	Modalias      *string
+	RSSI          *int
+	TxPower       *int
+	// BatteryPercentage comes from the Battery1 interface, which BlueZ only exposes for some connected devices.
+	BatteryPercentage *int
+}
+
+// A UUID is a service advertised by a device, e.g. `UUID: Audio Sink (0000110b-0000-1000-8000-00805f9b34fb)`.
+type UUID struct {
+	Name string
+	UUID string
 }
 
 // Validate checks that all required fields are present, just in case the returned data somehow fails to match our
@@ -37,29 +61,104 @@ func (i DeviceInfo) Validate() error {
 
 // ParseDeviceInfo parses the output of `bluetoothctl info <macAddr>`.
 func ParseDeviceInfo(output []byte) (DeviceInfo, error) {
-	var err error
 	var device DeviceInfo
-	// bluetoothctl doesn't provide structured output like JSON or whatever, so we have to parse it manually. We only
-	// care about a few fields from the output, so we can just look for those lines and extract the values.
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		switch fields[0] {
-		case "Device":
-			device.MacAddr = &fields[1]
-		case "Name:":
-			device.Name = &fields[1]
-		case "Connected:":
-			connected := fields[1] == "yes"
-			device.Connected = &connected
+	// bluetoothctl doesn't provide structured output like JSON or whatever, so we have to parse it manually. Apart
+	// from the header line, each line is a `Key: value` pair. Values can contain spaces (e.g. `Name: Bose QC35 II`), so
+	// we split on the first colon rather than on whitespace.
+	for _, line := range Lines(output) {
+		// Events are about other things happening on the bus, not the device we asked about.
+		if line.Event != EventNone {
+			continue
 		}
 
-		// As soon as we have all the fields we care about, we can stop scanning.
-		err = device.Validate()
-		if err == nil {
-			return device, nil
+		if mac, rest, ok := parseDeviceHeader(line.Text); ok {
+			// If there's somehow more than one device in the output, only keep the first one.
+			if device.MacAddr != nil {
+				break
+			}
+			device.MacAddr = &mac
+			if strings.HasPrefix(rest, "(") && strings.HasSuffix(rest, ")") {
+				addrType := rest[1 : len(rest)-1]
+				device.AddressType = &addrType
+			}
+			continue
 		}
+		// Ignore anything before the header, like "Waiting to connect to bluetoothd...".
+		if device.MacAddr == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line.Text, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Name":
+			device.Name = &value
+		case "Alias":
+			device.Alias = &value
+		case "Class":
+			if class, err := strconv.ParseUint(value, 0, 32); err == nil {
+				class32 := uint32(class)
+				device.Class = &class32
+			}
+		case "Icon":
+			device.Icon = &value
+		case "Paired":
+			device.Paired = parseYesNo(value)
+		case "Trusted":
+			device.Trusted = parseYesNo(value)
+		case "Blocked":
+			device.Blocked = parseYesNo(value)
+		case "Connected":
+			device.Connected = parseYesNo(value)
+		case "LegacyPairing":
+			device.LegacyPairing = parseYesNo(value)
+		case "UUID":
+			device.UUIDs = append(device.UUIDs, parseUUID(value))
+		case "Modalias":
+			device.Modalias = &value
+		case "RSSI":
+			device.RSSI = ParseInt(value)
+		case "TxPower":
+			device.TxPower = ParseInt(value)
+		case "Battery Percentage":
+			device.BatteryPercentage = ParseInt(value)
+		}
+	}
+	return device, device.Validate()
+}
+
+func parseYesNo(value string) *bool {
+	b := value == "yes"
+	return &b
+}
+
+// ParseInt parses numeric values, which bluetoothctl prints in a few different ways depending on the version and the
+// field: `-67`, `0x64 (100)` or `0xffffffbd (-67)`. When there's a decimal value in parentheses, that's the one we
+// want, since the hex value may be a sign-extended two's complement number.
+func ParseInt(value string) *int {
+	if start := strings.LastIndex(value, "("); start != -1 && strings.HasSuffix(value, ")") {
+		value = value[start+1 : len(value)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 0, 64)
+	if err != nil {
+		return nil
+	}
+	i := int(n)
+	return &i
+}
+
+// parseUUID parses `Audio Sink                (0000110b-0000-1000-8000-00805f9b34fb)`.
+func parseUUID(value string) UUID {
+	// Use the last parenthesis in case the name has its own, e.g. `Generic Access Profile (GAP) (00001800-...)`.
+	start := strings.LastIndex(value, "(")
+	if start == -1 {
+		return UUID{UUID: value}
+	}
+	return UUID{
+		Name: strings.TrimSpace(value[:start]),
+		UUID: strings.TrimSuffix(strings.TrimSpace(value[start+1:]), ")"),
 	}
-	return device, err
 }
@@ -36,4 +36,78 @@ func TestParseDeviceInfo(t *testing.T) {
 		t.Logf("%#v", devinfo)
 		t.Error(err)
 	}
+
+	checkString(t, "Name", devinfo.Name, "WF-1000XM4")
+	checkString(t, "MacAddr", devinfo.MacAddr, "F8:4E:17:66:E8:55")
+	checkString(t, "AddressType", devinfo.AddressType, "public")
+	checkString(t, "Alias", devinfo.Alias, "WF-1000XM4")
+	checkString(t, "Icon", devinfo.Icon, "audio-card")
+	checkString(t, "Modalias", devinfo.Modalias, "usb:v054Cp0DE1d0201")
+	checkBool(t, "Paired", devinfo.Paired, true)
+	checkBool(t, "Trusted", devinfo.Trusted, false)
+	checkBool(t, "Blocked", devinfo.Blocked, false)
+	checkBool(t, "Connected", devinfo.Connected, false)
+	checkBool(t, "LegacyPairing", devinfo.LegacyPairing, false)
+	if devinfo.Class == nil || *devinfo.Class != 0x00240404 {
+		t.Errorf("Class: got %v, wanted 0x00240404", devinfo.Class)
+	}
+	if len(devinfo.UUIDs) != 14 {
+		t.Errorf("got %d UUIDs, wanted 14", len(devinfo.UUIDs))
+	} else if want := (UUID{Name: "Audio Sink", UUID: "0000110b-0000-1000-8000-00805f9b34fb"}); devinfo.UUIDs[2] != want {
+		t.Errorf("UUIDs[2]: got %#v, wanted %#v", devinfo.UUIDs[2], want)
+	}
+	if devinfo.RSSI != nil || devinfo.TxPower != nil || devinfo.BatteryPercentage != nil {
+		t.Errorf("got RSSI/TxPower/BatteryPercentage for output that doesn't include them")
+	}
+}
+
+func TestParseDeviceInfoOptionalFields(t *testing.T) {
+	sampleOutput := `Device CC:98:8B:20:7D:DB (random)
+	Name: Bose QC35 II
+	Alias: Bose QC35 II
+	Paired: yes
+	Trusted: yes
+	Blocked: no
+	Connected: yes
+	RSSI: 0xffffffbd (-67)
+	TxPower: 4
+	Battery Percentage: 0x55 (85)`
+
+	devinfo, err := ParseDeviceInfo([]byte(sampleOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkString(t, "Name", devinfo.Name, "Bose QC35 II")
+	checkString(t, "AddressType", devinfo.AddressType, "random")
+	checkInt(t, "RSSI", devinfo.RSSI, -67)
+	checkInt(t, "TxPower", devinfo.TxPower, 4)
+	checkInt(t, "BatteryPercentage", devinfo.BatteryPercentage, 85)
+}
+
+func TestParseDeviceInfoMissingFields(t *testing.T) {
+	_, err := ParseDeviceInfo([]byte("Device F8:4E:17:66:E8:55 not available\n"))
+	if err == nil {
+		t.Error("expected an error for output without device info")
+	}
+}
+
+func checkString(t *testing.T, field string, got *string, want string) {
+	t.Helper()
+	if got == nil || *got != want {
+		t.Errorf("%s: got %v, wanted %q", field, got, want)
+	}
+}
+
+func checkBool(t *testing.T, field string, got *bool, want bool) {
+	t.Helper()
+	if got == nil || *got != want {
+		t.Errorf("%s: got %v, wanted %v", field, got, want)
+	}
+}
+
+func checkInt(t *testing.T, field string, got *int, want int) {
+	t.Helper()
+	if got == nil || *got != want {
+		t.Errorf("%s: got %v, wanted %d", field, got, want)
+	}
 }
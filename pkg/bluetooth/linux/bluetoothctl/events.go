@@ -0,0 +1,48 @@
+package bluetoothctl
+
+import "strings"
+
+// A DeviceEvent is a [NEW], [CHG] or [DEL] line about a device, which bluetoothctl prints whenever BlueZ tells it
+// something changed:
+//
+//	[NEW] Device F8:4E:17:66:E8:55 WF-1000XM4
+//	[CHG] Device F8:4E:17:66:E8:55 Connected: yes
+//	[DEL] Device F8:4E:17:66:E8:55 WF-1000XM4
+type DeviceEvent struct {
+	Event   Event
+	MacAddr string
+	// Name is set for [NEW] and [DEL] events. Devices without a name are announced with their address in its place,
+	// e.g. `4C-87-5D-2A-11-9F`, in which case Name is empty.
+	Name string
+	// Property and Value are set for [CHG] events, e.g. `Connected` and `yes`.
+	Property string
+	Value    string
+}
+
+// ParseDeviceEvent parses a line from CleanLine or Lines as a device event. It returns false if the line isn't one,
+// including [CHG] lines that don't have a `Property: value` pair.
+func ParseDeviceEvent(line Line) (DeviceEvent, bool) {
+	if line.Event == EventNone {
+		return DeviceEvent{}, false
+	}
+	mac, rest, ok := parseDeviceHeader(line.Text)
+	if !ok {
+		return DeviceEvent{}, false
+	}
+
+	event := DeviceEvent{Event: line.Event, MacAddr: mac}
+	if line.Event != EventChanged {
+		if rest != strings.ReplaceAll(mac, ":", "-") {
+			event.Name = rest
+		}
+		return event, true
+	}
+
+	property, value, ok := strings.Cut(rest, ":")
+	if !ok {
+		return DeviceEvent{}, false
+	}
+	event.Property = property
+	event.Value = strings.TrimSpace(value)
+	return event, true
+}
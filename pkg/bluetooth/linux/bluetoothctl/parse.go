@@ -0,0 +1,139 @@
+package bluetoothctl
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// bluetoothctl is written for humans, and depending on the version, whether stdout is a terminal and what else is
+// going on with the adapter, its output can be decorated with colour codes, interactive prompts, and asynchronous
+// event lines that have nothing to do with the command we ran. The helpers in this file strip all of that away so the
+// parsers only have to deal with the interesting lines.
+
+var (
+	// ansiEscape matches CSI escape sequences like `\x1b[0;94m` and `\x1b[K`.
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	// promptPrefix matches interactive prompts like `[bluetooth]# ` or `[WF-1000XM4]# `.
+	promptPrefix = regexp.MustCompile(`^\[[^\]]*\]# ?`)
+	// eventPrefix matches the tags bluetoothctl prints before asynchronous events, e.g. `[CHG] Device ... RSSI: -60`.
+	eventPrefix = regexp.MustCompile(`^\[(NEW|CHG|DEL)\] ?`)
+	// macAddrPattern matches a MAC address as printed by bluetoothctl.
+	macAddrPattern = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$`)
+)
+
+// An Event tags a line of output that bluetoothctl printed in response to something happening on the bus rather than
+// as the result of the command we ran.
+type Event string
+
+const (
+	EventNone    Event = ""
+	EventNew     Event = "NEW"
+	EventChanged Event = "CHG"
+	EventDeleted Event = "DEL"
+)
+
+// A Line is a single line of bluetoothctl output with the decoration removed.
+type Line struct {
+	Event Event
+	Text  string
+}
+
+// Lines splits bluetoothctl output into lines, removing colour codes, prompts and surrounding whitespace. Blank lines
+// are dropped.
+func Lines(output []byte) []Line {
+	var lines []Line
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	// Lines are normally short, but don't fail on unexpectedly long ones (e.g. a huge ManufacturerData dump).
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if line, ok := CleanLine(scanner.Text()); ok {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// CleanLine removes the decoration from a single line of bluetoothctl output. It returns false if nothing is left.
+func CleanLine(raw string) (Line, bool) {
+	text := ansiEscape.ReplaceAllString(raw, "")
+	// readline wraps the non-printing parts of the prompt in \x01...\x02 markers.
+	text = strings.NewReplacer("\x01", "", "\x02", "").Replace(text)
+	// When bluetoothctl prints an event while the prompt is showing, it redraws the line with a carriage return, so
+	// only the text after the last one is what's actually visible.
+	if i := strings.LastIndexByte(text, '\r'); i != -1 {
+		text = text[i+1:]
+	}
+	text = strings.TrimSpace(text)
+	// The prompt can be repeated if several commands were echoed back, e.g. `[bluetooth]# [bluetooth]# `.
+	for {
+		loc := promptPrefix.FindStringIndex(text)
+		if loc == nil {
+			break
+		}
+		text = strings.TrimSpace(text[loc[1]:])
+	}
+
+	var line Line
+	if m := eventPrefix.FindStringSubmatchIndex(text); m != nil {
+		line.Event = Event(text[m[2]:m[3]])
+		text = strings.TrimSpace(text[m[1]:])
+	}
+	line.Text = text
+	return line, text != ""
+}
+
+// parseDeviceHeader parses `Device <mac> <rest>` lines, returning the MAC and the rest of the line. It returns false
+// if the line doesn't start with `Device` followed by a valid MAC address.
+func parseDeviceHeader(text string) (mac string, rest string, ok bool) {
+	return parseHeader("Device", text)
+}
+
+// parseHeader is parseDeviceHeader for any kind of object, e.g. `Controller <mac> <rest>`.
+func parseHeader(kind string, text string) (mac string, rest string, ok bool) {
+	after, ok := strings.CutPrefix(text, kind+" ")
+	if !ok {
+		return "", "", false
+	}
+	mac, rest, _ = strings.Cut(after, " ")
+	if !macAddrPattern.MatchString(mac) {
+		return "", "", false
+	}
+	return mac, strings.TrimSpace(rest), true
+}
+
+// A DeviceListEntry is one device from the output of `bluetoothctl devices`.
+type DeviceListEntry struct {
+	MacAddr string
+	Name    string
+}
+
+// ParseDevices parses the output of `bluetoothctl devices`, which looks like:
+//
+//	Device F8:4E:17:66:E8:55 WF-1000XM4
+//	Device CC:98:8B:20:7D:DB Bose QC35 II
+//
+// Names can contain spaces and are kept whole. Lines that aren't device entries are ignored, as are [CHG] and [DEL]
+// events. [NEW] events are treated as entries, since some versions of bluetoothctl print the device list that way
+// while starting up. If a device appears more than once, only its first appearance is kept.
+func ParseDevices(output []byte) []DeviceListEntry {
+	entries := []DeviceListEntry{}
+	seen := map[string]bool{}
+	for _, line := range Lines(output) {
+		if line.Event != EventNone && line.Event != EventNew {
+			continue
+		}
+		mac, name, ok := parseDeviceHeader(line.Text)
+		if !ok {
+			continue
+		}
+		key := strings.ToUpper(mac)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		entries = append(entries, DeviceListEntry{MacAddr: mac, Name: name})
+	}
+	return entries
+}
@@ -0,0 +1,241 @@
+package bluetoothctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run `go test -update` to regenerate the .golden files after changing the parsers. Check the diff before committing!
+var update = flag.Bool("update", false, "update .golden files")
+
+// goldenTest runs parse on every .txt transcript in dir and compares the JSON-encoded result with the matching .golden
+// file.
+func goldenTest(t *testing.T, dir string, parse func([]byte) any) {
+	t.Helper()
+	transcripts, err := filepath.Glob(filepath.Join("testdata", dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcripts) == 0 {
+		t.Fatalf("no transcripts found in testdata/%s", dir)
+	}
+
+	for _, transcript := range transcripts {
+		name := strings.TrimSuffix(filepath.Base(transcript), ".txt")
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(transcript)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(parse(input), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := strings.TrimSuffix(transcript, ".txt") + ".golden"
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v (run `go test -update` to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output doesn't match %s\ngot:\n%s\nwanted:\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+// deviceInfoResult is what we record in the golden files for `bluetoothctl info` transcripts.
+type deviceInfoResult struct {
+	Info  DeviceInfo
+	Error string `json:",omitempty"`
+}
+
+func TestParseDeviceInfoGolden(t *testing.T) {
+	goldenTest(t, "info", func(input []byte) any {
+		info, err := ParseDeviceInfo(input)
+		result := deviceInfoResult{Info: info}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	})
+}
+
+func TestParseDevicesGolden(t *testing.T) {
+	goldenTest(t, "devices", func(input []byte) any {
+		return ParseDevices(input)
+	})
+}
+
+func TestParseScanGolden(t *testing.T) {
+	goldenTest(t, "scan", func(input []byte) any {
+		return ParseScan(input)
+	})
+}
+
+func TestParseControllersGolden(t *testing.T) {
+	goldenTest(t, "controllers", func(input []byte) any {
+		return ParseControllers(input)
+	})
+}
+
+// controllerInfoResult is what we record in the golden files for `bluetoothctl show` transcripts.
+type controllerInfoResult struct {
+	Info  ControllerInfo
+	Error string `json:",omitempty"`
+}
+
+func TestParseControllerInfoGolden(t *testing.T) {
+	goldenTest(t, "show", func(input []byte) any {
+		info, err := ParseControllerInfo(input)
+		result := controllerInfoResult{Info: info}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	})
+}
+
+func TestCleanLine(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Line
+		ok   bool
+	}{
+		{"Device F8:4E:17:66:E8:55 WF-1000XM4", Line{Text: "Device F8:4E:17:66:E8:55 WF-1000XM4"}, true},
+		{"\tName: Bose QC35 II  ", Line{Text: "Name: Bose QC35 II"}, true},
+		{"", Line{}, false},
+		{"   \t", Line{}, false},
+		{"\x1b[0;94m[bluetooth]\x1b[0m# ", Line{}, false},
+		{"\x1b[0;94m[bluetooth]\x1b[0m# devices", Line{Text: "devices"}, true},
+		{"\x01\x1b[0;94m\x02[bluetooth]\x01\x1b[0m\x02# [bluetooth]# show", Line{Text: "show"}, true},
+		{"[bluetooth]# \r\x1b[K\x1b[0;93m[CHG]\x1b[0m Device 04:52:C7:0C:91:3A RSSI: -61",
+			Line{Event: EventChanged, Text: "Device 04:52:C7:0C:91:3A RSSI: -61"}, true},
+		{"[NEW] Device F8:4E:17:66:E8:55 WF-1000XM4", Line{Event: EventNew, Text: "Device F8:4E:17:66:E8:55 WF-1000XM4"}, true},
+		{"[DEL] Device F8:4E:17:66:E8:55 WF-1000XM4", Line{Event: EventDeleted, Text: "Device F8:4E:17:66:E8:55 WF-1000XM4"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, ok := CleanLine(tt.raw)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got (%#v, %v), wanted (%#v, %v)", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseDeviceEvent(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want DeviceEvent
+		ok   bool
+	}{
+		{"[NEW] Device F8:4E:17:66:E8:55 WF-1000XM4", DeviceEvent{Event: EventNew, MacAddr: "F8:4E:17:66:E8:55", Name: "WF-1000XM4"}, true},
+		{"[NEW] Device 4C:87:5D:2A:11:9F 4C-87-5D-2A-11-9F", DeviceEvent{Event: EventNew, MacAddr: "4C:87:5D:2A:11:9F"}, true},
+		{"\x1b[0;93m[CHG]\x1b[0m Device F8:4E:17:66:E8:55 Connected: yes",
+			DeviceEvent{Event: EventChanged, MacAddr: "F8:4E:17:66:E8:55", Property: "Connected", Value: "yes"}, true},
+		{"[CHG] Device F8:4E:17:66:E8:55 Name: Sony: WF-1000XM4",
+			DeviceEvent{Event: EventChanged, MacAddr: "F8:4E:17:66:E8:55", Property: "Name", Value: "Sony: WF-1000XM4"}, true},
+		{"[DEL] Device F8:4E:17:66:E8:55 WF-1000XM4", DeviceEvent{Event: EventDeleted, MacAddr: "F8:4E:17:66:E8:55", Name: "WF-1000XM4"}, true},
+		// ManufacturerData dumps continue over several lines that don't have a value.
+		{"[CHG] Device F8:4E:17:66:E8:55 ManufacturerData.Key", DeviceEvent{}, false},
+		{"[CHG] Controller 00:1A:7D:DA:71:13 Discovering: yes", DeviceEvent{}, false},
+		{"Device F8:4E:17:66:E8:55 WF-1000XM4", DeviceEvent{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			line, _ := CleanLine(tt.raw)
+			got, ok := ParseDeviceEvent(line)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got (%#v, %v), wanted (%#v, %v)", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// addTranscriptSeeds adds every transcript in testdata/dir to the fuzz corpus.
+func addTranscriptSeeds(f *testing.F, dir string) {
+	transcripts, err := filepath.Glob(filepath.Join("testdata", dir, "*.txt"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, transcript := range transcripts {
+		input, err := os.ReadFile(transcript)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(input)
+	}
+}
+
+func FuzzParseDeviceInfo(f *testing.F) {
+	addTranscriptSeeds(f, "info")
+	f.Fuzz(func(t *testing.T, input []byte) {
+		info, err := ParseDeviceInfo(input)
+		if err == nil && info.Validate() != nil {
+			t.Errorf("ParseDeviceInfo returned no error for invalid info %#v", info)
+		}
+		if info.MacAddr != nil && !macAddrPattern.MatchString(*info.MacAddr) {
+			t.Errorf("ParseDeviceInfo returned invalid MAC %q", *info.MacAddr)
+		}
+	})
+}
+
+func FuzzParseDevices(f *testing.F) {
+	addTranscriptSeeds(f, "devices")
+	f.Fuzz(func(t *testing.T, input []byte) {
+		seen := map[string]bool{}
+		for _, entry := range ParseDevices(input) {
+			if !macAddrPattern.MatchString(entry.MacAddr) {
+				t.Errorf("ParseDevices returned invalid MAC %q", entry.MacAddr)
+			}
+			if seen[strings.ToUpper(entry.MacAddr)] {
+				t.Errorf("ParseDevices returned %s more than once", entry.MacAddr)
+			}
+			seen[strings.ToUpper(entry.MacAddr)] = true
+		}
+	})
+}
+
+func FuzzParseScan(f *testing.F) {
+	addTranscriptSeeds(f, "scan")
+	f.Fuzz(func(t *testing.T, input []byte) {
+		seen := map[string]bool{}
+		for _, result := range ParseScan(input) {
+			if !macAddrPattern.MatchString(result.MacAddr) {
+				t.Errorf("ParseScan returned invalid MAC %q", result.MacAddr)
+			}
+			if seen[strings.ToUpper(result.MacAddr)] {
+				t.Errorf("ParseScan returned %s more than once", result.MacAddr)
+			}
+			seen[strings.ToUpper(result.MacAddr)] = true
+		}
+	})
+}
+
+func FuzzParseControllerInfo(f *testing.F) {
+	addTranscriptSeeds(f, "show")
+	f.Fuzz(func(t *testing.T, input []byte) {
+		info, err := ParseControllerInfo(input)
+		if err == nil && info.Validate() != nil {
+			t.Errorf("ParseControllerInfo returned no error for invalid info %#v", info)
+		}
+		if info.MacAddr != nil && !macAddrPattern.MatchString(*info.MacAddr) {
+			t.Errorf("ParseControllerInfo returned invalid MAC %q", *info.MacAddr)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package bluetoothctl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A ScanResult is one device seen in the output of `bluetoothctl scan on`.
+type ScanResult struct {
+	MacAddr string
+	Name    string
+	RSSI    *int    `json:",omitempty"`
+	Class   *uint32 `json:",omitempty"`
+}
+
+// ParseScan parses the output of `bluetoothctl --timeout <seconds> scan on`, which is made up entirely of events:
+//
+//	Discovery started
+//	[CHG] Controller 00:1A:7D:DA:71:13 Discovering: yes
+//	[NEW] Device F8:4E:17:66:E8:55 WF-1000XM4
+//	[CHG] Device F8:4E:17:66:E8:55 RSSI: -58
+//	[CHG] Device CC:98:8B:20:7D:DB RSSI: 0xffffffc4 (-60)
+//	[DEL] Device 4C:87:5D:2A:11:9F 4C-87-5D-2A-11-9F
+//
+// New devices show up as [NEW] events. Devices BlueZ already knew about only show up as [CHG] events, usually for their
+// RSSI, so those count too. [DEL] events are ignored: BlueZ forgets unpaired devices shortly after discovery stops,
+// but they were still seen during the scan. Devices are returned in the order they were first seen, with the latest
+// RSSI reported for each.
+func ParseScan(output []byte) []ScanResult {
+	results := []ScanResult{}
+	index := map[string]int{}
+	for _, line := range Lines(output) {
+		event, ok := ParseDeviceEvent(line)
+		if !ok || event.Event == EventDeleted {
+			continue
+		}
+		key := strings.ToUpper(event.MacAddr)
+		i, ok := index[key]
+		if !ok {
+			i = len(results)
+			index[key] = i
+			results = append(results, ScanResult{MacAddr: event.MacAddr})
+		}
+		result := &results[i]
+
+		if event.Event == EventNew {
+			if result.Name == "" {
+				result.Name = event.Name
+			}
+			continue
+		}
+
+		switch event.Property {
+		case "Name":
+			result.Name = event.Value
+		case "Alias":
+			// The alias defaults to the name (or the address, if there isn't one), so only use it as a fallback.
+			if result.Name == "" && event.Value != strings.ReplaceAll(event.MacAddr, ":", "-") {
+				result.Name = event.Value
+			}
+		case "RSSI":
+			if rssi := ParseInt(event.Value); rssi != nil {
+				result.RSSI = rssi
+			}
+		case "Class":
+			if class, err := strconv.ParseUint(event.Value, 0, 32); err == nil {
+				class32 := uint32(class)
+				result.Class = &class32
+			}
+		}
+	}
+	return results
+}
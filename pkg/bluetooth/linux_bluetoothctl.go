@@ -1,90 +1,703 @@
 package bluetooth
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/linux/bluetoothctl"
 )
 
-var bluetoothctlDeviceListRegex = regexp.MustCompile(`Device ([0-9A-Za-z:]+) (.*)`)
+// bluetoothctlMacFormat matches the way bluetoothctl prints addresses, e.g. `CC:98:8B:20:7D:DB`.
+var bluetoothctlMacFormat = MacFormat{Separator: ":", Uppercase: true}
+
+// bluetoothctlErrorLine matches the lines bluetoothctl prints when a command fails. Depending on the BlueZ version
+// these may come with a zero or non-zero exit code, and they're printed on stdout, not stderr, along with everything
+// else, so only these lines are checked against bluetoothctlErrorPatterns. Otherwise a device called, say, "Not
+// Available" would make listing devices fail.
+var bluetoothctlErrorLine = regexp.MustCompile(
+	`^(Failed to |No default controller available|Device ([0-9A-F]{2}:){5}[0-9A-F]{2} not available$)`)
+
+// bluetoothctlErrorPatterns classifies the lines matched by bluetoothctlErrorLine.
+var bluetoothctlErrorPatterns = []errorPattern{
+	{"No default controller available", ErrAdapterNotFound},
+	{"not available", ErrDeviceNotFound}, // "Device AA:BB:CC:DD:EE:FF not available"
+	{"org.bluez.Error.DoesNotExist", ErrDeviceNotFound},
+	{"org.bluez.Error.NotReady", ErrAdapterPoweredOff},
+	{"Resource Not Ready", ErrAdapterPoweredOff},
+	{"org.bluez.Error.AuthenticationRejected", ErrNotPaired},
+	{"org.bluez.Error.AuthenticationFailed", ErrNotPaired},
+	{"connection-refused", ErrConnectionRefused}, // "Failed to connect: org.bluez.Error.Failed br-connection-refused"
+	{"connection-busy", ErrDeviceBusy},           // "Failed to connect: org.bluez.Error.Failed br-connection-busy"
+	{"org.bluez.Error.InProgress", ErrDeviceBusy},
+	{"Connection refused", ErrConnectionRefused},
+}
+
+// bluetoothctlError classifies the result of running bluetoothctl. It returns nil if the command succeeded.
+func bluetoothctlError(output []byte, err error) error {
+	// `select` prints "Controller <mac> not available" for a missing adapter.
+	var errorLines []byte
+	for _, line := range bluetoothctl.Lines(output) {
+		if line.Event != bluetoothctl.EventNone {
+			continue
+		}
+		if strings.HasPrefix(line.Text, "Controller ") && strings.HasSuffix(line.Text, " not available") {
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrAdapterNotFound, err)
+			}
+			return fmt.Errorf("%w: %s", ErrAdapterNotFound, line.Text)
+		}
+		if bluetoothctlErrorLine.MatchString(line.Text) {
+			errorLines = append(errorLines, line.Text+"\n"...)
+		}
+	}
+	if err := classifyCommandError(bluetoothctlErrorPatterns, errorLines, err); err != nil {
+		return err
+	}
+	// Older versions of bluetoothctl exit zero even when a command fails, so catch any failure we don't recognize.
+	if len(errorLines) > 0 {
+		return fmt.Errorf("bluetoothctl: %s", firstLine(errorLines))
+	}
+	return nil
+}
+
+// bluetoothctlDeviceFilterVersion is the first BlueZ release whose bluetoothctl accepts a property filter for the
+// `devices` command, e.g. `devices Connected`. Older versions silently ignore the argument and list every device, so
+// we can't just try it and see.
+var bluetoothctlDeviceFilterVersion = bluetoothctlVersion{5, 65}
+
+// defaultInfoConcurrency is how many `bluetoothctl info` processes List runs at once when it has to fall back to
+// querying each device individually.
+const defaultInfoConcurrency = 4
 
 // linuxBluetoothctlBluetoothManager wraps the bluetoothctl command for Linux.
-type linuxBluetoothctlBluetoothManager struct{}
+type linuxBluetoothctlBluetoothManager struct {
+	run CommandRunner
+	// stream starts the interactive bluetoothctl session used by Watch.
+	stream streamRunner
+	// adapter is the adapter we're pinned to, or zero to use bluetoothctl's default.
+	adapter MacAddress
+	// connectPolicy controls how Connect verifies and retries connections.
+	connectPolicy ConnectPolicy
+	// infoConcurrency limits how many `bluetoothctl info` processes List runs in parallel.
+	infoConcurrency int
+	// version caches the output of `bluetoothctl --version`. It's a pointer so copies of the manager share it, as are
+	// adapters and details.
+	version *bluetoothctlVersionCache
+	// adapters remembers which adapters we've recently seen in `bluetoothctl list`.
+	adapters *bluetoothctlAdapterCache
+	// details remembers what `info` last said about each device.
+	details *bluetoothctlDetailsCache
+	// batteries returns the battery levels UPower knows, for connected devices bluetoothctl doesn't report one for. If
+	// it's nil, there's no fallback.
+	batteries func(context.Context) (map[MacAddress]int, error)
+}
+
+func init() {
+	RegisterBackend(Backend{
+		Name:     "bluetoothctl",
+		Priority: 10,
+		Probe: func() error {
+			if err := requireOS("linux"); err != nil {
+				return err
+			}
+			return requireExecutable("bluetoothctl")
+		},
+		New: func(opts Options) (BluetoothManager, error) {
+			if opts.BluetoothctlSession {
+				fallback := opts.Runner
+				if fallback == nil {
+					fallback = ExecRunner{}
+				}
+				opts.Runner = newBluetoothctlSession("bluetoothctl", opts.Adapter, fallback)
+			}
+			run, err := opts.runner("bluetoothctl")
+			if err != nil {
+				return nil, err
+			}
+			m := newLinuxBluetoothctlBluetoothManager(run)
+			m.adapter = opts.Adapter
+			m.connectPolicy = opts.Connect
+			m.batteries = systemUPowerBatteries
+			return m, nil
+		},
+	})
+}
 
-func newLinuxBluetoothctlBluetoothManager() linuxBluetoothctlBluetoothManager {
-	// validate bluetoothctl is on the path
-	if !onPath("bluetoothctl") {
-		panic("couldn't find bluetoothctl on the path")
+func newLinuxBluetoothctlBluetoothManager(run CommandRunner) linuxBluetoothctlBluetoothManager {
+	return linuxBluetoothctlBluetoothManager{
+		run:             run,
+		stream:          streamCmd,
+		infoConcurrency: defaultInfoConcurrency,
+		version:         &bluetoothctlVersionCache{},
+		adapters:        &bluetoothctlAdapterCache{checked: map[MacAddress]time.Time{}},
+		details:         &bluetoothctlDetailsCache{devices: map[MacAddress]BluetoothDevice{}},
 	}
+}
+
+// bluetoothctl runs `bluetoothctl args...` against our adapter.
+func (m linuxBluetoothctlBluetoothManager) bluetoothctl(ctx context.Context, args ...string) ([]byte, error) {
+	return m.bluetoothctlOn(ctx, m.adapter, 0, args...)
+}
 
-	return linuxBluetoothctlBluetoothManager{}
+// bluetoothctlOn runs `bluetoothctl args...` against the given adapter, or bluetoothctl's default adapter if it's
+// zero. If timeout isn't zero, it's passed as --timeout to keep bluetoothctl running that long, e.g. while scanning.
+//
+// bluetoothctl has no command-line option for choosing an adapter, so to use a specific one we pipe it `select <mac>`
+// followed by the command on stdin. This relies on bluetoothctl waiting for each piped command to finish before
+// moving on to the next one and exiting, which older versions don't always do. If pinning to an adapter matters,
+// prefer the bluez backend.
+func (m linuxBluetoothctlBluetoothManager) bluetoothctlOn(ctx context.Context, adapter MacAddress, timeout time.Duration, args ...string) ([]byte, error) {
+	var flags []string
+	if timeout != 0 {
+		flags = []string{"--timeout", wholeSeconds(timeout)}
+	}
+	if adapter.IsZero() {
+		return m.run.Run(ctx, nil, "bluetoothctl", append(flags, args...)...)
+	}
+
+	// If `select` fails, bluetoothctl prints an error and carries on with the rest of its input on the default adapter,
+	// which is exactly what we're trying to avoid, so check the adapter is there first.
+	if err := m.adapters.check(ctx, adapter, m.findAdapter); err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf("select %s\n%s\n", adapter.FormatAs(bluetoothctlMacFormat), strings.Join(args, " "))
+	return m.run.Run(ctx, []byte(script), "bluetoothctl", flags...)
 }
 
-func (m linuxBluetoothctlBluetoothManager) Connect(ctx context.Context, macAddr string) error {
-	output, err := runCmd(ctx, "bluetoothctl", "connect", macAddr)
+// findAdapter returns the `bluetoothctl list` entry for the given adapter, or ErrAdapterNotFound if it isn't there.
+func (m linuxBluetoothctlBluetoothManager) findAdapter(ctx context.Context, adapter MacAddress) (bluetoothctl.ControllerListEntry, error) {
+	entries, err := m.listAdapters(ctx)
 	if err != nil {
-		// TODO: process the error to see what went wrong
-		return err
+		return bluetoothctl.ControllerListEntry{}, err
 	}
-	// TODO: validate output
-	_ = output
-	return nil
+	for _, entry := range entries {
+		if mac, err := ParseMacAddress(entry.MacAddr); err == nil && mac == adapter {
+			return entry, nil
+		}
+	}
+	return bluetoothctl.ControllerListEntry{}, fmt.Errorf("%w: %s", ErrAdapterNotFound, adapter)
 }
 
-func (m linuxBluetoothctlBluetoothManager) Disconnect(ctx context.Context, macAddr string) error {
-	output, err := runCmd(ctx, "bluetoothctl", "disconnect", macAddr)
+// listAdapters runs `bluetoothctl list` and returns the parsed entries.
+func (m linuxBluetoothctlBluetoothManager) listAdapters(ctx context.Context) ([]bluetoothctl.ControllerListEntry, error) {
+	output, err := m.run.Run(ctx, nil, "bluetoothctl", "list")
+	if err := bluetoothctlError(output, err); err != nil {
+		return nil, err
+	}
+	return bluetoothctl.ParseControllers(output), nil
+}
+
+// Adapters runs `bluetoothctl show` for each adapter in `bluetoothctl list`.
+func (m linuxBluetoothctlBluetoothManager) Adapters(ctx context.Context) ([]Adapter, error) {
+	entries, err := m.listAdapters(ctx)
 	if err != nil {
-		// TODO: process the error to see what went wrong
-		return err
+		return nil, err
 	}
-	// TODO: validate output
-	_ = output
-	return nil
+
+	adapters := make([]Adapter, 0, len(entries))
+	for _, entry := range entries {
+		mac, err := ParseMacAddress(entry.MacAddr)
+		if err != nil {
+			log.Printf("skipping unparseable adapter MAC %q: %v", entry.MacAddr, err)
+			continue
+		}
+		output, err := m.run.Run(ctx, nil, "bluetoothctl", "show", entry.MacAddr)
+		if err := bluetoothctlError(output, err); err != nil {
+			return nil, err
+		}
+		info, err := bluetoothctl.ParseControllerInfo(output)
+		if err != nil {
+			return nil, err
+		}
+
+		adapter := Adapter{
+			Name:         entry.Name,
+			MacAddr:      mac,
+			Powered:      *info.Powered,
+			Discoverable: *info.Discoverable,
+			Pairable:     *info.Pairable,
+			Selected:     entry.Default,
+		}
+		if !m.adapter.IsZero() {
+			adapter.Selected = mac == m.adapter
+		}
+		adapters = append(adapters, adapter)
+	}
+	return adapters, nil
+}
+
+func (m linuxBluetoothctlBluetoothManager) SetAdapterPowered(ctx context.Context, adapter MacAddress, powered bool) error {
+	state := "off"
+	if powered {
+		state = "on"
+	}
+	output, err := m.bluetoothctlOn(ctx, adapter, 0, "power", state)
+	return bluetoothctlError(output, err)
+}
+
+// Watch starts an interactive bluetoothctl session and turns the [NEW], [CHG] and [DEL] lines it prints into
+// DeviceEvents. The events stop if bluetoothctl exits.
+//
+// If we're pinned to an adapter, the session selects it, but bluetoothctl doesn't say which adapter an event is for, so
+// changes to devices on other adapters may be reported too.
+func (m linuxBluetoothctlBluetoothManager) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	var stdin []byte
+	if !m.adapter.IsZero() {
+		if _, err := m.findAdapter(ctx, m.adapter); err != nil {
+			return nil, err
+		}
+		stdin = []byte(fmt.Sprintf("select %s\n", m.adapter.FormatAs(bluetoothctlMacFormat)))
+	}
+	// bluetoothctl announces every device it already knows about with a [NEW] line when it starts, so find out which
+	// ones those are to avoid reporting them as added.
+	entries, err := m.listEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := m.stream(ctx, stdin, "bluetoothctl")
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[MacAddress]string{}
+	for _, entry := range entries {
+		if mac, err := ParseMacAddress(entry.MacAddr); err == nil {
+			names[mac] = entry.Name
+		}
+	}
+
+	events := make(chan DeviceEvent)
+	go func() {
+		defer close(events)
+		defer stream.Close()
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			line, ok := bluetoothctl.CleanLine(scanner.Text())
+			if !ok {
+				continue
+			}
+			parsed, ok := bluetoothctl.ParseDeviceEvent(line)
+			if !ok {
+				continue
+			}
+			event, ok := bluetoothctlEvent(parsed, names)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("reading bluetoothctl events: %v", err)
+		}
+	}()
+	return events, nil
+}
+
+// bluetoothctlWatchedProperties are the [CHG] properties Watch reports as DevicePropertyChanged events. They match the
+// fields of BluetoothDevice, so we ignore the rest, like the RSSI updates printed while scanning.
+var bluetoothctlWatchedProperties = map[string]bool{
+	"Name": true, "Alias": true, "Class": true, "Icon": true, "Paired": true, "Trusted": true, "Blocked": true,
+	"Battery Percentage": true,
+}
+
+// bluetoothctlEvent converts a parsed event line into a DeviceEvent, updating names (the devices we know about and
+// their names) as it goes. It returns false for events we don't report.
+func bluetoothctlEvent(parsed bluetoothctl.DeviceEvent, names map[MacAddress]string) (DeviceEvent, bool) {
+	mac, err := ParseMacAddress(parsed.MacAddr)
+	if err != nil {
+		return DeviceEvent{}, false
+	}
+
+	switch parsed.Event {
+	case bluetoothctl.EventNew:
+		if _, known := names[mac]; known {
+			return DeviceEvent{}, false
+		}
+		names[mac] = parsed.Name
+		return DeviceEvent{Type: DeviceAdded, MacAddr: mac, Name: parsed.Name}, true
+	case bluetoothctl.EventDeleted:
+		delete(names, mac)
+		return DeviceEvent{Type: DeviceRemoved, MacAddr: mac, Name: parsed.Name}, true
+	}
+
+	if parsed.Property == "Name" {
+		names[mac] = parsed.Value
+	}
+	event := DeviceEvent{MacAddr: mac, Name: names[mac]}
+	switch {
+	case parsed.Property == "Connected" && parsed.Value == "yes":
+		event.Type = DeviceConnected
+	case parsed.Property == "Connected":
+		event.Type = DeviceDisconnected
+	case bluetoothctlWatchedProperties[parsed.Property]:
+		event.Type = DevicePropertyChanged
+		event.Property = parsed.Property
+		// Convert the value to the type of the BluetoothDevice field, so it matches what the other backends report.
+		switch parsed.Property {
+		case "Paired", "Trusted", "Blocked":
+			event.Value = parsed.Value == "yes"
+		case "Class":
+			class, err := strconv.ParseUint(parsed.Value, 0, 32)
+			if err != nil {
+				return DeviceEvent{}, false
+			}
+			event.Value = uint32(class)
+		case "Battery Percentage":
+			battery := bluetoothctl.ParseInt(parsed.Value)
+			if battery == nil {
+				return DeviceEvent{}, false
+			}
+			event.Property = "Battery"
+			event.Value = *battery
+		default:
+			event.Value = parsed.Value
+		}
+	default:
+		return DeviceEvent{}, false
+	}
+	return event, true
+}
+
+// Connect runs `bluetoothctl connect` and then waits for `bluetoothctl info` to say the device is connected, retrying
+// according to the connect policy. bluetoothctl often says "Connection successful" before the device's profiles are
+// up, and older versions exit zero even after printing "Failed to connect", which bluetoothctlError catches.
+func (m linuxBluetoothctlBluetoothManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	return connectVerified(ctx, m.connectPolicy, macAddr, func(ctx context.Context) error {
+		output, err := m.bluetoothctl(ctx, "connect", macAddr.FormatAs(bluetoothctlMacFormat))
+		return bluetoothctlError(output, err)
+	}, func(ctx context.Context) (bool, error) {
+		return m.IsConnected(ctx, macAddr)
+	})
+}
+
+// Disconnect runs `bluetoothctl disconnect`, which waits for BlueZ to finish disconnecting. bluetoothctlError catches
+// the failures it reports in its output rather than its exit status.
+func (m linuxBluetoothctlBluetoothManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.bluetoothctl(ctx, "disconnect", macAddr.FormatAs(bluetoothctlMacFormat))
+	return bluetoothctlError(output, err)
 }
 
+// List lists all devices known to bluetoothctl.
+//
+// Running `bluetoothctl info` for every device is slow, since each call forks a new process that has to connect to
+// bluetoothd. When the installed version supports it, List instead takes the connected, paired and trusted state of
+// every device from one `devices <filter>` call each (run concurrently), and only runs `info` for the connected
+// devices, to fill in their Class, Icon, Blocked and Battery. Disconnected devices keep the Class, Icon and Blocked
+// that `info` last reported for them, if it's been run for them, and have no Battery, which BlueZ only reports while a
+// device is connected anyway. Use Get for the latest details of one.
+//
+// On older versions, List falls back to running `info` for each device. Either way, it runs at most infoConcurrency
+// `info` processes at once, and asks UPower for the battery levels of connected devices `info` doesn't have one for.
 func (m linuxBluetoothctlBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
-	output, err := runCmd(ctx, "bluetoothctl", "devices")
+	entries, err := m.listEntries(ctx)
 	if err != nil {
-		// TODO: process the error to see what went wrong
 		return nil, err
 	}
 
-	lines := bytes.Split(output, []byte("\n"))
+	var devices []BluetoothDevice
+	if m.supportsDeviceFilter(ctx) {
+		devices, err = m.listWithFilters(ctx, entries)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		devices = m.listWithInfo(ctx, entries)
+	}
+	addBatteries(ctx, devices, m.batteries)
+	return devices, nil
+}
+
+// listEntries runs `bluetoothctl devices [filter]` and returns the parsed entries.
+func (m linuxBluetoothctlBluetoothManager) listEntries(
+	ctx context.Context, filter ...string,
+) ([]bluetoothctl.DeviceListEntry, error) {
+	output, err := m.bluetoothctl(ctx, append([]string{"devices"}, filter...)...)
+	if err := bluetoothctlError(output, err); err != nil {
+		return nil, err
+	}
+	return bluetoothctl.ParseDevices(output), nil
+}
+
+func (m linuxBluetoothctlBluetoothManager) listWithFilters(
+	ctx context.Context, entries []bluetoothctl.DeviceListEntry,
+) ([]BluetoothDevice, error) {
+	// The filtered queries are independent, so run them at the same time.
+	filters := []string{"Connected", "Paired", "Trusted"}
+	matching := make([][]bluetoothctl.DeviceListEntry, len(filters))
+	errs := make([]error, len(filters))
+	var wg sync.WaitGroup
+	for i, filter := range filters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			matching[i], errs[i] = m.listEntries(ctx, filter)
+		}()
+	}
+	wg.Wait()
+
+	// filtered maps each filter to the set of (uppercase) MACs matching it.
+	filtered := map[string]map[string]bool{}
+	for i, filter := range filters {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		filtered[filter] = map[string]bool{}
+		for _, entry := range matching[i] {
+			filtered[filter][strings.ToUpper(entry.MacAddr)] = true
+		}
+	}
+
 	devices := []BluetoothDevice{}
-	for _, line := range lines {
-		ms := bluetoothctlDeviceListRegex.FindSubmatch(line)
-		if ms == nil {
-			lineStr := string(line)
-			if strings.TrimSpace(lineStr) != "" {
-				log.Printf("failed to match bluetoothctl device line: %s", string(line))
-			}
+	var connected []int
+	for _, entry := range entries {
+		macAddr, err := ParseMacAddress(entry.MacAddr)
+		if err != nil {
+			log.Printf("failed to parse MAC in bluetoothctl device entry: %v", err)
 			continue
 		}
-		macAddr := string(ms[1])
-		name := string(ms[2])
-		connected, err := m.IsConnected(ctx, macAddr)
-		if err != nil {
-			log.Printf("failed to get connection status for device %q with MAC %s: %v", name, macAddr, err)
-			connected = false
+		key := strings.ToUpper(entry.MacAddr)
+		if filtered["Connected"][key] {
+			connected = append(connected, len(devices))
 		}
-		devices = append(devices, BluetoothDevice{
-			Name:      name,
+		device := BluetoothDevice{
+			// `devices` prints the alias, which is what the user sees, so every device's Name comes from here rather
+			// than `info`, whether or not it's connected.
+			Name:      entry.Name,
 			MacAddr:   macAddr,
-			Connected: connected,
-		})
+			Connected: filtered["Connected"][key],
+			Alias:     entry.Name,
+			Paired:    filtered["Paired"][key],
+			Trusted:   filtered["Trusted"][key],
+		}
+		if details, ok := m.details.get(macAddr); ok {
+			device.Class, device.Icon, device.Blocked = details.Class, details.Icon, details.Blocked
+		}
+		devices = append(devices, device)
+	}
+
+	// Fill in the details of the connected devices, which are the ones whose battery level and type people look at.
+	// The state still comes from the filtered queries, so a device connecting or disconnecting in between doesn't make
+	// the list contradict itself.
+	macAddrs := make([]MacAddress, len(connected))
+	for i, j := range connected {
+		macAddrs[i] = devices[j].MacAddr
+	}
+	for i, info := range m.getAll(ctx, macAddrs) {
+		if info == nil {
+			continue
+		}
+		device := &devices[connected[i]]
+		device.Class = info.Class
+		device.Icon = info.Icon
+		device.Blocked = info.Blocked
+		device.Battery = info.Battery
+	}
+	return devices, nil
+}
+
+func (m linuxBluetoothctlBluetoothManager) listWithInfo(
+	ctx context.Context, entries []bluetoothctl.DeviceListEntry,
+) []BluetoothDevice {
+	var listed []bluetoothctl.DeviceListEntry
+	var macAddrs []MacAddress
+	for _, entry := range entries {
+		macAddr, err := ParseMacAddress(entry.MacAddr)
+		if err != nil {
+			log.Printf("failed to parse MAC in bluetoothctl device entry: %v", err)
+			continue
+		}
+		listed = append(listed, entry)
+		macAddrs = append(macAddrs, macAddr)
+	}
+
+	devices := []BluetoothDevice{}
+	for i, device := range m.getAll(ctx, macAddrs) {
+		if device == nil {
+			device = &BluetoothDevice{Name: listed[i].Name, MacAddr: macAddrs[i]}
+		}
+		devices = append(devices, *device)
+	}
+	return devices
+}
+
+// getAll runs info for each device, infoConcurrency at a time, and returns the results in the same order. Devices Get
+// fails for (or that we run out of time for) are logged and left nil.
+func (m linuxBluetoothctlBluetoothManager) getAll(ctx context.Context, macAddrs []MacAddress) []*BluetoothDevice {
+	concurrency := m.infoConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Each goroutine writes to its own slot, so the output stays in the same order as the input.
+	results := make([]*BluetoothDevice, len(macAddrs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, macAddr := range macAddrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+
+			device, err := m.info(ctx, macAddr)
+			if err != nil {
+				log.Printf("failed to get info for device with MAC %s: %v", macAddr, err)
+				return
+			}
+			results[i] = &device
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// supportsDeviceFilter returns true if the installed bluetoothctl accepts `devices <filter>`.
+func (m linuxBluetoothctlBluetoothManager) supportsDeviceFilter(ctx context.Context) bool {
+	version, err := m.version.get(ctx, m.run)
+	if err != nil {
+		log.Printf("failed to get bluetoothctl version, assuming it's old: %v", err)
+		return false
+	}
+	return !version.less(bluetoothctlDeviceFilterVersion)
+}
+
+func (m linuxBluetoothctlBluetoothManager) Pair(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.bluetoothctl(ctx, "pair", macAddr.FormatAs(bluetoothctlMacFormat))
+	// Pairing with a device we're already paired with isn't an error as far as our callers are concerned.
+	if bytes.Contains(output, []byte("org.bluez.Error.AlreadyExists")) {
+		return nil
+	}
+	return bluetoothctlError(output, err)
+}
+
+func (m linuxBluetoothctlBluetoothManager) Trust(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.bluetoothctl(ctx, "trust", macAddr.FormatAs(bluetoothctlMacFormat))
+	return bluetoothctlError(output, err)
+}
+
+func (m linuxBluetoothctlBluetoothManager) Untrust(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.bluetoothctl(ctx, "untrust", macAddr.FormatAs(bluetoothctlMacFormat))
+	return bluetoothctlError(output, err)
+}
+
+func (m linuxBluetoothctlBluetoothManager) Remove(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.bluetoothctl(ctx, "remove", macAddr.FormatAs(bluetoothctlMacFormat))
+	if err := bluetoothctlError(output, err); err != nil {
+		return err
+	}
+	m.details.forget(macAddr)
+	return nil
+}
+
+func (m linuxBluetoothctlBluetoothManager) Block(ctx context.Context, macAddr MacAddress) error {
+	return m.setBlocked(ctx, macAddr, true)
+}
+
+func (m linuxBluetoothctlBluetoothManager) Unblock(ctx context.Context, macAddr MacAddress) error {
+	return m.setBlocked(ctx, macAddr, false)
+}
+
+// setBlocked runs `block` or `unblock`, and records the change in m.details, since List doesn't run `info` for
+// disconnected devices to find out.
+func (m linuxBluetoothctlBluetoothManager) setBlocked(ctx context.Context, macAddr MacAddress, blocked bool) error {
+	cmd := "unblock"
+	if blocked {
+		cmd = "block"
+	}
+	output, err := m.bluetoothctl(ctx, cmd, macAddr.FormatAs(bluetoothctlMacFormat))
+	if err := bluetoothctlError(output, err); err != nil {
+		return err
+	}
+	m.details.update(macAddr, func(device *BluetoothDevice) { device.Blocked = blocked })
+	return nil
+}
+
+// Scan runs `bluetoothctl scan on` for the given duration, rounded up to a whole number of seconds since that's what
+// --timeout takes. Devices BlueZ already knew about don't announce their names during the scan, so any that are
+// missing are filled in from `bluetoothctl devices` afterwards.
+func (m linuxBluetoothctlBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	output, err := m.bluetoothctlOn(ctx, m.adapter, duration, "scan", "on")
+	if err := bluetoothctlError(output, err); err != nil {
+		return nil, err
 	}
 
+	results := bluetoothctl.ParseScan(output)
+	devices := make([]DiscoveredDevice, 0, len(results))
+	names := map[MacAddress]string{}
+	for _, result := range results {
+		mac, err := ParseMacAddress(result.MacAddr)
+		if err != nil {
+			log.Printf("skipping unparseable MAC %q in scan output: %v", result.MacAddr, err)
+			continue
+		}
+		device := DiscoveredDevice{Name: result.Name, MacAddr: mac, RSSI: result.RSSI}
+		if result.Class != nil {
+			device.Class = *result.Class
+		}
+		if device.Name == "" {
+			names[mac] = ""
+		}
+		devices = append(devices, device)
+	}
+
+	if len(names) > 0 {
+		// This is only a nicety, so don't fail the whole scan if it doesn't work.
+		entries, err := m.listEntries(ctx)
+		if err != nil {
+			log.Printf("failed to look up names of scanned devices: %v", err)
+		}
+		for _, entry := range entries {
+			mac, err := ParseMacAddress(entry.MacAddr)
+			if err != nil {
+				continue
+			}
+			// bluetoothctl lists unnamed devices with their address in place of a name.
+			if _, ok := names[mac]; ok && entry.Name != strings.ReplaceAll(entry.MacAddr, ":", "-") {
+				names[mac] = entry.Name
+			}
+		}
+		for i := range devices {
+			if devices[i].Name == "" {
+				devices[i].Name = names[devices[i].MacAddr]
+			}
+		}
+	}
 	return devices, nil
 }
 
-func (m linuxBluetoothctlBluetoothManager) Get(ctx context.Context, macAddr string) (BluetoothDevice, error) {
-	output, err := runCmd(ctx, "bluetoothctl", "info", macAddr)
+// Get returns the details from `bluetoothctl info`, with the battery level from UPower if the device is connected and
+// bluetoothctl doesn't know it.
+func (m linuxBluetoothctlBluetoothManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	device, err := m.info(ctx, macAddr)
 	if err != nil {
-		// TODO: process the error to see what went wrong
+		return BluetoothDevice{}, err
+	}
+	devices := []BluetoothDevice{device}
+	addBatteries(ctx, devices, m.batteries)
+	return devices[0], nil
+}
+
+// info runs `bluetoothctl info` for the device.
+func (m linuxBluetoothctlBluetoothManager) info(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	output, err := m.bluetoothctl(ctx, "info", macAddr.FormatAs(bluetoothctlMacFormat))
+	if err := bluetoothctlError(output, err); err != nil {
 		return BluetoothDevice{}, err
 	}
 
@@ -93,17 +706,168 @@ func (m linuxBluetoothctlBluetoothManager) Get(ctx context.Context, macAddr stri
 		return BluetoothDevice{}, err
 	}
 
-	return BluetoothDevice{
-		Name:      *device.Name,
-		MacAddr:   *device.MacAddr,
-		Connected: *device.Connected,
-	}, nil
+	mac, err := ParseMacAddress(*device.MacAddr)
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+
+	result := bluetoothctlDevice(mac, device)
+	m.details.set(result)
+	return result, nil
 }
 
-func (m linuxBluetoothctlBluetoothManager) IsConnected(ctx context.Context, macAddr string) (bool, error) {
-	device, err := m.Get(ctx, macAddr)
+// IsConnected doesn't ask UPower for batteries, so that polling it (see Connect) stays cheap.
+func (m linuxBluetoothctlBluetoothManager) IsConnected(ctx context.Context, macAddr MacAddress) (bool, error) {
+	device, err := m.info(ctx, macAddr)
 	if err != nil {
 		return false, err
 	}
 	return device.Connected, nil
 }
+
+// bluetoothctlDevice converts the parsed output of `bluetoothctl info` into a BluetoothDevice. info must have passed
+// Validate.
+func bluetoothctlDevice(mac MacAddress, info bluetoothctl.DeviceInfo) BluetoothDevice {
+	device := BluetoothDevice{
+		Name:      *info.Name,
+		MacAddr:   mac,
+		Connected: *info.Connected,
+	}
+	if info.Alias != nil {
+		device.Alias = *info.Alias
+	}
+	if info.Class != nil {
+		device.Class = *info.Class
+	}
+	if info.Icon != nil {
+		device.Icon = *info.Icon
+	}
+	if info.Paired != nil {
+		device.Paired = *info.Paired
+	}
+	if info.Trusted != nil {
+		device.Trusted = *info.Trusted
+	}
+	if info.Blocked != nil {
+		device.Blocked = *info.Blocked
+	}
+	device.Battery = info.BatteryPercentage
+	return device
+}
+
+// A bluetoothctlVersion is a BlueZ release number like 5.66.
+type bluetoothctlVersion struct {
+	Major, Minor int
+}
+
+var bluetoothctlVersionRegex = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// parseBluetoothctlVersion parses the output of `bluetoothctl --version`, e.g. `bluetoothctl: 5.66`.
+func parseBluetoothctlVersion(output []byte) (bluetoothctlVersion, error) {
+	ms := bluetoothctlVersionRegex.FindSubmatch(output)
+	if ms == nil {
+		return bluetoothctlVersion{}, fmt.Errorf("couldn't find a version number in %q", output)
+	}
+	major, _ := strconv.Atoi(string(ms[1]))
+	minor, _ := strconv.Atoi(string(ms[2]))
+	return bluetoothctlVersion{Major: major, Minor: minor}, nil
+}
+
+func (v bluetoothctlVersion) less(other bluetoothctlVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	return v.Minor < other.Minor
+}
+
+// bluetoothctlVersionCache remembers the bluetoothctl version once we've successfully looked it up. Failures aren't
+// cached, so a timeout on one request doesn't make us assume an old version forever.
+type bluetoothctlVersionCache struct {
+	mu      sync.Mutex
+	version *bluetoothctlVersion
+}
+
+func (c *bluetoothctlVersionCache) get(ctx context.Context, run CommandRunner) (bluetoothctlVersion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != nil {
+		return *c.version, nil
+	}
+
+	output, err := run.Run(ctx, nil, "bluetoothctl", "--version")
+	if err != nil {
+		return bluetoothctlVersion{}, err
+	}
+	version, err := parseBluetoothctlVersion(output)
+	if err != nil {
+		return bluetoothctlVersion{}, err
+	}
+	c.version = &version
+	return version, nil
+}
+
+// bluetoothctlAdapterCheckInterval is how long bluetoothctlOn trusts that an adapter it's seen in `bluetoothctl list`
+// is still there, rather than checking again before every command.
+const bluetoothctlAdapterCheckInterval = 10 * time.Second
+
+// bluetoothctlAdapterCache remembers when each adapter was last found in `bluetoothctl list`. Failures aren't cached,
+// so an adapter that's plugged back in is used again straight away.
+type bluetoothctlAdapterCache struct {
+	mu      sync.Mutex
+	checked map[MacAddress]time.Time
+}
+
+// check returns nil if adapter was found within the last bluetoothctlAdapterCheckInterval, and otherwise looks for it
+// with find. Concurrent checks wait for each other, so a burst of commands only looks once.
+func (c *bluetoothctlAdapterCache) check(
+	ctx context.Context, adapter MacAddress,
+	find func(context.Context, MacAddress) (bluetoothctl.ControllerListEntry, error),
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if checked, ok := c.checked[adapter]; ok && time.Since(checked) < bluetoothctlAdapterCheckInterval {
+		return nil
+	}
+	if _, err := find(ctx, adapter); err != nil {
+		delete(c.checked, adapter)
+		return err
+	}
+	c.checked[adapter] = time.Now()
+	return nil
+}
+
+// bluetoothctlDetailsCache holds the last `info` result for each device, so List can keep the details it doesn't run
+// `info` for.
+type bluetoothctlDetailsCache struct {
+	mu      sync.Mutex
+	devices map[MacAddress]BluetoothDevice
+}
+
+func (c *bluetoothctlDetailsCache) get(macAddr MacAddress) (BluetoothDevice, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	device, ok := c.devices[macAddr]
+	return device, ok
+}
+
+func (c *bluetoothctlDetailsCache) set(device BluetoothDevice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.devices[device.MacAddr] = device
+}
+
+// update applies fn to the device's details, starting from empty ones if there aren't any yet.
+func (c *bluetoothctlDetailsCache) update(macAddr MacAddress, fn func(*BluetoothDevice)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	device := c.devices[macAddr]
+	device.MacAddr = macAddr
+	fn(&device)
+	c.devices[macAddr] = device
+}
+
+func (c *bluetoothctlDetailsCache) forget(macAddr MacAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.devices, macAddr)
+}
@@ -0,0 +1,242 @@
+package bluetooth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/linux/bluetoothctl"
+)
+
+// bluetoothctlMarkerPrefix starts the marker lines bluetoothctlSession writes after each command. bluetoothctl doesn't
+// have a command by that name, so it answers with "Invalid command", which is how we know the command before it has
+// finished.
+const bluetoothctlMarkerPrefix = "dwmbt-end-of-command-"
+
+// bluetoothctlSession is a CommandRunner that keeps one interactive bluetoothctl process running and feeds it
+// commands on stdin, rather than starting a new process for each one. Starting bluetoothctl and waiting for it to
+// connect to bluetoothd takes tens of milliseconds, which is most of the cost of a typical command, so this makes
+// commands much faster. See Options.BluetoothctlSession.
+//
+// bluetoothctl reads the next line of its input, and prints the prompt for it, only once the previous command has
+// finished. So after each command we send a marker line that it doesn't recognize, and everything it prints before
+// it echoes the marker back is the command's output. Its complaint about the marker is thrown away. The prompts, colour codes and any events it prints in between are
+// left for the parsers in the bluetoothctl package to strip, just like with the output of a one-off process.
+//
+// Callers take turns, since the process can only run one command at a time. If the process dies, or a command runs
+// past its context's deadline (after which we can't tell where its output ends), the process is killed and a new one
+// is started for the next command.
+//
+// Only plain `bluetoothctl <command>` calls go to the session. Calls with flags (like --timeout for scanning), and
+// scripts that select an adapter other than the session's, are handed to fallback.
+type bluetoothctlSession struct {
+	// command is the bluetoothctl executable.
+	command string
+	// adapter is the adapter the session selects when it starts, or zero for bluetoothctl's default.
+	adapter  MacAddress
+	fallback CommandRunner
+
+	// turn holds a value while a caller is using the session. Everything below is only touched by the caller holding
+	// it.
+	turn    chan struct{}
+	proc    *bluetoothctlProcess
+	markers int
+}
+
+func newBluetoothctlSession(command string, adapter MacAddress, fallback CommandRunner) *bluetoothctlSession {
+	return &bluetoothctlSession{command: command, adapter: adapter, fallback: fallback, turn: make(chan struct{}, 1)}
+}
+
+// A bluetoothctlProcess is a running interactive bluetoothctl.
+type bluetoothctlProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// lines receives bluetoothctl's output a line at a time, and is closed when it exits.
+	lines chan string
+}
+
+func (s *bluetoothctlSession) Run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+	line, ok := s.sessionCommand(stdin, cmd, args)
+	if !ok {
+		return s.fallback.Run(ctx, stdin, cmd, args...)
+	}
+
+	select {
+	case s.turn <- struct{}{}:
+		defer func() { <-s.turn }()
+	case <-ctx.Done():
+		return nil, &CommandError{Command: cmd, Args: args, ExitCode: -1, Err: ctx.Err()}
+	}
+
+	// Throw away anything bluetoothctl printed since the last command, like events and the end of the last marker's
+	// "Invalid command" message. If it's exited in the meantime, start it again.
+	if s.proc != nil && !s.proc.drain() {
+		s.stop()
+	}
+	if s.proc == nil {
+		output, err := s.start(ctx)
+		if err != nil {
+			return output, err
+		}
+	}
+	return s.exchange(ctx, line)
+}
+
+// sessionCommand returns the line to send to the session for a call to Run, or false if it has to go to the fallback.
+// Scripts are only accepted if they select the session's own adapter, which it has already selected, and then run a
+// single command.
+func (s *bluetoothctlSession) sessionCommand(stdin []byte, cmd string, args []string) (string, bool) {
+	if cmd != "bluetoothctl" {
+		return "", false
+	}
+	if stdin == nil {
+		line := strings.Join(args, " ")
+		// A newline would smuggle a second command into the session.
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") || strings.ContainsAny(line, "\r\n") {
+			return "", false
+		}
+		return line, true
+	}
+	if len(args) != 0 || s.adapter.IsZero() {
+		return "", false
+	}
+	selectLine, command, _ := strings.Cut(strings.TrimSpace(string(stdin)), "\n")
+	if selectLine != "select "+s.adapter.FormatAs(bluetoothctlMacFormat) || command == "" ||
+		strings.ContainsAny(command, "\r\n") {
+		return "", false
+	}
+	return command, true
+}
+
+// start starts a new bluetoothctl process and selects the session's adapter, if it has one. If that fails, it returns
+// bluetoothctl's output along with the error so bluetoothctlError can explain it.
+func (s *bluetoothctlSession) start(ctx context.Context) ([]byte, error) {
+	cmd := exec.Command(s.command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, &CommandError{Command: s.command, ExitCode: -1, Err: err}
+	}
+
+	proc := &bluetoothctlProcess{cmd: cmd, stdin: stdin, lines: make(chan string, 64)}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			proc.lines <- scanner.Text()
+		}
+		close(proc.lines)
+		_ = cmd.Wait()
+	}()
+	s.proc = proc
+
+	if s.adapter.IsZero() {
+		return nil, nil
+	}
+	output, err := s.exchange(ctx, "select "+s.adapter.FormatAs(bluetoothctlMacFormat))
+	if err == nil {
+		err = bluetoothctlError(output, nil)
+	}
+	if err != nil {
+		s.stop()
+		return output, err
+	}
+	return nil, nil
+}
+
+// exchange sends line to the process and returns what bluetoothctl prints in response.
+func (s *bluetoothctlSession) exchange(ctx context.Context, line string) ([]byte, error) {
+	proc := s.proc
+	args := strings.Fields(line)
+	s.markers++
+	marker := fmt.Sprintf("%s%d", bluetoothctlMarkerPrefix, s.markers)
+	if _, err := io.WriteString(proc.stdin, line+"\n"+marker+"\n"); err != nil {
+		s.stop()
+		return nil, &CommandError{Command: s.command, Args: args, ExitCode: -1, Err: err}
+	}
+
+	var output strings.Builder
+	for {
+		select {
+		case text, ok := <-proc.lines:
+			if !ok {
+				s.stop()
+				return []byte(output.String()), &CommandError{
+					Command:  s.command,
+					Args:     args,
+					ExitCode: -1,
+					Stdout:   []byte(output.String()),
+					Err:      errors.New("bluetoothctl exited"),
+				}
+			}
+			if strings.Contains(text, marker) {
+				return []byte(output.String()), nil
+			}
+			if bluetoothctlSessionNoise(text) {
+				continue
+			}
+			output.WriteString(text)
+			output.WriteByte('\n')
+		case <-ctx.Done():
+			// We've lost track of where we are in bluetoothctl's output, so start afresh next time.
+			s.stop()
+			return []byte(output.String()), &CommandError{
+				Command:  s.command,
+				Args:     args,
+				ExitCode: -1,
+				Stdout:   []byte(output.String()),
+				Err:      ctx.Err(),
+			}
+		}
+	}
+}
+
+// bluetoothctlSessionNoise reports whether a line is part of bluetoothctl's complaint about an earlier marker, which can
+// still be arriving when the next command is sent.
+func bluetoothctlSessionNoise(raw string) bool {
+	if strings.Contains(raw, bluetoothctlMarkerPrefix) {
+		return true
+	}
+	// e.g. `Use "help" for a list of available commands in a menu.`
+	line, _ := bluetoothctl.CleanLine(raw)
+	return strings.HasPrefix(line.Text, `Use "`)
+}
+
+// drain discards any output that's waiting to be read. It returns false if the process has exited.
+func (p *bluetoothctlProcess) drain() bool {
+	for {
+		select {
+		case _, ok := <-p.lines:
+			if !ok {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// stop kills the process, if it's still running, and forgets it.
+func (s *bluetoothctlSession) stop() {
+	if s.proc == nil {
+		return
+	}
+	_ = s.proc.stdin.Close()
+	_ = s.proc.cmd.Process.Kill()
+	// Let the reader finish, so it doesn't block forever on a full channel.
+	go func(lines chan string) {
+		for range lines {
+		}
+	}(s.proc.lines)
+	s.proc = nil
+}
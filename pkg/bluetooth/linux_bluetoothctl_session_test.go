@@ -0,0 +1,315 @@
+package bluetooth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBluetoothctlEnvVar makes the test binary act as bluetoothctl, so the session tests and benchmarks have a real
+// process to talk to.
+const fakeBluetoothctlEnvVar = "DWMBT_FAKE_BLUETOOTHCTL"
+
+// fakeBluetoothctlStartup is how long the fake bluetoothctl takes to start, like the real one connecting to bluetoothd.
+const fakeBluetoothctlStartup = 20 * time.Millisecond
+
+// fakeBluetoothctlPrompt is the prompt bluetoothctl prints when it's ready for a command.
+const fakeBluetoothctlPrompt = "\x1b[0;94m[bluetooth]\x1b[0m# "
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeBluetoothctlEnvVar) != "" {
+		os.Exit(fakeBluetoothctlMain(os.Args[1:], os.Stdin, os.Stdout))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeBluetoothctlMain runs the fake bluetoothctl. With arguments it runs them as a single command, and without it
+// reads commands from stdin like the interactive bluetoothctl. Besides the usual commands, `sleep <duration>` stalls
+// it for a while.
+func fakeBluetoothctlMain(args []string, stdin io.Reader, stdout io.Writer) int {
+	fake := newFakeBluetoothctl("5.66", 20)
+	time.Sleep(fakeBluetoothctlStartup)
+
+	if len(args) > 0 {
+		output, err := fake.exec("bluetoothctl", 0, args...)
+		_, _ = stdout.Write(output)
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Agent registered\n%s", fakeBluetoothctlPrompt)
+	selected := 0
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		// Like readline when stdin isn't a terminal, echo the command back after the prompt.
+		fmt.Fprintf(stdout, "%s\n", scanner.Text())
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 1 && fields[0] == "exit":
+			return 0
+		case len(fields) == 2 && fields[0] == "sleep":
+			d, _ := time.ParseDuration(fields[1])
+			time.Sleep(d)
+		case len(fields) == 2 && fields[0] == "select":
+			if i := fake.controller(fields[1]); i != -1 {
+				selected = i
+			} else {
+				fmt.Fprintf(stdout, "Controller %s not available\n", fields[1])
+			}
+		default:
+			output, err := fake.exec("bluetoothctl", selected, fields...)
+			if err != nil && output == nil {
+				fmt.Fprintf(stdout, "Invalid command in menu main: %s\n\n"+
+					"Use \"help\" for a list of available commands in a menu.\n"+
+					"Use \"menu <submenu>\" if you want to enter any submenu.\n"+
+					"Use \"back\" if you want to return to menu main.\n", fields[0])
+			}
+			_, _ = stdout.Write(output)
+		}
+		fmt.Fprint(stdout, fakeBluetoothctlPrompt)
+	}
+	return 0
+}
+
+// forkFakeBluetoothctl returns a CommandRunner that runs bluetoothctl commands with a new fake bluetoothctl process
+// each time, and counts them.
+func forkFakeBluetoothctl(tb testing.TB) (CommandRunner, *atomic.Int64) {
+	tb.Setenv(fakeBluetoothctlEnvVar, "1")
+	var calls atomic.Int64
+	return CommandRunnerFunc(func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		calls.Add(1)
+		return ExecRunner{}.Run(ctx, stdin, os.Args[0], args...)
+	}), &calls
+}
+
+// sessionPid returns the process ID of the session's bluetoothctl, or 0 if it isn't running.
+func (s *bluetoothctlSession) sessionPid() int {
+	s.turn <- struct{}{}
+	defer func() { <-s.turn }()
+	if s.proc == nil {
+		return 0
+	}
+	return s.proc.cmd.Process.Pid
+}
+
+func TestBluetoothctlSession(t *testing.T) {
+	fork, forks := forkFakeBluetoothctl(t)
+	session := newBluetoothctlSession(os.Args[0], MacAddress{}, fork)
+	defer session.stop()
+	m := newLinuxBluetoothctlBluetoothManager(session)
+	ctx := context.Background()
+
+	devices, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 20 {
+		t.Errorf("got %d devices, wanted 20", len(devices))
+	}
+	pid := session.sessionPid()
+
+	headset := MustParseMacAddress("F8:4E:17:66:E8:01")
+	device, err := m.Get(ctx, headset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Headset 1" || device.Connected {
+		t.Errorf("got %+v, wanted Headset 1, disconnected", device)
+	}
+	// The session keeps its state between commands, just like bluetoothd would.
+	if err := m.Connect(ctx, headset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, MustParseMacAddress("4C:87:5D:2A:11:9F")); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("got %v, wanted ErrDeviceNotFound", err)
+	}
+
+	if got := session.sessionPid(); got != pid {
+		t.Errorf("got pid %d, wanted every command to run in %d", got, pid)
+	}
+	// Only `bluetoothctl --version` needs a process of its own.
+	if got := forks.Load(); got != 1 {
+		t.Errorf("got %d forks, wanted 1", got)
+	}
+}
+
+func TestBluetoothctlSessionRestarts(t *testing.T) {
+	fork, _ := forkFakeBluetoothctl(t)
+	session := newBluetoothctlSession(os.Args[0], MacAddress{}, fork)
+	defer session.stop()
+	ctx := context.Background()
+
+	if _, err := session.Run(ctx, nil, "bluetoothctl", "devices"); err != nil {
+		t.Fatal(err)
+	}
+	pid := session.sessionPid()
+	if _, err := session.Run(ctx, nil, "bluetoothctl", "exit"); err == nil {
+		t.Errorf("got no error, wanted one for bluetoothctl exiting mid-command")
+	}
+
+	// The next command starts a new bluetoothctl.
+	output, err := session.Run(ctx, nil, "bluetoothctl", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "Device F8:4E:17:66:E8:13 Headset 19") {
+		t.Errorf("got %q, wanted the list of devices", output)
+	}
+	if got := session.sessionPid(); got == pid || got == 0 {
+		t.Errorf("got pid %d, wanted a new process", got)
+	}
+}
+
+func TestBluetoothctlSessionTimeout(t *testing.T) {
+	fork, _ := forkFakeBluetoothctl(t)
+	session := newBluetoothctlSession(os.Args[0], MacAddress{}, fork)
+	defer session.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := session.Run(ctx, nil, "bluetoothctl", "sleep", "10s"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, wanted context.DeadlineExceeded", err)
+	}
+
+	// The stuck process was killed, so the next command doesn't have to wait for it.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output, err := session.Run(ctx, nil, "bluetoothctl", "info", "F8:4E:17:66:E8:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "Name: Headset 0") {
+		t.Errorf("got %q, wanted info for Headset 0", output)
+	}
+}
+
+func TestBluetoothctlSessionPinnedAdapter(t *testing.T) {
+	fork, forks := forkFakeBluetoothctl(t)
+	dongle := MustParseMacAddress("5C:F3:70:9B:2E:01")
+	session := newBluetoothctlSession(os.Args[0], dongle, fork)
+	defer session.stop()
+	m := newLinuxBluetoothctlBluetoothManager(session)
+	m.adapter = dongle
+	ctx := context.Background()
+
+	// The session has already selected the adapter, so scripts that select it run in the session too.
+	if err := m.SetAdapterPowered(ctx, dongle, true); err != nil {
+		t.Fatal(err)
+	}
+	output, err := session.Run(ctx, nil, "bluetoothctl", "show", "5C:F3:70:9B:2E:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "Powered: yes") {
+		t.Errorf("got %q, wanted the dongle to be powered", output)
+	}
+	if got := forks.Load(); got != 0 {
+		t.Errorf("got %d forks, wanted none", got)
+	}
+
+	// Scripts for other adapters can't use the session.
+	if _, err := session.Run(ctx, []byte("select 00:1A:7D:DA:71:13\npower off\n"), "bluetoothctl"); err != nil {
+		t.Fatal(err)
+	}
+	if got := forks.Load(); got != 1 {
+		t.Errorf("got %d forks, wanted 1", got)
+	}
+
+	missing := newBluetoothctlSession(os.Args[0], MustParseMacAddress("AA:BB:CC:DD:EE:FF"), fork)
+	defer missing.stop()
+	if _, err := missing.Run(ctx, nil, "bluetoothctl", "devices"); !errors.Is(err, ErrAdapterNotFound) {
+		t.Errorf("got %v, wanted ErrAdapterNotFound", err)
+	}
+}
+
+func TestBluetoothctlSessionConcurrent(t *testing.T) {
+	fork, _ := forkFakeBluetoothctl(t)
+	session := newBluetoothctlSession(os.Args[0], MacAddress{}, fork)
+	defer session.stop()
+	m := newLinuxBluetoothctlBluetoothManager(session)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mac := MustParseMacAddress(fmt.Sprintf("F8:4E:17:66:E8:%02X", i))
+			for j := 0; j < 5; j++ {
+				device, err := m.Get(ctx, mac)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if device.MacAddr != mac || device.Name != fmt.Sprintf("Headset %d", i) {
+					t.Errorf("got %v (%s), wanted %v (Headset %d)", device.MacAddr, device.Name, mac, i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// benchmarkBluetoothctlProcess runs op against a manager that talks to the fake bluetoothctl binary, either starting
+// a new process for every command or sending them all to one session.
+func benchmarkBluetoothctlProcess(
+	b *testing.B, useSession bool, op func(context.Context, linuxBluetoothctlBluetoothManager) error,
+) {
+	var run CommandRunner
+	run, _ = forkFakeBluetoothctl(b)
+	if useSession {
+		session := newBluetoothctlSession(os.Args[0], MacAddress{}, run)
+		defer session.stop()
+		run = session
+	}
+	m := newLinuxBluetoothctlBluetoothManager(run)
+	ctx := context.Background()
+	// Start the session and look up the version before timing anything.
+	if err := op(ctx, m); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := op(ctx, m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func bluetoothctlGetOp(ctx context.Context, m linuxBluetoothctlBluetoothManager) error {
+	_, err := m.Get(ctx, MustParseMacAddress("F8:4E:17:66:E8:01"))
+	return err
+}
+
+func bluetoothctlListOp(ctx context.Context, m linuxBluetoothctlBluetoothManager) error {
+	_, err := m.List(ctx)
+	return err
+}
+
+func BenchmarkBluetoothctlGetForkPerCall(b *testing.B) {
+	benchmarkBluetoothctlProcess(b, false, bluetoothctlGetOp)
+}
+
+func BenchmarkBluetoothctlGetSession(b *testing.B) {
+	benchmarkBluetoothctlProcess(b, true, bluetoothctlGetOp)
+}
+
+func BenchmarkBluetoothctlListForkPerCall(b *testing.B) {
+	benchmarkBluetoothctlProcess(b, false, bluetoothctlListOp)
+}
+
+func BenchmarkBluetoothctlListSession(b *testing.B) {
+	benchmarkBluetoothctlProcess(b, true, bluetoothctlListOp)
+}
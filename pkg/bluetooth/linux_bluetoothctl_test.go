@@ -0,0 +1,573 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeBluetoothctlDevice struct {
+	mac string
+	// name is the alias, which `devices` prints. `info` prints it too, and deviceName as the Name if it's set.
+	name       string
+	deviceName string
+	connected  bool
+	paired     bool
+	trusted    bool
+	// battery is reported by `info` while the device is connected, if it isn't 0.
+	battery int
+}
+
+type fakeBluetoothctlController struct {
+	mac     string
+	name    string
+	powered bool
+}
+
+// fakeBluetoothctl imitates the output of the bluetoothctl commands used by linuxBluetoothctlBluetoothManager.
+type fakeBluetoothctl struct {
+	version string
+	devices []fakeBluetoothctlDevice
+	// controllers are listed by `list`. The first one is the default.
+	controllers []fakeBluetoothctlController
+	// scripts records everything piped to bluetoothctl on stdin.
+	scripts []string
+	// scanOutput is printed by `scan on`.
+	scanOutput string
+	// sessionOutput is printed by an interactive session started with stream, which then exits.
+	sessionOutput string
+	// busyConnects is how many more `connect` calls fail with br-connection-busy before one works.
+	busyConnects int
+	// latency is added to every call to simulate the cost of starting bluetoothctl.
+	latency time.Duration
+	calls   atomic.Int64
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (f *fakeBluetoothctl) Run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+	f.calls.Add(1)
+	if f.latency > 0 {
+		select {
+		case <-time.After(f.latency):
+		case <-ctx.Done():
+			return nil, &CommandError{Command: cmd, Args: args, ExitCode: -1, Err: ctx.Err()}
+		}
+	}
+	if stdin == nil {
+		return f.exec(cmd, 0, args...)
+	}
+
+	// Like the real thing, run each line in turn, carrying on after a failed `select`.
+	f.scripts = append(f.scripts, string(stdin))
+	var out []byte
+	selected := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(stdin)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "select" {
+			if i := f.controller(fields[1]); i != -1 {
+				selected = i
+			} else {
+				out = fmt.Appendf(out, "Controller %s not available\n", fields[1])
+			}
+			continue
+		}
+		output, err := f.exec(cmd, selected, fields...)
+		out = append(out, output...)
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeBluetoothctl) stream(ctx context.Context, stdin []byte, cmd string, args ...string) (io.ReadCloser, error) {
+	if stdin != nil {
+		f.scripts = append(f.scripts, string(stdin))
+	}
+	return io.NopCloser(strings.NewReader(f.sessionOutput)), nil
+}
+
+func (f *fakeBluetoothctl) controller(mac string) int {
+	for i, c := range f.controllers {
+		if strings.EqualFold(c.mac, mac) {
+			return i
+		}
+	}
+	return -1
+}
+
+// exec runs a single bluetoothctl command with the given controller selected.
+func (f *fakeBluetoothctl) exec(cmd string, selected int, args ...string) ([]byte, error) {
+	var out strings.Builder
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		for i, c := range f.controllers {
+			fmt.Fprintf(&out, "Controller %s %s", c.mac, c.name)
+			if i == 0 {
+				out.WriteString(" [default]")
+			}
+			out.WriteString("\n")
+		}
+	case len(args) == 2 && args[0] == "show":
+		i := f.controller(args[1])
+		if i == -1 {
+			fmt.Fprintf(&out, "Controller %s not available\n", args[1])
+			return []byte(out.String()), &CommandError{Command: cmd, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		}
+		c := f.controllers[i]
+		fmt.Fprintf(&out, "Controller %s (public)\n\tName: %s\n\tAlias: %s\n\tPowered: %s\n\tDiscoverable: no\n"+
+			"\tPairable: yes\n\tDiscovering: no\n", c.mac, c.name, c.name, yesNo(c.powered))
+	case len(args) == 2 && args[0] == "power":
+		f.controllers[selected].powered = args[1] == "on"
+		fmt.Fprintf(&out, "Changing power %s succeeded\n", args[1])
+	case len(args) == 2 && args[0] == "connect":
+		fmt.Fprintf(&out, "Attempting to connect to %s\n", args[1])
+		if f.busyConnects > 0 {
+			f.busyConnects--
+			out.WriteString("Failed to connect: org.bluez.Error.Failed br-connection-busy\n")
+			return []byte(out.String()), &CommandError{Command: cmd, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		}
+		for i := range f.devices {
+			if f.devices[i].mac == args[1] {
+				f.devices[i].connected = true
+			}
+		}
+		out.WriteString("Connection successful\n")
+	case len(args) == 2 && (args[0] == "block" || args[0] == "unblock"):
+		fmt.Fprintf(&out, "Changing %s %s succeeded\n", args[1], args[0])
+	case len(args) == 1 && args[0] == "--version":
+		fmt.Fprintf(&out, "bluetoothctl: %s\n", f.version)
+	case len(args) >= 1 && args[0] == "devices":
+		// Like the real thing, old versions ignore the filter argument.
+		filter := ""
+		if len(args) > 1 && !parseVersionForTest(f.version).less(bluetoothctlDeviceFilterVersion) {
+			filter = args[1]
+		}
+		for _, d := range f.devices {
+			if (filter == "Connected" && !d.connected) || (filter == "Paired" && !d.paired) ||
+				(filter == "Trusted" && !d.trusted) {
+				continue
+			}
+			fmt.Fprintf(&out, "Device %s %s\n", d.mac, d.name)
+		}
+	case len(args) == 4 && args[0] == "--timeout" && args[2] == "scan" && args[3] == "on":
+		out.WriteString(f.scanOutput)
+	case len(args) == 2 && args[0] == "info":
+		for _, d := range f.devices {
+			if d.mac != args[1] {
+				continue
+			}
+			deviceName := d.name
+			if d.deviceName != "" {
+				deviceName = d.deviceName
+			}
+			fmt.Fprintf(&out, "Device %s (public)\n\tName: %s\n\tAlias: %s\n\tClass: 0x00240404\n\tIcon: audio-headset\n"+
+				"\tPaired: %s\n\tTrusted: %s\n\tBlocked: no\n\tConnected: %s\n",
+				d.mac, deviceName, d.name, yesNo(d.paired), yesNo(d.trusted), yesNo(d.connected))
+			if d.connected && d.battery != 0 {
+				fmt.Fprintf(&out, "\tBattery Percentage: 0x%02x (%d)\n", d.battery, d.battery)
+			}
+			return []byte(out.String()), nil
+		}
+		fmt.Fprintf(&out, "Device %s not available\n", args[1])
+		return []byte(out.String()), &CommandError{Command: cmd, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+	default:
+		return nil, &CommandError{Command: cmd, Args: args, ExitCode: 1, Err: fmt.Errorf("unexpected command")}
+	}
+	return []byte(out.String()), nil
+}
+
+func parseVersionForTest(s string) bluetoothctlVersion {
+	v, err := parseBluetoothctlVersion([]byte(s))
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func newFakeBluetoothctl(version string, n int) *fakeBluetoothctl {
+	f := &fakeBluetoothctl{
+		version: version,
+		controllers: []fakeBluetoothctlController{
+			{mac: "00:1A:7D:DA:71:13", name: "thinkpad", powered: true},
+			{mac: "5C:F3:70:9B:2E:01", name: "dongle", powered: false},
+		},
+	}
+	for i := 0; i < n; i++ {
+		f.devices = append(f.devices, fakeBluetoothctlDevice{
+			mac:       fmt.Sprintf("F8:4E:17:66:E8:%02X", i),
+			name:      fmt.Sprintf("Headset %d", i),
+			connected: i%3 == 0,
+			paired:    true,
+			trusted:   i%2 == 0,
+			battery:   90 - i,
+		})
+	}
+	return f
+}
+
+func TestParseBluetoothctlVersion(t *testing.T) {
+	for input, want := range map[string]bluetoothctlVersion{
+		"bluetoothctl: 5.66\n": {5, 66},
+		"5.50":                 {5, 50},
+	} {
+		got, err := parseBluetoothctlVersion([]byte(input))
+		if err != nil || got != want {
+			t.Errorf("%q: got (%v, %v), wanted %v", input, got, err, want)
+		}
+	}
+	if _, err := parseBluetoothctlVersion([]byte("bluetoothctl: unknown")); err == nil {
+		t.Error("expected an error for output without a version")
+	}
+}
+
+func TestBluetoothctlListWithDeviceFilter(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 6)
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+
+	devices, err := m.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 6 {
+		t.Fatalf("got %d devices, wanted 6", len(devices))
+	}
+	for i, device := range devices {
+		d := fake.devices[i]
+		want := BluetoothDevice{
+			Name:      d.name,
+			MacAddr:   MustParseMacAddress(d.mac),
+			Connected: d.connected,
+			Alias:     d.name,
+			Paired:    d.paired,
+			Trusted:   d.trusted,
+		}
+		// Only the connected devices get the details from `info`.
+		if d.connected {
+			want.Class = 0x240404
+			want.Icon = "audio-headset"
+			want.Battery = &d.battery
+		}
+		if !reflect.DeepEqual(device, want) {
+			t.Errorf("device %d: got %#v, wanted %#v", i, device, want)
+		}
+	}
+
+	// --version, devices, one `devices <filter>` per filter, and `info` for the two connected devices.
+	if calls := fake.calls.Load(); calls != 7 {
+		t.Errorf("got %d calls to bluetoothctl, wanted 7", calls)
+	}
+	// The version is cached, so the next List doesn't need --version.
+	if _, err := m.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fake.calls.Load(); calls != 13 {
+		t.Errorf("got %d calls to bluetoothctl after the second List, wanted 13", calls)
+	}
+}
+
+func TestBluetoothctlListWithDeviceFilterStable(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 2)
+	fake.devices[0].deviceName = "WH-1000XM4"
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+	ctx := context.Background()
+
+	before, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Headset 0 disconnecting shouldn't change anything but Connected and Battery, which BlueZ stops reporting.
+	fake.devices[0].connected = false
+	after, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := before[0]
+	want.Connected = false
+	want.Battery = nil
+	if !reflect.DeepEqual(after[0], want) {
+		t.Errorf("got %#v, wanted %#v", after[0], want)
+	}
+	// The name is the alias `devices` prints, whether or not the device is connected.
+	if before[0].Name != "Headset 0" {
+		t.Errorf("got name %q, wanted the alias", before[0].Name)
+	}
+	// Headset 1 has never been connected, so there's nothing to keep.
+	if after[1].Class != 0 || after[1].Icon != "" {
+		t.Errorf("got %#v, wanted no details", after[1])
+	}
+
+	// Blocking a device updates it without another `info`.
+	if err := m.Block(ctx, after[1].MacAddr); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !devices[1].Blocked {
+		t.Errorf("got %#v, wanted it blocked", devices[1])
+	}
+}
+
+func TestBluetoothctlListWithInfo(t *testing.T) {
+	fake := newFakeBluetoothctl("5.50", 6)
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+
+	devices, err := m.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 6 {
+		t.Fatalf("got %d devices, wanted 6", len(devices))
+	}
+	for i, device := range devices {
+		d := fake.devices[i]
+		if device.MacAddr != MustParseMacAddress(d.mac) || device.Connected != d.connected || device.Icon != "audio-headset" {
+			t.Errorf("device %d: got %#v, wanted %#v", i, device, d)
+		}
+	}
+}
+
+func TestBluetoothctlBatteryFromUPower(t *testing.T) {
+	for _, version := range []string{"5.50", "5.66"} {
+		t.Run(version, func(t *testing.T) {
+			fake := newFakeBluetoothctl(version, 4)
+			// Headset 0 reports its battery to bluetoothctl; Headset 3 only to UPower.
+			fake.devices[3].battery = 0
+			m := newLinuxBluetoothctlBluetoothManager(fake)
+			m.batteries = func(ctx context.Context) (map[MacAddress]int, error) {
+				return map[MacAddress]int{
+					MustParseMacAddress(fake.devices[0].mac): 10,
+					MustParseMacAddress(fake.devices[3].mac): 42,
+					// Not connected, so it's ignored.
+					MustParseMacAddress(fake.devices[1].mac): 50,
+				}, nil
+			}
+
+			devices, err := m.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []any
+			for _, device := range devices {
+				if device.Battery == nil {
+					got = append(got, nil)
+				} else {
+					got = append(got, *device.Battery)
+				}
+			}
+			if want := []any{90, nil, nil, 42}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got batteries %v, wanted %v", got, want)
+			}
+
+			device, err := m.Get(context.Background(), MustParseMacAddress(fake.devices[3].mac))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.Battery == nil || *device.Battery != 42 {
+				t.Errorf("got battery %v from Get, wanted 42", device.Battery)
+			}
+		})
+	}
+}
+
+func TestBluetoothctlScan(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 1)
+	// The first device is already known, so it only shows up as an RSSI change and its name comes from `devices`.
+	fake.scanOutput = "Discovery started\n" +
+		"[CHG] Controller 00:1A:7D:DA:71:13 Discovering: yes\n" +
+		"[CHG] Device F8:4E:17:66:E8:00 RSSI: -58\n" +
+		"[CHG] Device F8:4E:17:66:E8:00 Battery Percentage: 0x55 (85)\n" +
+		"[NEW] Device 4C:87:5D:2A:11:9F Galaxy Buds2\n" +
+		"[CHG] Device 4C:87:5D:2A:11:9F Class: 0x00240404\n" +
+		"[NEW] Device 6A:0B:41:C2:9E:10 6A-0B-41-C2-9E-10\n"
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+
+	devices, err := m.Scan(context.Background(), 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rssi := -58
+	want := []DiscoveredDevice{
+		{Name: "Headset 0", MacAddr: MustParseMacAddress("F8:4E:17:66:E8:00"), RSSI: &rssi},
+		{Name: "Galaxy Buds2", MacAddr: MustParseMacAddress("4C:87:5D:2A:11:9F"), Class: 0x240404},
+		{MacAddr: MustParseMacAddress("6A:0B:41:C2:9E:10")},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %#v, wanted %#v", devices, want)
+	}
+}
+
+func TestBluetoothctlAdapters(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 0)
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+
+	adapters, err := m.Adapters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Adapter{
+		{Name: "thinkpad", MacAddr: MustParseMacAddress("00:1A:7D:DA:71:13"), Powered: true, Pairable: true, Selected: true},
+		{Name: "dongle", MacAddr: MustParseMacAddress("5C:F3:70:9B:2E:01"), Pairable: true},
+	}
+	if !reflect.DeepEqual(adapters, want) {
+		t.Errorf("got %#v, wanted %#v", adapters, want)
+	}
+
+	// Pinning to the dongle selects it instead of the default.
+	m.adapter = MustParseMacAddress("5C:F3:70:9B:2E:01")
+	adapters, err = m.Adapters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adapters[0].Selected || !adapters[1].Selected {
+		t.Errorf("got %#v, wanted only the dongle to be selected", adapters)
+	}
+}
+
+func TestBluetoothctlPinnedAdapter(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 1)
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+	m.adapter = MustParseMacAddress("5C:F3:70:9B:2E:01")
+	ctx := context.Background()
+
+	if err := m.Connect(ctx, MustParseMacAddress(fake.devices[0].mac)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAdapterPowered(ctx, m.adapter, true); err != nil {
+		t.Fatal(err)
+	}
+	wantScripts := []string{
+		"select 5C:F3:70:9B:2E:01\nconnect F8:4E:17:66:E8:00\n",
+		// Connect checks the device came up.
+		"select 5C:F3:70:9B:2E:01\ninfo F8:4E:17:66:E8:00\n",
+		"select 5C:F3:70:9B:2E:01\npower on\n",
+	}
+	if !reflect.DeepEqual(fake.scripts, wantScripts) {
+		t.Errorf("got scripts %q, wanted %q", fake.scripts, wantScripts)
+	}
+	if !fake.controllers[1].powered || !fake.controllers[0].powered {
+		t.Errorf("got controllers %+v, wanted both powered", fake.controllers)
+	}
+	// The adapter is only looked up with `list` once, not before every command.
+	if calls := fake.calls.Load(); calls != int64(len(wantScripts))+1 {
+		t.Errorf("got %d calls to bluetoothctl, wanted %d", calls, len(wantScripts)+1)
+	}
+
+	// A missing adapter is caught before anything is run, so the command can't fall through to the default adapter.
+	fake.scripts = nil
+	m.adapter = MustParseMacAddress("11:22:33:44:55:66")
+	if err := m.Connect(ctx, MustParseMacAddress(fake.devices[0].mac)); !errors.Is(err, ErrAdapterNotFound) {
+		t.Errorf("got %v, wanted ErrAdapterNotFound", err)
+	}
+	if len(fake.scripts) != 0 {
+		t.Errorf("got scripts %q, wanted none", fake.scripts)
+	}
+}
+
+func TestBluetoothctlWatch(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 1)
+	fake.sessionOutput = "Agent registered\n" +
+		"[NEW] Controller 00:1A:7D:DA:71:13 thinkpad [default]\n" +
+		// Already known, so not reported as added.
+		"[NEW] Device F8:4E:17:66:E8:00 Headset 0\n" +
+		"\x1b[0;94m[bluetooth]\x1b[0m# \r\x1b[K[CHG] Device F8:4E:17:66:E8:00 Connected: yes\n" +
+		"[CHG] Device F8:4E:17:66:E8:00 RSSI: -58\n" +
+		"[CHG] Device F8:4E:17:66:E8:00 Battery Percentage: 0x55 (85)\n" +
+		"[NEW] Device 4C:87:5D:2A:11:9F Galaxy Buds2\n" +
+		"[CHG] Device 4C:87:5D:2A:11:9F Paired: yes\n" +
+		"[CHG] Device 4C:87:5D:2A:11:9F Class: 0x00240404\n" +
+		"[CHG] Device F8:4E:17:66:E8:00 Connected: no\n" +
+		"[DEL] Device 4C:87:5D:2A:11:9F Galaxy Buds2\n"
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+	m.stream = fake.stream
+
+	events, err := m.Watch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []DeviceEvent
+	for event := range events {
+		got = append(got, event)
+	}
+
+	headset := MustParseMacAddress("F8:4E:17:66:E8:00")
+	buds := MustParseMacAddress("4C:87:5D:2A:11:9F")
+	want := []DeviceEvent{
+		{Type: DeviceConnected, MacAddr: headset, Name: "Headset 0"},
+		{Type: DevicePropertyChanged, MacAddr: headset, Name: "Headset 0", Property: "Battery", Value: 85},
+		{Type: DeviceAdded, MacAddr: buds, Name: "Galaxy Buds2"},
+		{Type: DevicePropertyChanged, MacAddr: buds, Name: "Galaxy Buds2", Property: "Paired", Value: true},
+		{Type: DevicePropertyChanged, MacAddr: buds, Name: "Galaxy Buds2", Property: "Class", Value: uint32(0x240404)},
+		{Type: DeviceDisconnected, MacAddr: headset, Name: "Headset 0"},
+		{Type: DeviceRemoved, MacAddr: buds, Name: "Galaxy Buds2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v\nwanted %#v", got, want)
+	}
+}
+
+func benchmarkList(b *testing.B, version string, concurrency int) {
+	fake := newFakeBluetoothctl(version, 20)
+	// Starting bluetoothctl and waiting for it to connect to bluetoothd typically takes tens of milliseconds.
+	fake.latency = 20 * time.Millisecond
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+	m.infoConcurrency = concurrency
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.List(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBluetoothctlListSequentialInfo measures the old behaviour of List, which ran `info` for each device in turn.
+func BenchmarkBluetoothctlListSequentialInfo(b *testing.B) {
+	benchmarkList(b, "5.50", 1)
+}
+
+func BenchmarkBluetoothctlListParallelInfo(b *testing.B) {
+	benchmarkList(b, "5.50", defaultInfoConcurrency)
+}
+
+func BenchmarkBluetoothctlListDeviceFilter(b *testing.B) {
+	benchmarkList(b, "5.66", defaultInfoConcurrency)
+}
+
+func TestBluetoothctlConnectRetriesBusy(t *testing.T) {
+	fake := newFakeBluetoothctl("5.66", 2)
+	m := newLinuxBluetoothctlBluetoothManager(fake)
+	m.connectPolicy = ConnectPolicy{Attempts: 2, Backoff: time.Millisecond}
+	ctx := context.Background()
+	mac := MustParseMacAddress(fake.devices[1].mac)
+
+	fake.busyConnects = 1
+	if err := m.Connect(ctx, mac); err != nil {
+		t.Fatalf("got %v, wanted the retry to succeed", err)
+	}
+	if !fake.devices[1].connected {
+		t.Errorf("device isn't connected")
+	}
+
+	fake.devices[1].connected = false
+	fake.busyConnects = 2
+	err := m.Connect(ctx, mac)
+	if !errors.Is(err, ErrDeviceBusy) || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("got %v, wanted ErrDeviceBusy after 2 attempts", err)
+	}
+}
@@ -0,0 +1,747 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	bluezBusName        = "org.bluez"
+	bluezAdapterIface   = "org.bluez.Adapter1"
+	bluezDeviceIface    = "org.bluez.Device1"
+	bluezBatteryIface   = "org.bluez.Battery1"
+	dbusObjectManager   = "org.freedesktop.DBus.ObjectManager"
+	dbusPropertiesIface = "org.freedesktop.DBus.Properties"
+)
+
+// bluezObjects is the shape of the data returned by org.freedesktop.DBus.ObjectManager.GetManagedObjects: object path
+// => interface name => property name => value.
+type bluezObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// linuxBluezBluetoothManager talks to BlueZ directly over the system D-Bus rather than shelling out to bluetoothctl.
+type linuxBluezBluetoothManager struct {
+	conn *dbus.Conn
+	// adapter is the address of the adapter we're pinned to, or zero to use all of them (and the first one for
+	// operations like Scan that need a single adapter).
+	adapter MacAddress
+	// connectPolicy controls how Connect verifies and retries connections.
+	connectPolicy ConnectPolicy
+}
+
+func init() {
+	RegisterBackend(Backend{
+		Name: "bluez",
+		// Prefer talking to BlueZ directly over scraping bluetoothctl when both are available.
+		Priority: 20,
+		Probe:    probeBluez,
+		New: func(opts Options) (BluetoothManager, error) {
+			m, err := newLinuxBluezBluetoothManager(opts.Adapter)
+			if err != nil {
+				return nil, err
+			}
+			m.connectPolicy = opts.Connect
+			return m, nil
+		},
+	})
+}
+
+// probeBluez checks that the system bus is reachable and that bluetoothd has claimed the org.bluez name on it.
+func probeBluez() error {
+	if err := requireOS("linux"); err != nil {
+		return err
+	}
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to the system bus: %w", err)
+	}
+	defer conn.Close()
+
+	var hasOwner bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, bluezBusName).Store(&hasOwner)
+	if err != nil {
+		return fmt.Errorf("couldn't check for %s on the system bus: %w", bluezBusName, err)
+	}
+	if !hasOwner {
+		return fmt.Errorf("%s isn't running on the system bus (is bluetoothd running?)", bluezBusName)
+	}
+	return nil
+}
+
+// newLinuxBluezBluetoothManager opens a private connection to the system bus. The manager owns it for the rest of the
+// process's life: managers are created once at startup, and copies of them share the connection, so there's no point
+// at which it would be safe to close it.
+func newLinuxBluezBluetoothManager(adapter MacAddress) (linuxBluezBluetoothManager, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return linuxBluezBluetoothManager{}, fmt.Errorf("couldn't connect to the system bus: %w", err)
+	}
+
+	return linuxBluezBluetoothManager{conn: conn, adapter: adapter}, nil
+}
+
+// Connect calls Device1.Connect, which doesn't return until BlueZ has connected at least one profile, but it still
+// waits for the Connected property to be set, and retries according to the connect policy if BlueZ is busy.
+func (m linuxBluezBluetoothManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	path, err := m.findPoweredDevice(ctx, macAddr)
+	if err != nil {
+		return err
+	}
+	return connectVerified(ctx, m.connectPolicy, macAddr, func(ctx context.Context) error {
+		return bluezError(m.conn.Object(bluezBusName, path).CallWithContext(ctx, bluezDeviceIface+".Connect", 0).Err)
+	}, func(ctx context.Context) (bool, error) {
+		return m.IsConnected(ctx, macAddr)
+	})
+}
+
+func (m linuxBluezBluetoothManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	path, _, err := m.findDevice(ctx, macAddr)
+	if err != nil {
+		return err
+	}
+	return bluezError(m.conn.Object(bluezBusName, path).CallWithContext(ctx, bluezDeviceIface+".Disconnect", 0).Err)
+}
+
+func (m linuxBluezBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	adapter, err := m.pinnedAdapter(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map iteration order is random, so sort by object path to keep the output stable between calls.
+	paths := make([]dbus.ObjectPath, 0, len(objects))
+	for path, ifaces := range objects {
+		if props, ok := ifaces[bluezDeviceIface]; ok && onAdapter(props, adapter) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+
+	devices := []BluetoothDevice{}
+	for _, path := range paths {
+		device, err := bluezDevice(objects[path])
+		if err != nil {
+			log.Printf("skipping BlueZ device %s: %v", path, err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	m.addUPowerBatteries(ctx, devices)
+	return devices, nil
+}
+
+func (m linuxBluezBluetoothManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+	path, _, err := m.findDeviceIn(objects, macAddr)
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+	device, err := bluezDevice(objects[path])
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+	devices := []BluetoothDevice{device}
+	m.addUPowerBatteries(ctx, devices)
+	return devices[0], nil
+}
+
+// IsConnected only looks at Device1, so that polling it (see Connect) doesn't keep asking UPower for batteries.
+func (m linuxBluezBluetoothManager) IsConnected(ctx context.Context, macAddr MacAddress) (bool, error) {
+	_, props, err := m.findDevice(ctx, macAddr)
+	if err != nil {
+		return false, err
+	}
+	return variantBool(props, "Connected"), nil
+}
+
+// addUPowerBatteries fills in the battery level of connected devices that BlueZ doesn't have one for, if UPower knows
+// it.
+func (m linuxBluezBluetoothManager) addUPowerBatteries(ctx context.Context, devices []BluetoothDevice) {
+	addBatteries(ctx, devices, func(ctx context.Context) (map[MacAddress]int, error) {
+		return upowerBatteries(ctx, m.conn)
+	})
+}
+
+func (m linuxBluezBluetoothManager) Pair(ctx context.Context, macAddr MacAddress) error {
+	path, err := m.findPoweredDevice(ctx, macAddr)
+	if err != nil {
+		return err
+	}
+	err = m.conn.Object(bluezBusName, path).CallWithContext(ctx, bluezDeviceIface+".Pair", 0).Err
+	// Pairing with a device we're already paired with isn't an error as far as our callers are concerned.
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.bluez.Error.AlreadyExists" {
+		return nil
+	}
+	return bluezError(err)
+}
+
+func (m linuxBluezBluetoothManager) Trust(ctx context.Context, macAddr MacAddress) error {
+	return m.setDeviceProperty(ctx, macAddr, "Trusted", true)
+}
+
+func (m linuxBluezBluetoothManager) Untrust(ctx context.Context, macAddr MacAddress) error {
+	return m.setDeviceProperty(ctx, macAddr, "Trusted", false)
+}
+
+func (m linuxBluezBluetoothManager) Block(ctx context.Context, macAddr MacAddress) error {
+	return m.setDeviceProperty(ctx, macAddr, "Blocked", true)
+}
+
+func (m linuxBluezBluetoothManager) Unblock(ctx context.Context, macAddr MacAddress) error {
+	return m.setDeviceProperty(ctx, macAddr, "Blocked", false)
+}
+
+// Remove asks the device's adapter to forget it.
+func (m linuxBluezBluetoothManager) Remove(ctx context.Context, macAddr MacAddress) error {
+	path, props, err := m.findDevice(ctx, macAddr)
+	if err != nil {
+		return err
+	}
+	adapter, ok := props["Adapter"].Value().(dbus.ObjectPath)
+	if !ok {
+		return fmt.Errorf("device %s has no adapter", macAddr)
+	}
+	return bluezError(m.conn.Object(bluezBusName, adapter).CallWithContext(ctx, bluezAdapterIface+".RemoveDevice", 0, path).Err)
+}
+
+// Scan runs discovery on the selected adapter for the given duration and returns the devices BlueZ saw during it. BlueZ
+// only sets a device's RSSI while discovery is running and it has heard from the device, so that's how we tell them
+// apart from devices it already knew about. The results are read before discovery is stopped, since BlueZ clears the
+// RSSI (and eventually forgets unpaired devices) afterwards.
+func (m linuxBluezBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	adapter, adapterProps, err := m.selectAdapter(objects)
+	if err != nil {
+		return nil, err
+	}
+	if !variantBool(adapterProps, "Powered") {
+		return nil, fmt.Errorf("%w: %s", ErrAdapterPoweredOff, adapter)
+	}
+	obj := m.conn.Object(bluezBusName, adapter)
+	if err := obj.CallWithContext(ctx, bluezAdapterIface+".StartDiscovery", 0).Err; err != nil {
+		return nil, bluezError(err)
+	}
+	defer func() {
+		// Discovery has to be stopped even if ctx is what ended the scan, so don't use it here.
+		if err := obj.Call(bluezAdapterIface+".StopDiscovery", 0).Err; err != nil {
+			log.Printf("failed to stop discovery on %s: %v", adapter, err)
+		}
+	}()
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+		return nil, bluezError(ctx.Err())
+	}
+
+	objects, err = m.managedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]dbus.ObjectPath, 0, len(objects))
+	for path := range objects {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+
+	devices := []DiscoveredDevice{}
+	for _, path := range paths {
+		props, ok := objects[path][bluezDeviceIface]
+		if !ok {
+			continue
+		}
+		rssiVariant, ok := props["RSSI"]
+		if !ok {
+			continue
+		}
+		if owner, _ := props["Adapter"].Value().(dbus.ObjectPath); owner != adapter {
+			continue
+		}
+		device, err := bluezDeviceFromProps(props)
+		if err != nil {
+			log.Printf("skipping BlueZ device %s: %v", path, err)
+			continue
+		}
+		rssi16, _ := rssiVariant.Value().(int16)
+		rssi := int(rssi16)
+		devices = append(devices, DiscoveredDevice{
+			Name:    variantString(props, "Name"),
+			MacAddr: device.MacAddr,
+			RSSI:    &rssi,
+			Class:   device.Class,
+		})
+	}
+	return devices, nil
+}
+
+// Watch subscribes to BlueZ's InterfacesAdded, InterfacesRemoved and PropertiesChanged signals and turns them into
+// DeviceEvents. If we're pinned to an adapter, devices on other adapters are ignored.
+func (m linuxBluezBluetoothManager) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	fromBluez := dbus.WithMatchSender(bluezBusName)
+	matches := [][]dbus.MatchOption{
+		{fromBluez, dbus.WithMatchInterface(dbusObjectManager), dbus.WithMatchMember("InterfacesAdded")},
+		{fromBluez, dbus.WithMatchInterface(dbusObjectManager), dbus.WithMatchMember("InterfacesRemoved")},
+		{fromBluez, dbus.WithMatchInterface(dbusPropertiesIface), dbus.WithMatchMember("PropertiesChanged"),
+			dbus.WithMatchArg(0, bluezDeviceIface)},
+		{fromBluez, dbus.WithMatchInterface(dbusPropertiesIface), dbus.WithMatchMember("PropertiesChanged"),
+			dbus.WithMatchArg(0, bluezBatteryIface)},
+	}
+	signals := make(chan *dbus.Signal, 64)
+	stop := func() {
+		m.conn.RemoveSignal(signals)
+		for _, match := range matches {
+			_ = m.conn.RemoveMatchSignal(match...)
+		}
+	}
+	for _, match := range matches {
+		if err := m.conn.AddMatchSignalContext(ctx, match...); err != nil {
+			stop()
+			return nil, bluezError(err)
+		}
+	}
+	m.conn.Signal(signals)
+
+	// Subscribe before taking the snapshot so nothing can happen in between without us hearing about it.
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	adapter, err := m.pinnedAdapter(objects)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	devices := map[dbus.ObjectPath]map[string]dbus.Variant{}
+	for path, ifaces := range objects {
+		if props, ok := ifaces[bluezDeviceIface]; ok && onAdapter(props, adapter) {
+			devices[path] = props
+		}
+	}
+
+	events := make(chan DeviceEvent)
+	go func() {
+		defer close(events)
+		defer stop()
+		for {
+			var sig *dbus.Signal
+			select {
+			case <-ctx.Done():
+				return
+			case s, ok := <-signals:
+				// The channel is closed if the connection to the bus is lost.
+				if !ok {
+					return
+				}
+				sig = s
+			}
+			for _, event := range bluezSignalEvents(sig, devices, adapter) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// bluezSignalEvents updates devices (object path => Device1 properties) with the contents of a signal and returns the
+// resulting events.
+func bluezSignalEvents(sig *dbus.Signal, devices map[dbus.ObjectPath]map[string]dbus.Variant, adapter dbus.ObjectPath) []DeviceEvent {
+	switch sig.Name {
+	case dbusObjectManager + ".InterfacesAdded":
+		var path dbus.ObjectPath
+		var ifaces map[string]map[string]dbus.Variant
+		if err := dbus.Store(sig.Body, &path, &ifaces); err != nil {
+			return nil
+		}
+		props, ok := ifaces[bluezDeviceIface]
+		if battery, hasBattery := ifaces[bluezBatteryIface]; !ok && hasBattery {
+			// BlueZ usually adds Battery1 to a device once it's connected.
+			return bluezBatteryEvents(path, devices, battery["Percentage"])
+		}
+		if !ok || !onAdapter(props, adapter) {
+			return nil
+		}
+		device, err := bluezDeviceFromProps(props)
+		if err != nil {
+			log.Printf("ignoring new BlueZ device %s: %v", path, err)
+			return nil
+		}
+		devices[path] = props
+		return []DeviceEvent{{Type: DeviceAdded, MacAddr: device.MacAddr, Name: device.Name}}
+
+	case dbusObjectManager + ".InterfacesRemoved":
+		var path dbus.ObjectPath
+		var ifaces []string
+		if err := dbus.Store(sig.Body, &path, &ifaces); err != nil {
+			return nil
+		}
+		props, ok := devices[path]
+		if ok && !slices.Contains(ifaces, bluezDeviceIface) && slices.Contains(ifaces, bluezBatteryIface) {
+			return bluezBatteryEvents(path, devices, dbus.Variant{})
+		}
+		if !ok || !slices.Contains(ifaces, bluezDeviceIface) {
+			return nil
+		}
+		delete(devices, path)
+		device, err := bluezDeviceFromProps(props)
+		if err != nil {
+			return nil
+		}
+		return []DeviceEvent{{Type: DeviceRemoved, MacAddr: device.MacAddr, Name: device.Name}}
+
+	case dbusPropertiesIface + ".PropertiesChanged":
+		var iface string
+		var changed map[string]dbus.Variant
+		var invalidated []string
+		if err := dbus.Store(sig.Body, &iface, &changed, &invalidated); err != nil {
+			return nil
+		}
+		if percentage, ok := changed["Percentage"]; ok && iface == bluezBatteryIface {
+			return bluezBatteryEvents(sig.Path, devices, percentage)
+		}
+		if iface != bluezDeviceIface {
+			return nil
+		}
+		props, ok := devices[sig.Path]
+		if !ok {
+			return nil
+		}
+		updated := maps.Clone(props)
+		maps.Copy(updated, changed)
+		for _, name := range invalidated {
+			delete(updated, name)
+		}
+		devices[sig.Path] = updated
+
+		before, err := bluezDeviceFromProps(props)
+		if err != nil {
+			return nil
+		}
+		after, err := bluezDeviceFromProps(updated)
+		if err != nil {
+			return nil
+		}
+		return diffDevice(before, after)
+	}
+	return nil
+}
+
+// bluezBatteryEvents returns the event for a change to the Battery1 Percentage of the device at path, which is a
+// zero Variant if the device no longer has a battery level.
+func bluezBatteryEvents(path dbus.ObjectPath, devices map[dbus.ObjectPath]map[string]dbus.Variant, percentage dbus.Variant) []DeviceEvent {
+	props, ok := devices[path]
+	if !ok {
+		return nil
+	}
+	device, err := bluezDeviceFromProps(props)
+	if err != nil {
+		return nil
+	}
+	event := DeviceEvent{Type: DevicePropertyChanged, MacAddr: device.MacAddr, Name: device.Name, Property: "Battery"}
+	if battery, ok := percentage.Value().(byte); ok {
+		event.Value = int(battery)
+	}
+	return []DeviceEvent{event}
+}
+
+// Adapters lists every adapter BlueZ knows about, sorted by object path.
+func (m linuxBluezBluetoothManager) Adapters(ctx context.Context) ([]Adapter, error) {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Only an error if there are no adapters at all, in which case there's nothing to mark as selected anyway.
+	selected, _, _ := m.selectAdapter(objects)
+
+	paths := make([]dbus.ObjectPath, 0, len(objects))
+	for path, ifaces := range objects {
+		if _, ok := ifaces[bluezAdapterIface]; ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+
+	adapters := []Adapter{}
+	for _, path := range paths {
+		props := objects[path][bluezAdapterIface]
+		macAddr, err := ParseMacAddress(variantString(props, "Address"))
+		if err != nil {
+			log.Printf("skipping BlueZ adapter %s: %v", path, err)
+			continue
+		}
+		// As with devices, the name is the Alias, which is what bluetoothctl shows, and defaults to Name.
+		name := variantString(props, "Alias")
+		if name == "" {
+			name = variantString(props, "Name")
+		}
+		adapters = append(adapters, Adapter{
+			Name:         name,
+			MacAddr:      macAddr,
+			Powered:      variantBool(props, "Powered"),
+			Discoverable: variantBool(props, "Discoverable"),
+			Pairable:     variantBool(props, "Pairable"),
+			Selected:     path == selected,
+		})
+	}
+	return adapters, nil
+}
+
+func (m linuxBluezBluetoothManager) SetAdapterPowered(ctx context.Context, adapter MacAddress, powered bool) error {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return err
+	}
+	path, _, err := findAdapter(objects, adapter)
+	if err != nil {
+		return err
+	}
+	return bluezError(m.conn.Object(bluezBusName, path).
+		CallWithContext(ctx, dbusPropertiesIface+".Set", 0, bluezAdapterIface, "Powered", dbus.MakeVariant(powered)).Err)
+}
+
+// selectAdapter returns the object path and Adapter1 properties of the adapter we're pinned to or, if we aren't pinned
+// to one, of the first adapter, which is the one bluetoothctl uses by default.
+func (m linuxBluezBluetoothManager) selectAdapter(objects bluezObjects) (dbus.ObjectPath, map[string]dbus.Variant, error) {
+	if !m.adapter.IsZero() {
+		return findAdapter(objects, m.adapter)
+	}
+	var paths []dbus.ObjectPath
+	for path, ifaces := range objects {
+		if _, ok := ifaces[bluezAdapterIface]; ok {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return "", nil, ErrAdapterNotFound
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+	return paths[0], objects[paths[0]][bluezAdapterIface], nil
+}
+
+// pinnedAdapter returns the object path of the adapter we're pinned to, or "" if we aren't pinned to one.
+func (m linuxBluezBluetoothManager) pinnedAdapter(objects bluezObjects) (dbus.ObjectPath, error) {
+	if m.adapter.IsZero() {
+		return "", nil
+	}
+	path, _, err := findAdapter(objects, m.adapter)
+	return path, err
+}
+
+// findAdapter looks up the object path and Adapter1 properties of the adapter with the given address.
+func findAdapter(objects bluezObjects, macAddr MacAddress) (dbus.ObjectPath, map[string]dbus.Variant, error) {
+	for path, ifaces := range objects {
+		props, ok := ifaces[bluezAdapterIface]
+		if !ok {
+			continue
+		}
+		if addr, err := ParseMacAddress(variantString(props, "Address")); err == nil && addr == macAddr {
+			return path, props, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%w: %s", ErrAdapterNotFound, macAddr)
+}
+
+// onAdapter returns true if the device with the given Device1 properties belongs to the adapter at path. Every device
+// matches if path is "".
+func onAdapter(props map[string]dbus.Variant, path dbus.ObjectPath) bool {
+	if path == "" {
+		return true
+	}
+	adapter, _ := props["Adapter"].Value().(dbus.ObjectPath)
+	return adapter == path
+}
+
+func (m linuxBluezBluetoothManager) setDeviceProperty(ctx context.Context, macAddr MacAddress, name string, value any) error {
+	path, _, err := m.findDevice(ctx, macAddr)
+	if err != nil {
+		return err
+	}
+	return bluezError(m.conn.Object(bluezBusName, path).
+		CallWithContext(ctx, dbusPropertiesIface+".Set", 0, bluezDeviceIface, name, dbus.MakeVariant(value)).Err)
+}
+
+// managedObjects fetches the whole org.bluez object tree in a single round trip.
+func (m linuxBluezBluetoothManager) managedObjects(ctx context.Context) (bluezObjects, error) {
+	var objects bluezObjects
+	err := m.conn.Object(bluezBusName, "/").
+		CallWithContext(ctx, dbusObjectManager+".GetManagedObjects", 0).
+		Store(&objects)
+	if err != nil {
+		return nil, bluezError(err)
+	}
+	return objects, nil
+}
+
+// findDevice looks up the object path and Device1 properties of the device with the given MAC address.
+func (m linuxBluezBluetoothManager) findDevice(ctx context.Context, macAddr MacAddress) (dbus.ObjectPath, map[string]dbus.Variant, error) {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return m.findDeviceIn(objects, macAddr)
+}
+
+// findDeviceIn is findDevice for an object tree we've already fetched.
+//
+// BlueZ names device objects after their address (e.g. /org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF), but the adapter part of
+// the path varies, so we match on the Address property instead of building the path ourselves. If we're pinned to an
+// adapter, devices on other adapters are ignored.
+func (m linuxBluezBluetoothManager) findDeviceIn(objects bluezObjects, macAddr MacAddress) (dbus.ObjectPath, map[string]dbus.Variant, error) {
+	adapter, err := m.pinnedAdapter(objects)
+	if err != nil {
+		return "", nil, err
+	}
+	for path, ifaces := range objects {
+		props, ok := ifaces[bluezDeviceIface]
+		if !ok || !onAdapter(props, adapter) {
+			continue
+		}
+		if addr, err := ParseMacAddress(variantString(props, "Address")); err == nil && addr == macAddr {
+			return path, props, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, macAddr)
+}
+
+// findPoweredDevice is findDevice for operations that need the radio, like Connect. It fails with ErrAdapterPoweredOff
+// if the device's adapter is powered off, since BlueZ's own error for that isn't very clear.
+func (m linuxBluezBluetoothManager) findPoweredDevice(ctx context.Context, macAddr MacAddress) (dbus.ObjectPath, error) {
+	objects, err := m.managedObjects(ctx)
+	if err != nil {
+		return "", err
+	}
+	path, props, err := m.findDeviceIn(objects, macAddr)
+	if err != nil {
+		return "", err
+	}
+	adapter, _ := props["Adapter"].Value().(dbus.ObjectPath)
+	if adapterProps, ok := objects[adapter][bluezAdapterIface]; ok && !variantBool(adapterProps, "Powered") {
+		return "", fmt.Errorf("%w: %s", ErrAdapterPoweredOff, adapter)
+	}
+	return path, nil
+}
+
+// bluezErrorNames maps the D-Bus error names BlueZ returns to our sentinel errors.
+var bluezErrorNames = map[string]error{
+	"org.bluez.Error.DoesNotExist":           ErrDeviceNotFound,
+	"org.bluez.Error.NotReady":               ErrAdapterPoweredOff,
+	"org.bluez.Error.AuthenticationRejected": ErrNotPaired,
+	"org.bluez.Error.AuthenticationFailed":   ErrNotPaired,
+	"org.bluez.Error.InProgress":             ErrDeviceBusy,
+	"org.freedesktop.DBus.Error.NoReply":     ErrBackendTimeout,
+	"org.freedesktop.DBus.Error.Timeout":     ErrBackendTimeout,
+}
+
+// bluezErrorPatterns catches errors that BlueZ reports as a generic org.bluez.Error.Failed with the details in the
+// message, e.g. "br-connection-refused".
+var bluezErrorPatterns = []errorPattern{
+	{"connection-refused", ErrConnectionRefused},
+	{"Connection refused", ErrConnectionRefused},
+	{"connection-busy", ErrDeviceBusy},
+}
+
+// bluezError wraps a D-Bus error in the matching sentinel error, if there is one.
+func bluezError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrBackendTimeout, err)
+	}
+
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) {
+		return err
+	}
+	if sentinel, ok := bluezErrorNames[dbusErr.Name]; ok {
+		return fmt.Errorf("%w: %w", sentinel, err)
+	}
+	if sentinel := classifyOutput(bluezErrorPatterns, []byte(dbusErr.Error())); sentinel != nil {
+		return fmt.Errorf("%w: %w", sentinel, err)
+	}
+	return err
+}
+
+// bluezDevice converts the interfaces of a BlueZ device object into a BluetoothDevice, including its battery level if
+// it has a Battery1 interface.
+func bluezDevice(ifaces map[string]map[string]dbus.Variant) (BluetoothDevice, error) {
+	device, err := bluezDeviceFromProps(ifaces[bluezDeviceIface])
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+	if percentage, ok := ifaces[bluezBatteryIface]["Percentage"].Value().(byte); ok {
+		battery := int(percentage)
+		device.Battery = &battery
+	}
+	return device, nil
+}
+
+func bluezDeviceFromProps(props map[string]dbus.Variant) (BluetoothDevice, error) {
+	macAddr, err := ParseMacAddress(variantString(props, "Address"))
+	if err != nil {
+		return BluetoothDevice{}, err
+	}
+
+	// Alias is the name BlueZ, bluetoothctl and desktop Bluetooth settings show. It's the Name the device reports
+	// unless the user has renamed it, and BlueZ always sets it, falling back to a name derived from the address for
+	// devices that haven't told us their name. It's only missing for objects that aren't really devices.
+	name := variantString(props, "Alias")
+	if name == "" {
+		name = variantString(props, "Name")
+	}
+	class, _ := props["Class"].Value().(uint32)
+	return BluetoothDevice{
+		Name:      name,
+		MacAddr:   macAddr,
+		Connected: variantBool(props, "Connected"),
+		Alias:     variantString(props, "Alias"),
+		Class:     class,
+		Icon:      variantString(props, "Icon"),
+		Paired:    variantBool(props, "Paired"),
+		Trusted:   variantBool(props, "Trusted"),
+		Blocked:   variantBool(props, "Blocked"),
+	}, nil
+}
+
+// variantString returns the named property as a string, or "" if it's missing or has a different type.
+func variantString(props map[string]dbus.Variant, name string) string {
+	v, ok := props[name]
+	if !ok {
+		return ""
+	}
+	s, _ := v.Value().(string)
+	return s
+}
+
+// variantBool returns the named property as a bool, or false if it's missing or has a different type.
+func variantBool(props map[string]dbus.Variant, name string) bool {
+	v, ok := props[name]
+	if !ok {
+		return false
+	}
+	b, _ := v.Value().(bool)
+	return b
+}
@@ -0,0 +1,412 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// newTestBluezManager starts a private bus with a fake org.bluez on it and returns a manager connected to it.
+func newTestBluezManager(t *testing.T) (linuxBluezBluetoothManager, *fakeBluez) {
+	t.Helper()
+	addr := startTestBus(t)
+	fake := startFakeBluez(t, addr)
+	return linuxBluezBluetoothManager{conn: connectTestBus(t, addr)}, fake
+}
+
+// wantBluezDevice returns the BluetoothDevice we expect for a device created with fakeBluez.AddDevice.
+func wantBluezDevice(name, macAddr string, connected bool) BluetoothDevice {
+	return BluetoothDevice{
+		Name:      name,
+		MacAddr:   MustParseMacAddress(macAddr),
+		Connected: connected,
+		Alias:     name,
+		Class:     0x240404,
+		Icon:      "audio-headset",
+		Paired:    true,
+	}
+}
+
+func TestBluezList(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	fake.AddDevice(hci0, "CC:98:8B:20:7D:DB", "Bose QC35 II", true)
+
+	devices, err := m.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BluetoothDevice{
+		wantBluezDevice("Bose QC35 II", "CC:98:8B:20:7D:DB", true),
+		wantBluezDevice("WF-1000XM4", "F8:4E:17:66:E8:55", false),
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %#v, wanted %#v", devices, want)
+	}
+}
+
+func TestBluezGet(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", true)
+
+	device, err := m.Get(context.Background(), MustParseMacAddress("f8:4e:17:66:e8:55"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := wantBluezDevice("WF-1000XM4", "F8:4E:17:66:E8:55", true)
+	if device != want {
+		t.Errorf("got %#v, wanted %#v", device, want)
+	}
+
+	if _, err := m.Get(context.Background(), MustParseMacAddress("aa:bb:cc:dd:ee:ff")); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("got %v, wanted ErrDeviceNotFound", err)
+	}
+}
+
+func TestBluezDeviceName(t *testing.T) {
+	tests := []struct {
+		name  string
+		props map[string]dbus.Variant
+		want  string
+	}{
+		{"renamed", map[string]dbus.Variant{"Name": dbus.MakeVariant("WH-1000XM4"), "Alias": dbus.MakeVariant("Work")},
+			"Work"},
+		{"nameless", map[string]dbus.Variant{"Alias": dbus.MakeVariant("F8-4E-17-66-E8-55")}, "F8-4E-17-66-E8-55"},
+		{"no alias", map[string]dbus.Variant{"Name": dbus.MakeVariant("WH-1000XM4")}, "WH-1000XM4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.props["Address"] = dbus.MakeVariant("F8:4E:17:66:E8:55")
+			device, err := bluezDeviceFromProps(tt.props)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.Name != tt.want {
+				t.Errorf("got %q, wanted %q", device.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestBluezBattery(t *testing.T) {
+	addr := startTestBus(t)
+	fake := startFakeBluez(t, addr)
+	startFakeUPower(t, addr,
+		fakeUPowerDevice{NativePath: "BAT0", Serial: "5B10W51867", Percentage: 64},
+		fakeUPowerDevice{NativePath: "hid-dc:2c:26:01:4a:7b-battery", Percentage: 14.6},
+		fakeUPowerDevice{NativePath: "/org/bluez/hci0/dev_F8_4E_17_66_E8_55", Percentage: 50},
+	)
+	m := linuxBluezBluetoothManager{conn: connectTestBus(t, addr)}
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	headphones := fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", true)
+	fake.SetBattery(headphones.path, 85)
+	fake.AddDevice(hci0, "DC:2C:26:01:4A:7B", "Keyboard K380", true)
+	fake.AddDevice(hci0, "CC:98:8B:20:7D:DB", "Bose QC35 II", false)
+
+	battery := func(percentage int) *int { return &percentage }
+	tests := []struct {
+		macAddr string
+		want    *int
+	}{
+		// BlueZ's Battery1 wins over UPower.
+		{"f8:4e:17:66:e8:55", battery(85)},
+		// No Battery1, so it comes from UPower.
+		{"dc:2c:26:01:4a:7b", battery(15)},
+		{"cc:98:8b:20:7d:db", nil},
+	}
+
+	devices, err := m.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.macAddr, func(t *testing.T) {
+			macAddr := MustParseMacAddress(tt.macAddr)
+			i := slices.IndexFunc(devices, func(d BluetoothDevice) bool { return d.MacAddr == macAddr })
+			if i < 0 {
+				t.Fatalf("List didn't return %v", macAddr)
+			}
+			if got := devices[i].Battery; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("List: got %v, wanted %v", got, tt.want)
+			}
+
+			device, err := m.Get(context.Background(), macAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(device.Battery, tt.want) {
+				t.Errorf("Get: got %v, wanted %v", device.Battery, tt.want)
+			}
+		})
+	}
+}
+
+func TestBluezConnectDisconnect(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	dev := fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	ctx := context.Background()
+
+	if err := m.Connect(ctx, MustParseMacAddress("f8:4e:17:66:e8:55")); err != nil {
+		t.Fatal(err)
+	}
+	if connected, err := m.IsConnected(ctx, MustParseMacAddress("f8:4e:17:66:e8:55")); err != nil || !connected {
+		t.Errorf("after Connect: got connected=%v err=%v, wanted connected", connected, err)
+	}
+
+	if err := m.Disconnect(ctx, MustParseMacAddress("f8:4e:17:66:e8:55")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Prop(dev.path, bluezDeviceIface, "Connected"); got != false {
+		t.Errorf("after Disconnect: got Connected=%v, wanted false", got)
+	}
+}
+
+func TestBluezConnectError(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	dev := fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	dev.SetConnectErr(dbus.NewError("org.bluez.Error.Failed", []any{"br-connection-refused"}))
+
+	err := m.Connect(context.Background(), MustParseMacAddress("f8:4e:17:66:e8:55"))
+	if !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("got %v, wanted ErrConnectionRefused", err)
+	}
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) || dbusErr.Name != "org.bluez.Error.Failed" {
+		t.Errorf("got %v, wanted it to wrap org.bluez.Error.Failed", err)
+	}
+
+	dev.SetConnectErr(dbus.NewError("org.bluez.Error.NotReady", []any{"Resource Not Ready"}))
+	err = m.Connect(context.Background(), MustParseMacAddress("f8:4e:17:66:e8:55"))
+	if !errors.Is(err, ErrAdapterPoweredOff) {
+		t.Errorf("got %v, wanted ErrAdapterPoweredOff", err)
+	}
+}
+
+func TestBluezTrustBlockPair(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	dev := fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	mac := MustParseMacAddress("f8:4e:17:66:e8:55")
+	ctx := context.Background()
+
+	steps := []struct {
+		name string
+		op   func(context.Context, MacAddress) error
+		prop string
+		want bool
+	}{
+		{"Trust", m.Trust, "Trusted", true},
+		{"Untrust", m.Untrust, "Trusted", false},
+		{"Block", m.Block, "Blocked", true},
+		{"Unblock", m.Unblock, "Blocked", false},
+	}
+	for _, step := range steps {
+		if err := step.op(ctx, mac); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := fake.Prop(dev.path, bluezDeviceIface, step.prop); got != step.want {
+			t.Errorf("after %s: got %s=%v, wanted %v", step.name, step.prop, got, step.want)
+		}
+	}
+
+	// The fake starts out paired, so this exercises the AlreadyExists case.
+	if err := m.Pair(ctx, mac); err != nil {
+		t.Errorf("Pair on an already paired device: %v", err)
+	}
+}
+
+func TestBluezRemove(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	dev := fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	mac := MustParseMacAddress("f8:4e:17:66:e8:55")
+
+	if err := m.Remove(context.Background(), mac); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Has(dev.path) {
+		t.Error("device still exists after Remove")
+	}
+	if err := m.Remove(context.Background(), mac); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("second Remove: got %v, wanted ErrDeviceNotFound", err)
+	}
+}
+
+func TestBluezScan(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	fake.AddNearbyDevice(hci0, "4C:87:5D:2A:11:9F", "Galaxy Buds2", -77)
+
+	devices, err := m.Scan(context.Background(), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rssi := -77
+	want := []DiscoveredDevice{{Name: "Galaxy Buds2", MacAddr: MustParseMacAddress("4c:87:5d:2a:11:9f"), RSSI: &rssi, Class: 0x240404}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %#v, wanted %#v", devices, want)
+	}
+	if got := fake.Prop(hci0, bluezAdapterIface, "Discovering"); got != false {
+		t.Errorf("got Discovering=%v after Scan, wanted false", got)
+	}
+}
+
+func TestBluezScanCancelled(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.Scan(ctx, time.Minute); !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+	// Discovery is stopped even though the scan was cut short.
+	if got := fake.Prop(hci0, bluezAdapterIface, "Discovering"); got != false {
+		t.Errorf("got Discovering=%v after Scan, wanted false", got)
+	}
+}
+
+func TestBluezAdapters(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	hci1 := fake.AddAdapter("hci1", "5C:F3:70:9B:2E:01")
+	ctx := context.Background()
+
+	if err := m.SetAdapterPowered(ctx, MustParseMacAddress("5c:f3:70:9b:2e:01"), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Prop(hci1, bluezAdapterIface, "Powered"); got != false {
+		t.Errorf("got Powered=%v after SetAdapterPowered, wanted false", got)
+	}
+
+	adapters, err := m.Adapters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Adapter{
+		{Name: "hci0", MacAddr: MustParseMacAddress("00:1A:7D:DA:71:13"), Powered: true, Pairable: true, Selected: true},
+		{Name: "hci1", MacAddr: MustParseMacAddress("5C:F3:70:9B:2E:01"), Pairable: true},
+	}
+	if !reflect.DeepEqual(adapters, want) {
+		t.Errorf("got %#v, wanted %#v", adapters, want)
+	}
+
+	if err := m.SetAdapterPowered(ctx, MustParseMacAddress("11:22:33:44:55:66"), true); !errors.Is(err, ErrAdapterNotFound) {
+		t.Errorf("SetAdapterPowered on a missing adapter: got %v, wanted ErrAdapterNotFound", err)
+	}
+}
+
+func TestBluezPinnedAdapter(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	hci1 := fake.AddAdapter("hci1", "5C:F3:70:9B:2E:01")
+	fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	fake.AddDevice(hci1, "CC:98:8B:20:7D:DB", "Bose QC35 II", false)
+	ctx := context.Background()
+
+	m.adapter = MustParseMacAddress("5c:f3:70:9b:2e:01")
+	devices, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BluetoothDevice{wantBluezDevice("Bose QC35 II", "CC:98:8B:20:7D:DB", false)}; !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %#v, wanted only the device on hci1", devices)
+	}
+	if _, err := m.Get(ctx, MustParseMacAddress("f8:4e:17:66:e8:55")); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Get for a device on another adapter: got %v, wanted ErrDeviceNotFound", err)
+	}
+
+	fake.setProp(hci1, bluezAdapterIface, "Powered", false)
+	if err := m.Connect(ctx, MustParseMacAddress("cc:98:8b:20:7d:db")); !errors.Is(err, ErrAdapterPoweredOff) {
+		t.Errorf("Connect with the adapter off: got %v, wanted ErrAdapterPoweredOff", err)
+	}
+	if _, err := m.Scan(ctx, time.Millisecond); !errors.Is(err, ErrAdapterPoweredOff) {
+		t.Errorf("Scan with the adapter off: got %v, wanted ErrAdapterPoweredOff", err)
+	}
+
+	m.adapter = MustParseMacAddress("11:22:33:44:55:66")
+	if _, err := m.List(ctx); !errors.Is(err, ErrAdapterNotFound) {
+		t.Errorf("List with a missing adapter: got %v, wanted ErrAdapterNotFound", err)
+	}
+}
+
+// nextEvent waits for the next event from a Watch.
+func nextEvent(t *testing.T, events <-chan DeviceEvent) DeviceEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("events channel closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return DeviceEvent{}
+}
+
+func TestBluezWatch(t *testing.T) {
+	m, fake := newTestBluezManager(t)
+	hci0 := fake.AddAdapter("hci0", "00:1A:7D:DA:71:13")
+	dev := fake.AddDevice(hci0, "F8:4E:17:66:E8:55", "WF-1000XM4", false)
+	headphones := MustParseMacAddress("f8:4e:17:66:e8:55")
+	speaker := MustParseMacAddress("cc:98:8b:20:7d:db")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextEvent(t, events), (DeviceEvent{Type: DeviceConnected, MacAddr: headphones, Name: "WF-1000XM4"}); got != want {
+		t.Errorf("got %#v, wanted %#v", got, want)
+	}
+
+	fake.setProp(dev.path, bluezDeviceIface, "Trusted", true)
+	want := DeviceEvent{Type: DevicePropertyChanged, MacAddr: headphones, Name: "WF-1000XM4", Property: "Trusted", Value: true}
+	if got := nextEvent(t, events); got != want {
+		t.Errorf("got %#v, wanted %#v", got, want)
+	}
+
+	fake.SetBattery(dev.path, 90)
+	want = DeviceEvent{Type: DevicePropertyChanged, MacAddr: headphones, Name: "WF-1000XM4", Property: "Battery", Value: 90}
+	if got := nextEvent(t, events); got != want {
+		t.Errorf("got %#v, wanted %#v", got, want)
+	}
+	fake.SetBattery(dev.path, 89)
+	want.Value = 89
+	if got := nextEvent(t, events); got != want {
+		t.Errorf("got %#v, wanted %#v", got, want)
+	}
+
+	speakerDev := fake.AddDevice(hci0, "CC:98:8B:20:7D:DB", "Bose QC35 II", false)
+	if got, want := nextEvent(t, events), (DeviceEvent{Type: DeviceAdded, MacAddr: speaker, Name: "Bose QC35 II"}); got != want {
+		t.Errorf("got %#v, wanted %#v", got, want)
+	}
+
+	adapter := &fakeBluezAdapter{bluez: fake, path: hci0}
+	if err := adapter.RemoveDevice(speakerDev.path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextEvent(t, events), (DeviceEvent{Type: DeviceRemoved, MacAddr: speaker, Name: "Bose QC35 II"}); got != want {
+		t.Errorf("got %#v, wanted %#v", got, want)
+	}
+
+	cancel()
+	for range events {
+	}
+}
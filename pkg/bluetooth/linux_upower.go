@@ -0,0 +1,104 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	upowerBusName     = "org.freedesktop.UPower"
+	upowerPath        = "/org/freedesktop/UPower"
+	upowerIface       = "org.freedesktop.UPower"
+	upowerDeviceIface = "org.freedesktop.UPower.Device"
+)
+
+// upowerAddressRegex matches a MAC address in a UPower device's Serial or NativePath, which for Bluetooth devices look
+// like "F8:4E:17:66:E8:55", "/org/bluez/hci0/dev_F8_4E_17_66_E8_55" or "hid-f8:4e:17:66:e8:55-battery".
+var upowerAddressRegex = regexp.MustCompile(`[0-9A-Fa-f]{2}([:_][0-9A-Fa-f]{2}){5}`)
+
+// upowerBatteries asks UPower for the battery levels of the Bluetooth devices it knows about. It's the fallback for
+// devices that don't have a BlueZ Battery1 interface, like HID devices that report their battery through the kernel
+// instead. If UPower isn't running, it returns no batteries rather than an error.
+func upowerBatteries(ctx context.Context, conn *dbus.Conn) (map[MacAddress]int, error) {
+	var paths []dbus.ObjectPath
+	err := conn.Object(upowerBusName, upowerPath).CallWithContext(ctx, upowerIface+".EnumerateDevices", 0).Store(&paths)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	batteries := map[MacAddress]int{}
+	for _, path := range paths {
+		var props map[string]dbus.Variant
+		err := conn.Object(upowerBusName, path).
+			CallWithContext(ctx, dbusPropertiesIface+".GetAll", 0, upowerDeviceIface).
+			Store(&props)
+		if err != nil {
+			return nil, err
+		}
+		macAddr, ok := upowerDeviceAddress(props)
+		if !ok {
+			continue
+		}
+		if percentage, ok := props["Percentage"].Value().(float64); ok {
+			batteries[macAddr] = int(math.Round(percentage))
+		}
+	}
+	return batteries, nil
+}
+
+// upowerDeviceAddress returns the address of the Bluetooth device a UPower device belongs to. ok is false for devices
+// that aren't Bluetooth devices, like the laptop's own battery.
+func upowerDeviceAddress(props map[string]dbus.Variant) (macAddr MacAddress, ok bool) {
+	for _, name := range []string{"Serial", "NativePath"} {
+		match := upowerAddressRegex.FindString(variantString(props, name))
+		if match == "" {
+			continue
+		}
+		if macAddr, err := ParseMacAddress(strings.ReplaceAll(match, "_", ":")); err == nil {
+			return macAddr, true
+		}
+	}
+	return MacAddress{}, false
+}
+
+// systemUPowerBatteries is upowerBatteries on the system bus, for backends that don't otherwise use D-Bus.
+func systemUPowerBatteries(ctx context.Context) (map[MacAddress]int, error) {
+	// SystemBus returns a connection shared by the whole process, so it mustn't be closed.
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return upowerBatteries(ctx, conn)
+}
+
+// addBatteries fills in the battery level of connected devices that don't have one, from batteries (usually UPower)
+// if it knows it. It's only a nicety, so failures are logged rather than returned.
+func addBatteries(
+	ctx context.Context, devices []BluetoothDevice, batteries func(context.Context) (map[MacAddress]int, error),
+) {
+	missing := slices.ContainsFunc(devices, func(d BluetoothDevice) bool { return d.Connected && d.Battery == nil })
+	if !missing || batteries == nil {
+		return
+	}
+	levels, err := batteries(ctx)
+	if err != nil {
+		log.Printf("failed to get battery levels from UPower: %v", err)
+		return
+	}
+	for i, device := range devices {
+		if battery, ok := levels[device.MacAddr]; ok && device.Connected && device.Battery == nil {
+			devices[i].Battery = &battery
+		}
+	}
+}
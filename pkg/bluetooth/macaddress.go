@@ -1,10 +1,14 @@
 package bluetooth
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+var ErrInvalidMac = fmt.Errorf("invalid MAC address")
+
 var nonHexChars = regexp.MustCompile(`[^0-9A-Fa-f]`)
 
 // chunkString splits a string into chunks of length chunkSize. The last chunk may be shorter than chunkSize.
@@ -39,3 +43,85 @@ func NormalizeMac(mac string) (string, bool) {
 	mac = strings.Join(macParts, ":")
 	return mac, true
 }
+
+// A MacAddress is a 48-bit Bluetooth device address.
+//
+// Different tools format addresses differently (bluetoothctl prints `CC:98:8B:20:7D:DB` while blueutil prints
+// `cc-98-8b-20-7d-db`), so we parse them all into this type as soon as they enter the program. String always produces
+// the same canonical format regardless of where the address came from, and backends use FormatAs to convert it to
+// whatever format their underlying tool expects.
+type MacAddress [6]byte
+
+// A MacFormat describes how to write a MacAddress as a string.
+type MacFormat struct {
+	Separator string
+	Uppercase bool
+}
+
+// CanonicalMacFormat is the format used by MacAddress.String, and therefore by API responses and CLI output. It
+// matches the output of NormalizeMac.
+var CanonicalMacFormat = MacFormat{Separator: ":", Uppercase: false}
+
+// ParseMacAddress parses a MAC address in any format accepted by NormalizeMac. It returns an error wrapping
+// ErrInvalidMac if the address doesn't look valid.
+func ParseMacAddress(s string) (MacAddress, error) {
+	var mac MacAddress
+	normalized, ok := NormalizeMac(s)
+	if !ok {
+		return mac, fmt.Errorf("%w: %q", ErrInvalidMac, s)
+	}
+	for i, part := range strings.Split(normalized, ":") {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return MacAddress{}, fmt.Errorf("%w: %q", ErrInvalidMac, s)
+		}
+		mac[i] = byte(b)
+	}
+	return mac, nil
+}
+
+// MustParseMacAddress is like ParseMacAddress but panics if the address is invalid. It's intended for constants and
+// tests.
+func MustParseMacAddress(s string) MacAddress {
+	mac, err := ParseMacAddress(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
+
+// IsZero returns true for the all-zeroes address, which is what an uninitialized MacAddress holds.
+func (m MacAddress) IsZero() bool {
+	return m == MacAddress{}
+}
+
+// String returns the address in CanonicalMacFormat.
+func (m MacAddress) String() string {
+	return m.FormatAs(CanonicalMacFormat)
+}
+
+// FormatAs returns the address written in the given format.
+func (m MacAddress) FormatAs(f MacFormat) string {
+	digits := "%02x"
+	if f.Uppercase {
+		digits = "%02X"
+	}
+	parts := make([]string, len(m))
+	for i, b := range m {
+		parts[i] = fmt.Sprintf(digits, b)
+	}
+	return strings.Join(parts, f.Separator)
+}
+
+func (m MacAddress) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *MacAddress) UnmarshalText(text []byte) error {
+	mac, err := ParseMacAddress(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mac
+	return nil
+}
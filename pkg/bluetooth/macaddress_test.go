@@ -1,6 +1,8 @@
 package bluetooth
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -72,3 +74,69 @@ func TestChunkString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMacAddress(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"CC:98:8B:20:7D:DB", "cc:98:8b:20:7d:db", false},
+		{"cc-98-8b-20-7d-db", "cc:98:8b:20:7d:db", false},
+		{"CC988B207DDB", "cc:98:8b:20:7d:db", false},
+		{"cc:98:8b:20:7d", "", true},
+		{"http://example.xyz", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			mac, err := ParseMacAddress(tt.input)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidMac) {
+					t.Errorf("got err %v, wanted ErrInvalidMac", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mac.String() != tt.want {
+				t.Errorf("got %q, wanted %q", mac.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMacAddressFormatAs(t *testing.T) {
+	mac := MustParseMacAddress("cc:98:8b:20:7d:db")
+	if got := mac.FormatAs(bluetoothctlMacFormat); got != "CC:98:8B:20:7D:DB" {
+		t.Errorf("bluetoothctl format: got %q", got)
+	}
+	if got := mac.FormatAs(blueutilMacFormat); got != "cc-98-8b-20-7d-db" {
+		t.Errorf("blueutil format: got %q", got)
+	}
+}
+
+func TestMacAddressJSON(t *testing.T) {
+	device := BluetoothDevice{Name: "WF-1000XM4", MacAddr: MustParseMacAddress("F8-4E-17-66-E8-55")}
+	j, err := json.Marshal(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Name":"WF-1000XM4","MacAddr":"f8:4e:17:66:e8:55","Connected":false,"Paired":false,"Trusted":false,"Blocked":false}`
+	if string(j) != want {
+		t.Errorf("got %s, wanted %s", j, want)
+	}
+
+	var decoded BluetoothDevice
+	if err := json.Unmarshal(j, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != device {
+		t.Errorf("round trip: got %#v, wanted %#v", decoded, device)
+	}
+
+	if err := json.Unmarshal([]byte(`{"MacAddr":"nope"}`), &decoded); !errors.Is(err, ErrInvalidMac) {
+		t.Errorf("got err %v, wanted ErrInvalidMac", err)
+	}
+}
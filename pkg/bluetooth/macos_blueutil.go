@@ -1,8 +1,13 @@
 package bluetooth
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 )
 
 type blueutilDeviceInfo struct {
@@ -10,45 +15,86 @@ type blueutilDeviceInfo struct {
 	Name      string `json:"name"`
 	Connected bool   `json:"connected"`
 	Paired    bool   `json:"paired"`
+	// RSSI is only reported for devices that are in range, e.g. connected ones or ones found by --inquiry.
+	RSSI *int `json:"RSSI"`
 }
 
-type macosBlueutilBluetoothManager struct{}
+// blueutilMacFormat matches the way blueutil prints addresses, e.g. `cc-98-8b-20-7d-db`.
+var blueutilMacFormat = MacFormat{Separator: "-", Uppercase: false}
 
-func newMacosBlueutilBluetoothManager() macosBlueutilBluetoothManager {
-	// validate blueutil is on the path
-	if !onPath("blueutil") {
-		panic("couldn't find blueutil on the path")
-	}
+// blueutilErrorPatterns recognizes the messages blueutil prints on stderr when a command fails.
+var blueutilErrorPatterns = []errorPattern{
+	{"Device not found", ErrDeviceNotFound}, // "Device not found by address: cc-98-8b-20-7d-db"
+	{"not paired", ErrNotPaired},
+	{"powered off", ErrAdapterPoweredOff},
+	{"Power is off", ErrAdapterPoweredOff},
+	{"refused", ErrConnectionRefused},
+}
 
-	return macosBlueutilBluetoothManager{}
+// blueutilError classifies the result of running blueutil. It returns nil if the command succeeded.
+func blueutilError(output []byte, err error) error {
+	return classifyCommandError(blueutilErrorPatterns, output, err)
 }
 
-func (m macosBlueutilBluetoothManager) Connect(ctx context.Context, macAddr string) error {
-	output, err := runCmd(ctx, "blueutil", "--connect", macAddr)
-	if err != nil {
-		// TODO: process the error to see what went wrong
-		return err
-	}
-	// TODO: validate output
-	_ = output
-	return nil
+// macosBlueutilBluetoothManager wraps the blueutil command for macOS. blueutil doesn't report the adapter's address, so
+// it doesn't implement AdapterManager.
+type macosBlueutilBluetoothManager struct {
+	run CommandRunner
+	// connectPolicy controls how Connect verifies and retries connections.
+	connectPolicy ConnectPolicy
 }
 
-func (m macosBlueutilBluetoothManager) Disconnect(ctx context.Context, macAddr string) error {
-	output, err := runCmd(ctx, "blueutil", "--disconnect", macAddr)
-	if err != nil {
-		// TODO: process the error to see what went wrong
-		return err
-	}
-	// TODO: validate output
-	_ = output
-	return nil
+func init() {
+	RegisterBackend(Backend{
+		Name:     "blueutil",
+		Priority: 10,
+		Probe: func() error {
+			if err := requireOS("darwin"); err != nil {
+				return err
+			}
+			return requireExecutable("blueutil")
+		},
+		New: func(opts Options) (BluetoothManager, error) {
+			// macOS only ever uses one adapter, and blueutil has no way of choosing it anyway.
+			if !opts.Adapter.IsZero() {
+				return nil, errors.New("blueutil can't be pinned to an adapter")
+			}
+			run, err := opts.runner("blueutil")
+			if err != nil {
+				return nil, err
+			}
+			m := newMacosBlueutilBluetoothManager(run)
+			m.connectPolicy = opts.Connect
+			return m, nil
+		},
+	})
+}
+
+func newMacosBlueutilBluetoothManager(run CommandRunner) macosBlueutilBluetoothManager {
+	return macosBlueutilBluetoothManager{run: run}
+}
+
+// Connect runs `blueutil --connect` and then waits for `blueutil --is-connected` to say the device is connected,
+// retrying according to the connect policy.
+func (m macosBlueutilBluetoothManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	return connectVerified(ctx, m.connectPolicy, macAddr, func(ctx context.Context) error {
+		output, err := m.run.Run(ctx, nil, "blueutil", "--connect", macAddr.FormatAs(blueutilMacFormat))
+		return blueutilError(output, err)
+	}, func(ctx context.Context) (bool, error) {
+		return m.IsConnected(ctx, macAddr)
+	})
+}
+
+// Disconnect runs `blueutil --disconnect`, which waits for the device to disconnect, and classifies its errors with
+// blueutilError.
+func (m macosBlueutilBluetoothManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.run.Run(ctx, nil, "blueutil", "--disconnect", macAddr.FormatAs(blueutilMacFormat))
+	return blueutilError(output, err)
 }
 
 func (m macosBlueutilBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
-	output, err := runCmd(ctx, "blueutil", "--paired", "--format", "json")
-	if err != nil {
-		// TODO: process the error to see what went wrong
+	output, err := m.run.Run(ctx, nil, "blueutil", "--paired", "--format", "json")
+	if err := blueutilError(output, err); err != nil {
 		return nil, err
 	}
 
@@ -60,21 +106,26 @@ func (m macosBlueutilBluetoothManager) List(ctx context.Context) ([]BluetoothDev
 
 	devices := []BluetoothDevice{}
 	for _, rawDevice := range rawDevices {
+		macAddr, err := ParseMacAddress(rawDevice.Address)
+		if err != nil {
+			log.Printf("failed to parse MAC for blueutil device %q: %v", rawDevice.Name, err)
+			continue
+		}
 		devices = append(devices, BluetoothDevice{
 			Name:      rawDevice.Name,
-			MacAddr:   rawDevice.Address,
+			MacAddr:   macAddr,
 			Connected: rawDevice.Connected,
+			Paired:    rawDevice.Paired,
 		})
 	}
 
 	return devices, nil
 }
 
-func (m macosBlueutilBluetoothManager) Get(ctx context.Context, macAddr string) (BluetoothDevice, error) {
+func (m macosBlueutilBluetoothManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
 	var device BluetoothDevice
-	output, err := runCmd(ctx, "blueutil", "--info", macAddr, "--format", "json")
-	if err != nil {
-		// TODO: process the error to see what went wrong
+	output, err := m.run.Run(ctx, nil, "blueutil", "--info", macAddr.FormatAs(blueutilMacFormat), "--format", "json")
+	if err := blueutilError(output, err); err != nil {
 		return device, err
 	}
 
@@ -85,18 +136,66 @@ func (m macosBlueutilBluetoothManager) Get(ctx context.Context, macAddr string)
 	}
 
 	device.Name = rawDevice.Name
-	device.MacAddr = rawDevice.Address
+	device.MacAddr, err = ParseMacAddress(rawDevice.Address)
+	if err != nil {
+		return device, err
+	}
 	device.Connected = rawDevice.Connected
+	device.Paired = rawDevice.Paired
 	return device, nil
 }
 
-func (m macosBlueutilBluetoothManager) IsConnected(ctx context.Context, macAddr string) (bool, error) {
-	output, err := runCmd(ctx, "blueutil", "--is-connected", macAddr)
+// Pair pairs with the device. blueutil can't trust or block devices, so it doesn't implement DeviceTruster or
+// DeviceBlocker.
+func (m macosBlueutilBluetoothManager) Pair(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.run.Run(ctx, nil, "blueutil", "--pair", macAddr.FormatAs(blueutilMacFormat))
+	return blueutilError(output, err)
+}
+
+func (m macosBlueutilBluetoothManager) Remove(ctx context.Context, macAddr MacAddress) error {
+	output, err := m.run.Run(ctx, nil, "blueutil", "--unpair", macAddr.FormatAs(blueutilMacFormat))
+	return blueutilError(output, err)
+}
+
+// Scan runs `blueutil --inquiry`, which takes the duration in whole seconds.
+func (m macosBlueutilBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	output, err := m.run.Run(ctx, nil, "blueutil", "--inquiry", wholeSeconds(duration), "--format", "json")
+	if err := blueutilError(output, err); err != nil {
+		return nil, err
+	}
+
+	var rawDevices []blueutilDeviceInfo
+	err = json.Unmarshal(output, &rawDevices)
 	if err != nil {
-		// TODO: process the error to see what went wrong
+		return nil, err
+	}
+
+	devices := []DiscoveredDevice{}
+	for _, rawDevice := range rawDevices {
+		macAddr, err := ParseMacAddress(rawDevice.Address)
+		if err != nil {
+			log.Printf("failed to parse MAC for blueutil device %q: %v", rawDevice.Name, err)
+			continue
+		}
+		devices = append(devices, DiscoveredDevice{
+			Name:    rawDevice.Name,
+			MacAddr: macAddr,
+			RSSI:    rawDevice.RSSI,
+		})
+	}
+	return devices, nil
+}
+
+func (m macosBlueutilBluetoothManager) IsConnected(ctx context.Context, macAddr MacAddress) (bool, error) {
+	output, err := m.run.Run(ctx, nil, "blueutil", "--is-connected", macAddr.FormatAs(blueutilMacFormat))
+	if err := blueutilError(output, err); err != nil {
 		return false, err
 	}
 
 	// --is-connected returns '1' if the device is connected and 0 if not
+	output = bytes.TrimSpace(output)
+	if len(output) != 1 {
+		return false, fmt.Errorf("unexpected output from blueutil --is-connected: %q", output)
+	}
 	return output[0] == '1', nil
 }
@@ -0,0 +1,119 @@
+package bluetooth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DevicePolicy limits which devices a BluetoothManager will operate on. Entries are either MAC addresses or device
+// aliases. Aliases are compared case-insensitively against the device's alias and name, so they only match devices
+// the backend knows about.
+type DevicePolicy struct {
+	// Allow lists the only devices that can be operated on. If it's empty, every device is allowed.
+	Allow []string
+	// Deny lists devices that can never be operated on, even if they're in Allow.
+	Deny []string
+}
+
+// check returns ErrDeviceNotAllowed if the policy doesn't allow the device. device is nil if the backend doesn't know
+// about it.
+func (p DevicePolicy) check(macAddr MacAddress, device *BluetoothDevice) error {
+	if policyMatches(p.Deny, macAddr, device) {
+		return fmt.Errorf("%w: %v is denied", ErrDeviceNotAllowed, macAddr)
+	}
+	if len(p.Allow) > 0 && !policyMatches(p.Allow, macAddr, device) {
+		return fmt.Errorf("%w: %v isn't allowed", ErrDeviceNotAllowed, macAddr)
+	}
+	return nil
+}
+
+// policyMatches returns true if any of entries names the device.
+func policyMatches(entries []string, macAddr MacAddress, device *BluetoothDevice) bool {
+	for _, entry := range entries {
+		if mac, err := ParseMacAddress(entry); err == nil {
+			if mac == macAddr {
+				return true
+			}
+			continue
+		}
+		if device != nil && (strings.EqualFold(entry, device.Alias) || strings.EqualFold(entry, device.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// knownDevicesTTL is how long the set of known devices is used before it's fetched again.
+	knownDevicesTTL = 30 * time.Second
+	// knownDevicesMinAge is how old the set has to be before an address that isn't in it causes a refetch. New devices
+	// show up straight away, but a stream of requests for unknown addresses can't make us call List every time.
+	knownDevicesMinAge = 5 * time.Second
+)
+
+// knownDevices is a periodically refreshed set of the devices the backend knows about, i.e. the ones its List returns.
+type knownDevices struct {
+	inner BluetoothManager
+	now   func() time.Time
+	// flights makes concurrent lookups that need a refresh share one List call, which runs without holding mu so a slow
+	// backend only holds up the lookups that are waiting for it, and each of those only until its own ctx is done.
+	flights *flightGroup
+
+	mu      sync.Mutex
+	devices map[MacAddress]BluetoothDevice
+	updated time.Time
+}
+
+func newKnownDevices(inner BluetoothManager) *knownDevices {
+	return &knownDevices{inner: inner, now: time.Now, flights: &flightGroup{flights: map[flightKey]*flight{}}}
+}
+
+// lookup returns the known device with the given address, and false if there isn't one.
+func (k *knownDevices) lookup(ctx context.Context, macAddr MacAddress) (BluetoothDevice, bool, error) {
+	k.mu.Lock()
+	devices, age := k.devices, k.now().Sub(k.updated)
+	k.mu.Unlock()
+
+	if devices == nil || age > knownDevicesTTL {
+		var err error
+		if devices, err = k.refresh(ctx); err != nil {
+			return BluetoothDevice{}, false, err
+		}
+		age = 0
+	}
+	device, ok := devices[macAddr]
+	if !ok && age > knownDevicesMinAge {
+		var err error
+		if devices, err = k.refresh(ctx); err != nil {
+			return BluetoothDevice{}, false, err
+		}
+		device, ok = devices[macAddr]
+	}
+	return device, ok, nil
+}
+
+// refresh fetches the known devices, or waits for a fetch that's already running, and returns them.
+func (k *knownDevices) refresh(ctx context.Context) (map[MacAddress]BluetoothDevice, error) {
+	v, err := k.flights.do(ctx, flightKey{op: "list known devices"}, func(ctx context.Context) (any, error) {
+		list, err := k.inner.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		devices := make(map[MacAddress]BluetoothDevice, len(list))
+		for _, device := range list {
+			devices[device.MacAddr] = device
+		}
+		k.mu.Lock()
+		k.devices = devices
+		k.updated = k.now()
+		k.mu.Unlock()
+		return devices, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[MacAddress]BluetoothDevice), nil
+}
@@ -0,0 +1,289 @@
+package bluetooth
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNoBackend is returned (wrapped in a *BackendError) when NewBluetoothManager can't find a usable backend.
+var ErrNoBackend = errors.New("no usable bluetooth backend")
+
+// A Backend describes a BluetoothManager implementation that NewBluetoothManager can choose from.
+type Backend struct {
+	// Name identifies the backend in config files and the DWMBT_BLUETOOTH_BACKEND environment variable.
+	Name string
+	// Priority orders automatic selection. Backends with a higher priority are probed first.
+	Priority int
+	// Probe returns nil if the backend can be used on this host, or an error explaining why not.
+	Probe func() error
+	// New constructs the backend. It's only called after Probe succeeds. Backends that can't honour opts (e.g. they
+	// can't be pinned to an adapter) should return an error rather than silently ignoring them.
+	New func(opts Options) (BluetoothManager, error)
+}
+
+// Options configures the BluetoothManager returned by NewBluetoothManagerWithOptions.
+type Options struct {
+	// Backend names the backend to use. If it's empty, the first backend that's usable on this host is used.
+	Backend string
+	// Adapter pins the manager to the adapter with this address. If it's zero, the backend uses the system's default
+	// adapter. Operations fail with ErrAdapterNotFound if the adapter isn't present.
+	Adapter MacAddress
+	// Policy limits which devices the manager will operate on.
+	Policy DevicePolicy
+	// Connect controls how Connect verifies and retries connections. The zero value uses DefaultConnectPolicy.
+	Connect ConnectPolicy
+	// Runner runs the external commands for backends that use them. If it's nil, they're run with ExecRunner. Either
+	// way they're traced with TracingRunner.
+	Runner CommandRunner
+	// RecordCommands is the path of a file to record every external command the backend runs to, as a Transcript that
+	// LoadTranscript can read. It's for debugging, and only affects backends that run commands, i.e. not bluez.
+	// Recording stops once the file reaches 64MB.
+	RecordCommands string
+	// BluetoothctlSession makes the bluetoothctl backend keep one interactive bluetoothctl running and send it
+	// commands, instead of starting a new bluetoothctl for each one. It's much faster, but relies on bluetoothctl's
+	// interactive output, which is less stable between BlueZ releases than its one-shot output.
+	BluetoothctlSession bool
+}
+
+// backendRegistry holds the backends NewBluetoothManager can choose from. Backends register themselves with the
+// package-level registry in their init functions.
+type backendRegistry struct {
+	mu       sync.RWMutex
+	backends map[string]Backend
+}
+
+var registry = newBackendRegistry()
+
+func newBackendRegistry() *backendRegistry {
+	return &backendRegistry{backends: map[string]Backend{}}
+}
+
+// RegisterBackend makes a backend available to NewBluetoothManager. It panics if a backend with the same name is
+// already registered or if Probe or New is nil, since either is a programming error.
+func RegisterBackend(b Backend) {
+	registry.register(b)
+}
+
+// Backends returns the names of all registered backends in the order NewBluetoothManager probes them.
+func Backends() []string {
+	return registry.names()
+}
+
+func (r *backendRegistry) register(b Backend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b.Probe == nil || b.New == nil {
+		panic(fmt.Sprintf("bluetooth: backend %q is missing Probe or New", b.Name))
+	}
+	if _, dup := r.backends[b.Name]; dup {
+		panic(fmt.Sprintf("bluetooth: backend %q registered twice", b.Name))
+	}
+	r.backends[b.Name] = b
+}
+
+func (r *backendRegistry) names() []string {
+	var names []string
+	for _, b := range r.sorted() {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+// sorted returns the registered backends by descending priority, then by name.
+func (r *backendRegistry) sorted() []Backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sorted := make([]Backend, 0, len(r.backends))
+	for _, b := range r.backends {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// A BackendRejection records why a backend couldn't be used.
+type BackendRejection struct {
+	Backend string
+	Reason  error
+}
+
+// BackendError is returned by NewBluetoothManager when no backend could be used. It lists every backend that was
+// tried and why it was rejected so the user can tell what they need to install or configure.
+type BackendError struct {
+	// Requested is the backend name that was asked for, or "" if the backend was being picked automatically.
+	Requested  string
+	Rejections []BackendRejection
+}
+
+func (e *BackendError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(ErrNoBackend.Error())
+	if e.Requested != "" {
+		fmt.Fprintf(&sb, " (requested %q)", e.Requested)
+	}
+	if len(e.Rejections) == 0 {
+		sb.WriteString(": no backends registered")
+	}
+	for i, r := range e.Rejections {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%s: %v", r.Backend, r.Reason)
+	}
+	return sb.String()
+}
+
+func (e *BackendError) Unwrap() error {
+	return ErrNoBackend
+}
+
+// NewBluetoothManager returns a BluetoothManager using the named backend. If name is empty, each registered backend
+// is probed in priority order and the first one that's usable on this host is used.
+func NewBluetoothManager(name string) (BluetoothManager, error) {
+	return registry.newManager(Options{Backend: name})
+}
+
+// NewBluetoothManagerWithOptions is NewBluetoothManager with more control over how the manager is set up.
+func NewBluetoothManagerWithOptions(opts Options) (BluetoothManager, error) {
+	return registry.newManager(opts)
+}
+
+func (r *backendRegistry) newManager(opts Options) (BluetoothManager, error) {
+	name := opts.Backend
+	var candidates []Backend
+	if name == "" {
+		candidates = r.sorted()
+	} else {
+		r.mu.RLock()
+		b, ok := r.backends[name]
+		r.mu.RUnlock()
+		if !ok {
+			return nil, &BackendError{
+				Requested: name,
+				Rejections: []BackendRejection{{
+					Backend: name,
+					Reason:  fmt.Errorf("unknown backend (available: %s)", strings.Join(r.names(), ", ")),
+				}},
+			}
+		}
+		candidates = []Backend{b}
+	}
+
+	backendErr := &BackendError{Requested: name}
+	for _, b := range candidates {
+		if err := b.Probe(); err != nil {
+			backendErr.Rejections = append(backendErr.Rejections, BackendRejection{Backend: b.Name, Reason: err})
+			continue
+		}
+		manager, err := b.New(opts)
+		if err != nil {
+			backendErr.Rejections = append(backendErr.Rejections, BackendRejection{Backend: b.Name, Reason: err})
+			continue
+		}
+		// Wrap the manager in a normalizing manager to ensure all MAC addresses are validated and formatted
+		// consistently, and that we only operate on devices we know about and are allowed to touch. This saves us
+		// from having to do this in every implementation.
+		safer := newSaferBluetoothManager(manager, opts.Policy)
+		safer.backend = b.Name
+		return safer, nil
+	}
+	return nil, backendErr
+}
+
+// BackendInfo describes the backend behind a BluetoothManager.
+type BackendInfo struct {
+	// Name is the backend's name, or "" if it isn't known.
+	Name string
+	// Capabilities lists the optional capabilities the backend supports: "pair", "trust", "remove", "block", "scan",
+	// "adapters" and "watch".
+	Capabilities []string
+}
+
+// A wrapper is a BluetoothManager that wraps another, and implements every capability interface whether or not the
+// manager it wraps does. Unwrap returns the wrapped manager. The managers this package wraps backends in are all
+// wrappers, and a manager from outside the package that wraps one of them can implement Unwrap too, so that
+// DescribeBackend and the cache can still see the backend.
+type wrapper interface {
+	Unwrap() BluetoothManager
+}
+
+// unwrapBackend follows Unwrap from m until it gets to a manager that isn't a wrapper, which is usually the backend.
+func unwrapBackend(m BluetoothManager) BluetoothManager {
+	for {
+		w, ok := m.(wrapper)
+		if !ok {
+			return m
+		}
+		m = w.Unwrap()
+	}
+}
+
+// DescribeBackend returns the name and capabilities of m's backend. The managers that wrap a backend implement every
+// capability interface whether or not the backend does, so this looks through them with Unwrap, i.e. m can be a
+// manager from NewBluetoothManager, optionally wrapped with NewSerializingBluetoothManager and
+// NewCachingBluetoothManager. Any other manager is described by the interfaces it implements.
+func DescribeBackend(m BluetoothManager) BackendInfo {
+	var info BackendInfo
+	for w, ok := m.(wrapper); ok; w, ok = m.(wrapper) {
+		if safer, ok := m.(saferBluetoothManager); ok {
+			info.Name = safer.backend
+		}
+		m = w.Unwrap()
+	}
+
+	capabilities := []struct {
+		name string
+		ok   bool
+	}{
+		{"pair", is[DevicePairer](m)},
+		{"trust", is[DeviceTruster](m)},
+		{"remove", is[DeviceRemover](m)},
+		{"block", is[DeviceBlocker](m)},
+		{"scan", is[Scanner](m)},
+		{"adapters", is[AdapterManager](m)},
+		{"watch", is[DeviceWatcher](m)},
+	}
+	for _, c := range capabilities {
+		if c.ok {
+			info.Capabilities = append(info.Capabilities, c.name)
+		}
+	}
+	return info
+}
+
+// Capability returns m as a T, e.g. a DevicePairer, if m's backend implements T. The managers that wrap a backend
+// implement every capability interface whether or not the backend does, so a type assertion on one always succeeds;
+// this looks through them with Unwrap to see whether the capability is real.
+func Capability[T any](m BluetoothManager) (T, bool) {
+	c, ok := m.(T)
+	if !ok || !is[T](unwrapBackend(m)) {
+		var zero T
+		return zero, false
+	}
+	return c, true
+}
+
+// is reports whether m implements T.
+func is[T any](m BluetoothManager) bool {
+	_, ok := m.(T)
+	return ok
+}
+
+// requireOS returns an error unless we're running on the given GOOS.
+func requireOS(goos string) error {
+	if runtime.GOOS != goos {
+		return fmt.Errorf("requires %s, running on %s", goos, runtime.GOOS)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopBluetoothManager struct {
+	BluetoothManager
+	name string
+}
+
+func testBackend(name string, priority int, probeErr error) Backend {
+	return Backend{
+		Name:     name,
+		Priority: priority,
+		Probe:    func() error { return probeErr },
+		New: func(opts Options) (BluetoothManager, error) {
+			return nopBluetoothManager{name: name}, nil
+		},
+	}
+}
+
+func TestRegistryPicksFirstPassingProbe(t *testing.T) {
+	r := newBackendRegistry()
+	r.register(testBackend("low", 1, nil))
+	r.register(testBackend("high", 3, errors.New("not installed")))
+	r.register(testBackend("mid", 2, nil))
+
+	m, err := r.newManager(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.(saferBluetoothManager).inner.(nopBluetoothManager).name; got != "mid" {
+		t.Errorf("got backend %q, wanted %q", got, "mid")
+	}
+}
+
+func TestRegistryExplicitName(t *testing.T) {
+	r := newBackendRegistry()
+	r.register(testBackend("high", 3, nil))
+	r.register(testBackend("low", 1, nil))
+
+	m, err := r.newManager(Options{Backend: "low"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.(saferBluetoothManager).inner.(nopBluetoothManager).name; got != "low" {
+		t.Errorf("got backend %q, wanted %q", got, "low")
+	}
+
+	// An explicitly requested backend is still probed.
+	r.register(testBackend("broken", 0, errors.New("not installed")))
+	_, err = r.newManager(Options{Backend: "broken"})
+	if !errors.Is(err, ErrNoBackend) || !strings.Contains(err.Error(), "broken: not installed") {
+		t.Errorf("got %v, wanted ErrNoBackend mentioning the probe failure", err)
+	}
+}
+
+func TestRegistryUnknownName(t *testing.T) {
+	r := newBackendRegistry()
+	r.register(testBackend("a", 0, nil))
+	r.register(testBackend("b", 0, nil))
+
+	_, err := r.newManager(Options{Backend: "c"})
+	if !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("got %v, wanted ErrNoBackend", err)
+	}
+	if !strings.Contains(err.Error(), "available: a, b") {
+		t.Errorf("error %q doesn't list available backends", err)
+	}
+}
+
+func TestRegistryListsEveryRejection(t *testing.T) {
+	r := newBackendRegistry()
+	r.register(testBackend("a", 2, errors.New("requires darwin")))
+	r.register(testBackend("b", 1, errors.New("couldn't find b on the path")))
+
+	_, err := r.newManager(Options{})
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Fatalf("got %v, wanted a *BackendError", err)
+	}
+	want := "no usable bluetooth backend: a: requires darwin; b: couldn't find b on the path"
+	if err.Error() != want {
+		t.Errorf("got %q, wanted %q", err.Error(), want)
+	}
+}
+
+// scanningBluetoothManager is a backend with just the Scanner capability.
+type scanningBluetoothManager struct {
+	nopBluetoothManager
+}
+
+func (scanningBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	return nil, nil
+}
+
+func TestDescribeBackend(t *testing.T) {
+	r := newBackendRegistry()
+	r.register(Backend{
+		Name:  "scanner",
+		Probe: func() error { return nil },
+		New: func(opts Options) (BluetoothManager, error) {
+			return scanningBluetoothManager{}, nil
+		},
+	})
+	m, err := r.newManager(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := BackendInfo{Name: "scanner", Capabilities: []string{"scan"}}
+	// The wrappers implement every capability, but that doesn't mean the backend does.
+	serializing := NewSerializingBluetoothManager(m)
+	for _, m := range []BluetoothManager{
+		m, serializing, newCachingBluetoothManager(serializing, 0), decoratingManager{serializing},
+	} {
+		if got := DescribeBackend(m); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+	}
+	if got := DescribeBackend(nopBluetoothManager{}); got.Name != "" || got.Capabilities != nil {
+		t.Errorf("got %+v for a bare manager, wanted nothing", got)
+	}
+}
+
+func TestCapability(t *testing.T) {
+	m := NewSerializingBluetoothManager(newSaferBluetoothManager(scanningBluetoothManager{}, DevicePolicy{}))
+	if _, ok := m.(DevicePairer); !ok {
+		t.Fatalf("the wrappers should implement DevicePairer")
+	}
+	if _, ok := Capability[DevicePairer](m); ok {
+		t.Errorf("got a DevicePairer for a backend that can't pair")
+	}
+	scanner, ok := Capability[Scanner](m)
+	if !ok {
+		t.Fatalf("got no Scanner for a backend that can scan")
+	}
+	// It's still the wrapper, so scans go through it.
+	if _, ok := scanner.(serializingBluetoothManager); !ok {
+		t.Errorf("got a %T, wanted the serializing manager", scanner)
+	}
+}
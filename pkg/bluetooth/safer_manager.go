@@ -3,56 +3,212 @@ package bluetooth
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"time"
 )
 
-var ErrInvalidMac = fmt.Errorf("invalid MAC address")
-
 // saferBluetoothManager wraps an underlying BluetoothManager, providing standardized validation of MAC addresses passed
 // as arguments.
 //
 // This is primarily a security feature. We pass the MAC address as an argument to external commands, and while we use
 // exec.Command to avoid shell injection, letting an attacker pass an arbitrary string creates the risk of buffer
-// overflows or other attacks targeting vulnerabilities in the underlying commands that we use.
+// overflows or other attacks targeting vulnerabilities in the underlying commands that we use. Taking a MacAddress
+// instead of a string means untrusted input has already been through ParseMacAddress by the time it gets here, so the
+// only thing left to reject is the zero address, which is what callers get if they forget to set one.
 //
-// TODO: To be extra safe, we should also check that provided MAC addresses are in the list of devices we know about.
-// This would all but ensure that a MAC address passed to us is valid and safe to use. While I doubt an attacker could
-// fit a real attack into a string that looks like a valid MAC address, it's better to be safe than sorry.
+// To be extra safe, we also check that the address belongs to a device the backend lists, which all but ensures it's
+// valid and safe to use, and that the DevicePolicy allows it. Pair is the exception to the first check, since the
+// device it's given hasn't been paired yet and some backends only list paired devices. Either way, a peer can't make
+// us operate on an arbitrary address. Rejections are logged so there's an audit trail.
 type saferBluetoothManager struct {
-	inner BluetoothManager
+	inner  BluetoothManager
+	policy DevicePolicy
+	known  *knownDevices
+	// backend is the name of the backend inner came from, if it's known.
+	backend string
+}
+
+func newSaferBluetoothManager(inner BluetoothManager, policy DevicePolicy) saferBluetoothManager {
+	return saferBluetoothManager{inner: inner, policy: policy, known: newKnownDevices(inner)}
+}
+
+// checkDevice returns ErrInvalidMac for the zero address, ErrUnknownDevice if mustBeKnown is set and the backend
+// doesn't list the device, and ErrDeviceNotAllowed if the policy doesn't allow it. op names the operation for the log.
+func (m saferBluetoothManager) checkDevice(ctx context.Context, op string, macAddr MacAddress, mustBeKnown bool) error {
+	if macAddr.IsZero() {
+		return ErrInvalidMac
+	}
+	device, known, err := m.known.lookup(ctx, macAddr)
+	if err != nil {
+		return err
+	}
+
+	var rejection error
+	if known {
+		rejection = m.policy.check(macAddr, &device)
+	} else if mustBeKnown {
+		rejection = fmt.Errorf("%w: %v", ErrUnknownDevice, macAddr)
+	} else {
+		rejection = m.policy.check(macAddr, nil)
+	}
+	if rejection != nil {
+		slog.Warn("rejected device operation", "op", op, "macAddr", macAddr, "err", rejection)
+	}
+	return rejection
+}
+
+func (m saferBluetoothManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	if err := m.checkDevice(ctx, "connect", macAddr, true); err != nil {
+		return err
+	}
+	return m.inner.Connect(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	if err := m.checkDevice(ctx, "disconnect", macAddr, true); err != nil {
+		return err
+	}
+	return m.inner.Disconnect(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	return m.inner.List(ctx)
+}
+
+func (m saferBluetoothManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	if err := m.checkDevice(ctx, "get", macAddr, true); err != nil {
+		return BluetoothDevice{}, err
+	}
+	return m.inner.Get(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) IsConnected(ctx context.Context, macAddr MacAddress) (bool, error) {
+	if err := m.checkDevice(ctx, "is-connected", macAddr, true); err != nil {
+		return false, err
+	}
+	return m.inner.IsConnected(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) Pair(ctx context.Context, macAddr MacAddress) error {
+	if macAddr.IsZero() {
+		return ErrInvalidMac
+	}
+	pairer, ok := m.inner.(DevicePairer)
+	if !ok {
+		return ErrUnsupported
+	}
+	if err := m.checkDevice(ctx, "pair", macAddr, false); err != nil {
+		return err
+	}
+	return pairer.Pair(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) Trust(ctx context.Context, macAddr MacAddress) error {
+	if macAddr.IsZero() {
+		return ErrInvalidMac
+	}
+	truster, ok := m.inner.(DeviceTruster)
+	if !ok {
+		return ErrUnsupported
+	}
+	if err := m.checkDevice(ctx, "trust", macAddr, true); err != nil {
+		return err
+	}
+	return truster.Trust(ctx, macAddr)
 }
 
-func (m saferBluetoothManager) Connect(ctx context.Context, macAddr string) error {
-	mac, ok := NormalizeMac(macAddr)
+func (m saferBluetoothManager) Untrust(ctx context.Context, macAddr MacAddress) error {
+	if macAddr.IsZero() {
+		return ErrInvalidMac
+	}
+	truster, ok := m.inner.(DeviceTruster)
 	if !ok {
+		return ErrUnsupported
+	}
+	if err := m.checkDevice(ctx, "untrust", macAddr, true); err != nil {
+		return err
+	}
+	return truster.Untrust(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) Remove(ctx context.Context, macAddr MacAddress) error {
+	if macAddr.IsZero() {
 		return ErrInvalidMac
 	}
-	return m.inner.Connect(ctx, mac)
+	remover, ok := m.inner.(DeviceRemover)
+	if !ok {
+		return ErrUnsupported
+	}
+	if err := m.checkDevice(ctx, "remove", macAddr, true); err != nil {
+		return err
+	}
+	return remover.Remove(ctx, macAddr)
 }
 
-func (m saferBluetoothManager) Disconnect(ctx context.Context, macAddr string) error {
-	mac, ok := NormalizeMac(macAddr)
+func (m saferBluetoothManager) Block(ctx context.Context, macAddr MacAddress) error {
+	if macAddr.IsZero() {
+		return ErrInvalidMac
+	}
+	blocker, ok := m.inner.(DeviceBlocker)
 	if !ok {
+		return ErrUnsupported
+	}
+	if err := m.checkDevice(ctx, "block", macAddr, true); err != nil {
+		return err
+	}
+	return blocker.Block(ctx, macAddr)
+}
+
+func (m saferBluetoothManager) Unblock(ctx context.Context, macAddr MacAddress) error {
+	if macAddr.IsZero() {
 		return ErrInvalidMac
 	}
-	return m.inner.Disconnect(ctx, mac)
+	blocker, ok := m.inner.(DeviceBlocker)
+	if !ok {
+		return ErrUnsupported
+	}
+	if err := m.checkDevice(ctx, "unblock", macAddr, true); err != nil {
+		return err
+	}
+	return blocker.Unblock(ctx, macAddr)
 }
 
-func (m saferBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
-	return m.inner.List(ctx)
+func (m saferBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	scanner, ok := m.inner.(Scanner)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return scanner.Scan(ctx, duration)
 }
 
-func (m saferBluetoothManager) Get(ctx context.Context, macAddr string) (BluetoothDevice, error) {
-	mac, ok := NormalizeMac(macAddr)
+func (m saferBluetoothManager) Adapters(ctx context.Context) ([]Adapter, error) {
+	adapterManager, ok := m.inner.(AdapterManager)
 	if !ok {
-		return BluetoothDevice{}, ErrInvalidMac
+		return nil, ErrUnsupported
 	}
-	return m.inner.Get(ctx, mac)
+	return adapterManager.Adapters(ctx)
 }
 
-func (m saferBluetoothManager) IsConnected(ctx context.Context, macAddr string) (bool, error) {
-	mac, ok := NormalizeMac(macAddr)
+func (m saferBluetoothManager) SetAdapterPowered(ctx context.Context, adapter MacAddress, powered bool) error {
+	if adapter.IsZero() {
+		return ErrInvalidMac
+	}
+	adapterManager, ok := m.inner.(AdapterManager)
 	if !ok {
-		return false, ErrInvalidMac
+		return ErrUnsupported
+	}
+	return adapterManager.SetAdapterPowered(ctx, adapter, powered)
+}
+
+// Unwrap returns the backend.
+func (m saferBluetoothManager) Unwrap() BluetoothManager {
+	return m.inner
+}
+
+// Watch uses the backend's DeviceWatcher if it has one, and falls back to polling List if it doesn't.
+func (m saferBluetoothManager) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	if watcher, ok := m.inner.(DeviceWatcher); ok {
+		return watcher.Watch(ctx)
 	}
-	return m.inner.IsConnected(ctx, mac)
+	return pollDevices(ctx, m.inner, defaultPollInterval)
 }
@@ -0,0 +1,153 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSaferManagerUnsupportedCapabilities(t *testing.T) {
+	// nopBluetoothManager only implements the basic BluetoothManager interface.
+	m := newSaferBluetoothManager(nopBluetoothManager{}, DevicePolicy{})
+	mac := MustParseMacAddress("f8:4e:17:66:e8:55")
+	ctx := context.Background()
+
+	ops := map[string]func(context.Context, MacAddress) error{
+		"Pair":    m.Pair,
+		"Trust":   m.Trust,
+		"Untrust": m.Untrust,
+		"Remove":  m.Remove,
+		"Block":   m.Block,
+		"Unblock": m.Unblock,
+	}
+	for name, op := range ops {
+		if err := op(ctx, mac); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: got %v, wanted ErrUnsupported", name, err)
+		}
+		if err := op(ctx, MacAddress{}); !errors.Is(err, ErrInvalidMac) {
+			t.Errorf("%s with zero MAC: got %v, wanted ErrInvalidMac", name, err)
+		}
+	}
+	if _, err := m.Scan(ctx, time.Second); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Scan: got %v, wanted ErrUnsupported", err)
+	}
+	if _, err := m.Adapters(ctx); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Adapters: got %v, wanted ErrUnsupported", err)
+	}
+	if err := m.SetAdapterPowered(ctx, mac, true); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("SetAdapterPowered: got %v, wanted ErrUnsupported", err)
+	}
+	if err := m.SetAdapterPowered(ctx, MacAddress{}, true); !errors.Is(err, ErrInvalidMac) {
+		t.Errorf("SetAdapterPowered with zero MAC: got %v, wanted ErrInvalidMac", err)
+	}
+}
+
+func TestSaferManagerDeviceChecks(t *testing.T) {
+	headphones := BluetoothDevice{Name: "WF-1000XM4", Alias: "Work Buds", MacAddr: MustParseMacAddress("f8:4e:17:66:e8:55")}
+	speaker := BluetoothDevice{Name: "Bose QC35 II", MacAddr: MustParseMacAddress("cc:98:8b:20:7d:db")}
+	unknown := MustParseMacAddress("4c:87:5d:2a:11:9f")
+
+	tests := []struct {
+		name    string
+		policy  DevicePolicy
+		macAddr MacAddress
+		wantErr error
+	}{
+		{"known device", DevicePolicy{}, headphones.MacAddr, nil},
+		{"unknown device", DevicePolicy{}, unknown, ErrUnknownDevice},
+		{"denied by MAC", DevicePolicy{Deny: []string{"F8-4E-17-66-E8-55"}}, headphones.MacAddr, ErrDeviceNotAllowed},
+		{"denied by alias", DevicePolicy{Deny: []string{"work buds"}}, headphones.MacAddr, ErrDeviceNotAllowed},
+		{"denied by name", DevicePolicy{Deny: []string{"WF-1000XM4"}}, headphones.MacAddr, ErrDeviceNotAllowed},
+		{"allowed by alias", DevicePolicy{Allow: []string{"Work Buds"}}, headphones.MacAddr, nil},
+		{"not in allow list", DevicePolicy{Allow: []string{"Work Buds"}}, speaker.MacAddr, ErrDeviceNotAllowed},
+		{"deny beats allow", DevicePolicy{Allow: []string{"Work Buds"}, Deny: []string{"f8:4e:17:66:e8:55"}},
+			headphones.MacAddr, ErrDeviceNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &countingManager{devices: []BluetoothDevice{headphones, speaker}}
+			m := newSaferBluetoothManager(inner, tt.policy)
+			if err := m.Connect(context.Background(), tt.macAddr); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, wanted %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKnownDevicesRefresh(t *testing.T) {
+	headphones := BluetoothDevice{Name: "WF-1000XM4", MacAddr: MustParseMacAddress("f8:4e:17:66:e8:55")}
+	inner := &countingManager{}
+	known := newKnownDevices(inner)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	known.now = func() time.Time { return clock }
+	ctx := context.Background()
+
+	lookup := func(wantKnown bool, wantCalls int) {
+		t.Helper()
+		_, ok, err := known.lookup(ctx, headphones.MacAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != wantKnown || inner.calls() != wantCalls {
+			t.Errorf("got (%v, %d List calls), wanted (%v, %d)", ok, inner.calls(), wantKnown, wantCalls)
+		}
+	}
+
+	lookup(false, 1)
+	// The device shows up, but the set is too new to be refetched for an unknown address.
+	inner.devices = []BluetoothDevice{headphones}
+	lookup(false, 1)
+	clock = clock.Add(knownDevicesMinAge + time.Second)
+	lookup(true, 2)
+	// Known devices don't cause a refetch until the TTL is up.
+	clock = clock.Add(knownDevicesTTL)
+	lookup(true, 2)
+	clock = clock.Add(time.Second)
+	lookup(true, 3)
+}
+
+// slowListManager's List blocks until release is closed.
+type slowListManager struct {
+	BluetoothManager
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (m *slowListManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	m.calls.Add(1)
+	<-m.release
+	return nil, nil
+}
+
+func TestKnownDevicesSlowRefresh(t *testing.T) {
+	inner := &slowListManager{release: make(chan struct{})}
+	known := newKnownDevices(inner)
+	mac := MustParseMacAddress("f8:4e:17:66:e8:55")
+
+	// Lookups waiting on a slow List give up when their own context is done, rather than queueing behind each other.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if _, _, err := known.lookup(ctx, mac); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, wanted the lookup to time out", err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("lookup took %v, wanted it to give up after 20ms", elapsed)
+			}
+		}()
+	}
+	wg.Wait()
+	close(inner.release)
+	if calls := inner.calls.Load(); calls > 3 {
+		t.Errorf("got %d List calls, wanted the lookups to share them", calls)
+	}
+}
@@ -0,0 +1,323 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// serializingBluetoothManager stops concurrent requests for the same device from racing each other. Two peers (or a
+// peer and a local user) can ask to connect and disconnect the same device at the same time, and running both
+// commands at once leaves the device in whichever state bluetoothd happened to finish with.
+//
+// Operations that change a device are run one at a time per MAC address. Operations on different devices still run
+// concurrently. On top of that, a request that's identical to one already in flight (the same operation on the same
+// device) joins it and gets its result instead of running again, and List, Get and IsConnected are coalesced the same
+// way.
+//
+// A caller stops waiting when its own context is done, even if the operation it joined is still running. The
+// operation itself runs with the values of the context of the caller that started it, but not its deadline, and isn't
+// canceled until every caller waiting for it has given up, so a caller that joins with a later deadline still gets
+// the result.
+type serializingBluetoothManager struct {
+	inner   BluetoothManager
+	locks   *deviceLocks
+	flights *flightGroup
+}
+
+// NewSerializingBluetoothManager wraps m so that operations that change a device run one at a time per device, and
+// identical concurrent requests are coalesced into one. m is usually the manager returned by NewBluetoothManager; the
+// returned manager implements the same capabilities.
+func NewSerializingBluetoothManager(m BluetoothManager) BluetoothManager {
+	return newSerializingBluetoothManager(m)
+}
+
+func newSerializingBluetoothManager(m BluetoothManager) serializingBluetoothManager {
+	return serializingBluetoothManager{
+		inner:   m,
+		locks:   &deviceLocks{locks: map[MacAddress]*deviceLock{}},
+		flights: &flightGroup{flights: map[flightKey]*flight{}},
+	}
+}
+
+// change runs op for macAddr once any other change to the device has finished, joining an identical op that's already
+// waiting or running.
+func (m serializingBluetoothManager) change(
+	ctx context.Context, op string, macAddr MacAddress, fn func(context.Context) error,
+) error {
+	_, err := m.flights.do(ctx, flightKey{op, macAddr}, func(ctx context.Context) (any, error) {
+		unlock, err := m.locks.lock(ctx, macAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// read runs op, joining an identical op that's already running.
+func read[T any](
+	ctx context.Context, m serializingBluetoothManager, op string, macAddr MacAddress, fn func(context.Context) (T, error),
+) (T, error) {
+	v, err := m.flights.do(ctx, flightKey{op, macAddr}, func(ctx context.Context) (any, error) {
+		return fn(ctx)
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return v.(T), nil
+}
+
+func (m serializingBluetoothManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	return m.change(ctx, "connect", macAddr, func(ctx context.Context) error {
+		return m.inner.Connect(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	return m.change(ctx, "disconnect", macAddr, func(ctx context.Context) error {
+		return m.inner.Disconnect(ctx, macAddr)
+	})
+}
+
+// List is coalesced, so callers share the slice it returns and mustn't modify it.
+func (m serializingBluetoothManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	return read(ctx, m, "list", MacAddress{}, m.inner.List)
+}
+
+func (m serializingBluetoothManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	return read(ctx, m, "get", macAddr, func(ctx context.Context) (BluetoothDevice, error) {
+		return m.inner.Get(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) IsConnected(ctx context.Context, macAddr MacAddress) (bool, error) {
+	return read(ctx, m, "is-connected", macAddr, func(ctx context.Context) (bool, error) {
+		return m.inner.IsConnected(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Pair(ctx context.Context, macAddr MacAddress) error {
+	pairer, ok := m.inner.(DevicePairer)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.change(ctx, "pair", macAddr, func(ctx context.Context) error {
+		return pairer.Pair(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Trust(ctx context.Context, macAddr MacAddress) error {
+	truster, ok := m.inner.(DeviceTruster)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.change(ctx, "trust", macAddr, func(ctx context.Context) error {
+		return truster.Trust(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Untrust(ctx context.Context, macAddr MacAddress) error {
+	truster, ok := m.inner.(DeviceTruster)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.change(ctx, "untrust", macAddr, func(ctx context.Context) error {
+		return truster.Untrust(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Remove(ctx context.Context, macAddr MacAddress) error {
+	remover, ok := m.inner.(DeviceRemover)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.change(ctx, "remove", macAddr, func(ctx context.Context) error {
+		return remover.Remove(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Block(ctx context.Context, macAddr MacAddress) error {
+	blocker, ok := m.inner.(DeviceBlocker)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.change(ctx, "block", macAddr, func(ctx context.Context) error {
+		return blocker.Block(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Unblock(ctx context.Context, macAddr MacAddress) error {
+	blocker, ok := m.inner.(DeviceBlocker)
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.change(ctx, "unblock", macAddr, func(ctx context.Context) error {
+		return blocker.Unblock(ctx, macAddr)
+	})
+}
+
+func (m serializingBluetoothManager) Scan(ctx context.Context, duration time.Duration) ([]DiscoveredDevice, error) {
+	scanner, ok := m.inner.(Scanner)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return scanner.Scan(ctx, duration)
+}
+
+func (m serializingBluetoothManager) Adapters(ctx context.Context) ([]Adapter, error) {
+	adapterManager, ok := m.inner.(AdapterManager)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return adapterManager.Adapters(ctx)
+}
+
+func (m serializingBluetoothManager) SetAdapterPowered(ctx context.Context, adapter MacAddress, powered bool) error {
+	adapterManager, ok := m.inner.(AdapterManager)
+	if !ok {
+		return ErrUnsupported
+	}
+	return adapterManager.SetAdapterPowered(ctx, adapter, powered)
+}
+
+// Unwrap returns the manager whose operations are serialized.
+func (m serializingBluetoothManager) Unwrap() BluetoothManager {
+	return m.inner
+}
+
+func (m serializingBluetoothManager) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	watcher, ok := m.inner.(DeviceWatcher)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return watcher.Watch(ctx)
+}
+
+// deviceLocks is a set of per-device locks that can be waited for with a context.
+type deviceLocks struct {
+	mu    sync.Mutex
+	locks map[MacAddress]*deviceLock
+}
+
+type deviceLock struct {
+	// held has room for one value, which is in it while the lock is held.
+	held chan struct{}
+	// refs counts the callers holding or waiting for the lock, so it can be dropped from the map once there are none.
+	refs int
+}
+
+// lock waits until the lock for macAddr is free, or ctx is done, and takes it.
+func (l *deviceLocks) lock(ctx context.Context, macAddr MacAddress) (unlock func(), err error) {
+	l.mu.Lock()
+	dl, ok := l.locks[macAddr]
+	if !ok {
+		dl = &deviceLock{held: make(chan struct{}, 1)}
+		l.locks[macAddr] = dl
+	}
+	dl.refs++
+	l.mu.Unlock()
+
+	select {
+	case dl.held <- struct{}{}:
+		return func() {
+			<-dl.held
+			l.release(macAddr, dl)
+		}, nil
+	case <-ctx.Done():
+		l.release(macAddr, dl)
+		return nil, contextError(ctx, fmt.Sprintf("waiting for another operation on %v", macAddr))
+	}
+}
+
+func (l *deviceLocks) release(macAddr MacAddress, dl *deviceLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dl.refs--
+	if dl.refs == 0 {
+		delete(l.locks, macAddr)
+	}
+}
+
+type flightKey struct {
+	op      string
+	macAddr MacAddress
+}
+
+// A flight is a call that one or more callers are waiting for.
+type flight struct {
+	done    chan struct{}
+	value   any
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces identical concurrent calls into one, like golang.org/x/sync/singleflight, except that callers
+// can stop waiting when their context is done.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// do runs fn, unless a call with the same key is already running, in which case it waits for that call's result
+// instead. fn gets a context with ctx's values that's only canceled once every caller has stopped waiting. It has no
+// deadline: each caller's deadline only bounds how long that caller waits.
+func (g *flightGroup) do(ctx context.Context, key flightKey, fn func(context.Context) (any, error)) (any, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		f = g.start(ctx, key, fn)
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody wants the result any more. Later callers have to start again rather than join a canceled call.
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, contextError(ctx, "waiting for "+key.op)
+	}
+}
+
+// start runs fn in the background and records it under key. g.mu must be held.
+func (g *flightGroup) start(ctx context.Context, key flightKey, fn func(context.Context) (any, error)) *flight {
+	fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	f := &flight{done: make(chan struct{}), cancel: cancel}
+	g.flights[key] = f
+
+	go func() {
+		defer cancel()
+		f.value, f.err = fn(fctx)
+		g.mu.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// contextError returns the error for giving up on something because ctx is done, wrapping ErrBackendTimeout if its
+// deadline passed.
+func contextError(ctx context.Context, doing string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s: %w", ErrBackendTimeout, doing, ctx.Err())
+	}
+	return fmt.Errorf("%s: %w", doing, ctx.Err())
+}
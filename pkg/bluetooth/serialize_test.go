@@ -0,0 +1,256 @@
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedManager blocks every Connect, Disconnect and Get until release is closed, and records what ran.
+type gatedManager struct {
+	BluetoothManager
+	release chan struct{}
+
+	mu      sync.Mutex
+	calls   []string
+	active  map[MacAddress]int
+	overlap bool
+}
+
+func newGatedManager() *gatedManager {
+	return &gatedManager{release: make(chan struct{}), active: map[MacAddress]int{}}
+}
+
+func (m *gatedManager) run(ctx context.Context, op string, macAddr MacAddress) error {
+	m.mu.Lock()
+	m.calls = append(m.calls, op+" "+macAddr.String())
+	m.active[macAddr]++
+	if m.active[macAddr] > 1 {
+		m.overlap = true
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.active[macAddr]--
+		m.mu.Unlock()
+	}()
+
+	select {
+	case <-m.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *gatedManager) Connect(ctx context.Context, macAddr MacAddress) error {
+	return m.run(ctx, "connect", macAddr)
+}
+
+func (m *gatedManager) Disconnect(ctx context.Context, macAddr MacAddress) error {
+	return m.run(ctx, "disconnect", macAddr)
+}
+
+func (m *gatedManager) Get(ctx context.Context, macAddr MacAddress) (BluetoothDevice, error) {
+	err := m.run(ctx, "get", macAddr)
+	return BluetoothDevice{MacAddr: macAddr}, err
+}
+
+func (m *gatedManager) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.calls)
+}
+
+// waitFor polls cond until it's true, failing the test if that takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waiters returns how many callers are waiting for the call with the given key.
+func (g *flightGroup) waiters(key flightKey) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+func TestSerializingManager(t *testing.T) {
+	headphones := MustParseMacAddress("f8:4e:17:66:e8:55")
+	keyboard := MustParseMacAddress("dc:2c:26:01:4a:7b")
+
+	type request struct {
+		op      string
+		macAddr MacAddress
+	}
+	tests := []struct {
+		name     string
+		requests []request
+		// wantRunning is how many calls reach the inner manager before any of them finish.
+		wantRunning int
+		wantCalls   int
+	}{
+		{"identical connects are coalesced",
+			[]request{{"connect", headphones}, {"connect", headphones}, {"connect", headphones}}, 1, 1},
+		{"identical gets are coalesced",
+			[]request{{"get", headphones}, {"get", headphones}}, 1, 1},
+		{"connect and disconnect take turns",
+			[]request{{"connect", headphones}, {"disconnect", headphones}}, 1, 2},
+		{"different devices run concurrently",
+			[]request{{"connect", headphones}, {"connect", keyboard}}, 2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newGatedManager()
+			m := newSerializingBluetoothManager(inner)
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(tt.requests))
+			for i, r := range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					switch r.op {
+					case "connect":
+						errs[i] = m.Connect(ctx, r.macAddr)
+					case "disconnect":
+						errs[i] = m.Disconnect(ctx, r.macAddr)
+					case "get":
+						_, errs[i] = m.Get(ctx, r.macAddr)
+					}
+				}()
+				// Start the requests in order, and make sure each one has got as far as it can before the next.
+				waitFor(t, r.op+" to start", func() bool {
+					return m.flights.waiters(flightKey{r.op, r.macAddr}) > 0
+				})
+			}
+			waitFor(t, "the inner manager to be called", func() bool { return inner.callCount() >= tt.wantRunning })
+			// Give anything that shouldn't be running a chance to start.
+			time.Sleep(10 * time.Millisecond)
+			if got := inner.callCount(); got != tt.wantRunning {
+				t.Errorf("got %d calls running at once, wanted %d", got, tt.wantRunning)
+			}
+
+			close(inner.release)
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					t.Errorf("got %v, wanted no error", err)
+				}
+			}
+			if got := inner.callCount(); got != tt.wantCalls {
+				t.Errorf("got %d calls %v, wanted %d", got, inner.calls, tt.wantCalls)
+			}
+			if inner.overlap {
+				t.Errorf("calls for the same device overlapped: %v", inner.calls)
+			}
+		})
+	}
+}
+
+func TestSerializingManagerWaiterDeadline(t *testing.T) {
+	headphones := MustParseMacAddress("f8:4e:17:66:e8:55")
+	inner := newGatedManager()
+	m := newSerializingBluetoothManager(inner)
+
+	firstDone := make(chan error)
+	go func() { firstDone <- m.Connect(context.Background(), headphones) }()
+	waitFor(t, "connect to start", func() bool { return inner.callCount() == 1 })
+
+	// A disconnect stuck behind the connect, and a connect that joined it, both give up when their deadline passes.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Disconnect(ctx, headphones); !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Connect(ctx, headphones); !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+
+	// The first connect carries on regardless, and the disconnect never ran.
+	close(inner.release)
+	if err := <-firstDone; err != nil {
+		t.Errorf("got %v, wanted no error", err)
+	}
+	if got := inner.callCount(); got != 1 {
+		t.Errorf("got calls %v, wanted just the first connect", inner.calls)
+	}
+}
+
+func TestSerializingManagerJoinerDeadline(t *testing.T) {
+	headphones := MustParseMacAddress("f8:4e:17:66:e8:55")
+	inner := newGatedManager()
+	m := newSerializingBluetoothManager(inner)
+
+	// The connect is started by a caller in a hurry, and joined by one with plenty of time.
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	firstDone := make(chan error)
+	go func() { firstDone <- m.Connect(short, headphones) }()
+	waitFor(t, "connect to start", func() bool { return inner.callCount() == 1 })
+	long, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	secondDone := make(chan error)
+	go func() { secondDone <- m.Connect(long, headphones) }()
+	waitFor(t, "the second connect to join", func() bool {
+		return m.flights.waiters(flightKey{"connect", headphones}) == 2
+	})
+
+	if err := <-firstDone; !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("got %v for the first connect, wanted ErrBackendTimeout", err)
+	}
+	// The first caller's deadline doesn't cut the connect short for the second.
+	time.Sleep(10 * time.Millisecond)
+	close(inner.release)
+	if err := <-secondDone; err != nil {
+		t.Errorf("got %v for the second connect, wanted no error", err)
+	}
+	if got := inner.callCount(); got != 1 {
+		t.Errorf("got calls %v, wanted one connect", inner.calls)
+	}
+}
+
+func TestSerializingManagerCancelsAbandonedCalls(t *testing.T) {
+	headphones := MustParseMacAddress("f8:4e:17:66:e8:55")
+	inner := newGatedManager()
+	m := newSerializingBluetoothManager(inner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Connect(ctx, headphones) }()
+	waitFor(t, "connect to start", func() bool { return inner.callCount() == 1 })
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, wanted context.Canceled", err)
+	}
+
+	// The abandoned connect is canceled, so the device is free for the next one, which runs again rather than
+	// joining it.
+	waitFor(t, "the abandoned connect to finish", func() bool {
+		inner.mu.Lock()
+		defer inner.mu.Unlock()
+		return inner.active[headphones] == 0
+	})
+	close(inner.release)
+	if err := m.Connect(context.Background(), headphones); err != nil {
+		t.Errorf("got %v, wanted no error", err)
+	}
+	if got := inner.callCount(); got != 2 {
+		t.Errorf("got calls %v, wanted 2 connects", inner.calls)
+	}
+}
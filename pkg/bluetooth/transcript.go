@@ -0,0 +1,222 @@
+package bluetooth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A Transcript is a recording of the external commands a backend ran and what they printed. Setting
+// Options.RecordCommands makes the command-based backends (bluetoothctl and blueutil) write one as they go, so users
+// hitting a parsing bug can send us a recording instead of us needing their hardware. Replaying it through the backend
+// turns it into a regression test; see testdata/transcripts.
+type Transcript struct {
+	// Backend is the backend that ran the commands.
+	Backend string
+	// Operation describes what the commands were run for, e.g. "List" or "Get f8:4e:17:66:e8:55". It isn't recorded,
+	// since the recorder doesn't know, but the replay tests need it.
+	Operation string `json:",omitempty"`
+	Commands  []RecordedCommand
+}
+
+// A RecordedCommand is one external command in a Transcript.
+type RecordedCommand struct {
+	Command string
+	Args    []string `json:",omitempty"`
+	Stdin   string   `json:",omitempty"`
+	Stdout  string
+	Stderr  string `json:",omitempty"`
+	// ExitCode is the command's exit code, or -1 if it didn't exit normally. See CommandError.
+	ExitCode int
+	// Error is the error the command failed with, if any, e.g. "exit status 1" or "context deadline exceeded".
+	Error string `json:",omitempty"`
+	// Duration is how long the command took, e.g. "1.503s".
+	Duration string `json:",omitempty"`
+}
+
+// LoadTranscript reads a Transcript written by Options.RecordCommands. The recorder writes the Transcript without its
+// commands on the first line, followed by one RecordedCommand per line, but LoadTranscript also reads a single JSON
+// Transcript with its commands inline, as in testdata/transcripts.
+func LoadTranscript(path string) (Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Transcript{}, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	var t Transcript
+	if err := dec.Decode(&t); err != nil {
+		return Transcript{}, fmt.Errorf("parsing transcript %s: %w", path, err)
+	}
+	for {
+		var c RecordedCommand
+		err := dec.Decode(&c)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Transcript{}, fmt.Errorf("parsing transcript %s: %w", path, err)
+		}
+		t.Commands = append(t.Commands, c)
+	}
+	return t, nil
+}
+
+// runner returns the CommandRunner the named backend should use: opts.Runner or ExecRunner, wrapped in a recorder if
+// opts.RecordCommands is set, and traced with TracingRunner.
+func (opts Options) runner(backend string) (CommandRunner, error) {
+	run := opts.Runner
+	if run == nil {
+		run = ExecRunner{}
+	}
+	if opts.RecordCommands != "" {
+		rec, err := newCommandRecorder(opts.RecordCommands, backend)
+		if err != nil {
+			return nil, err
+		}
+		run = rec.wrap(run)
+	}
+	return TracingRunner{Runner: run}, nil
+}
+
+// maxTranscriptSize is how big a transcript can get before the recorder stops adding to it, so leaving recording on
+// can't fill the disk.
+const maxTranscriptSize = 64 << 20
+
+// commandRecorder writes a Transcript of the commands run through it. Each command is appended to the file as soon as
+// it finishes, so the recording survives the process being killed, until the file reaches maxSize.
+type commandRecorder struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	full bool
+}
+
+// newCommandRecorder creates (or truncates) the transcript file at path. The recorder keeps it open for the rest of
+// the process's life, like the backend it records.
+func newCommandRecorder(path, backend string) (*commandRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("can't record commands: %w", err)
+	}
+	r := &commandRecorder{path: path, maxSize: maxTranscriptSize, file: f}
+	// The header is a Transcript with no commands; they follow it, one per line.
+	if err := r.append(Transcript{Backend: backend}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't record commands: %w", err)
+	}
+	return r, nil
+}
+
+// wrap returns a CommandRunner that records the commands it runs with run.
+func (r *commandRecorder) wrap(run CommandRunner) CommandRunner {
+	return CommandRunnerFunc(func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		start := time.Now()
+		output, err := run.Run(ctx, stdin, cmd, args...)
+		recorded := RecordedCommand{
+			Command:  cmd,
+			Args:     args,
+			Stdin:    string(stdin),
+			Stdout:   string(output),
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			recorded.ExitCode = -1
+			recorded.Error = err.Error()
+			var cmdErr *CommandError
+			if errors.As(err, &cmdErr) {
+				recorded.ExitCode = cmdErr.ExitCode
+				recorded.Stderr = string(cmdErr.Stderr)
+				recorded.Error = cmdErr.Err.Error()
+			}
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err := r.append(recorded); err != nil {
+			log.Printf("failed to record command: %v", err)
+		}
+		return output, err
+	})
+}
+
+// append writes v to the transcript as one line, unless that would take it past maxSize. r.mu must be held, except by
+// newCommandRecorder.
+func (r *commandRecorder) append(v any) error {
+	if r.full {
+		return nil
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+	if r.size+int64(len(j)) > r.maxSize {
+		r.full = true
+		log.Printf("transcript %s has reached %d bytes; not recording any more commands", r.path, r.maxSize)
+		return nil
+	}
+	n, err := r.file.Write(j)
+	r.size += int64(n)
+	return err
+}
+
+// replayRunner returns a CommandRunner that answers with the commands recorded in t instead of running anything. Each
+// call gets the first recorded command with the same command line and stdin that hasn't been used yet, so commands
+// that backends run concurrently don't have to be replayed in the order they were recorded. A call with no match
+// left fails, which makes tests catch backends that start running different commands.
+func replayRunner(t Transcript) CommandRunner {
+	var mu sync.Mutex
+	used := make([]bool, len(t.Commands))
+	return CommandRunnerFunc(func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, recorded := range t.Commands {
+			if used[i] || recorded.Command != cmd || !slices.Equal(recorded.Args, args) || recorded.Stdin != string(stdin) {
+				continue
+			}
+			used[i] = true
+			return recorded.replay()
+		}
+		return nil, &CommandError{
+			Command:  cmd,
+			Args:     args,
+			ExitCode: -1,
+			Err:      errors.New("no recording of this command left to replay"),
+		}
+	})
+}
+
+// replay returns the output and error that the recorded command produced, in the form ExecRunner returns them.
+func (c RecordedCommand) replay() ([]byte, error) {
+	stdout := []byte(c.Stdout)
+	if c.Error == "" {
+		return stdout, nil
+	}
+	err := errors.New(c.Error)
+	// The errors backends check for have to survive the trip through the transcript.
+	for _, sentinel := range []error{context.DeadlineExceeded, context.Canceled} {
+		if c.Error == sentinel.Error() {
+			err = sentinel
+		}
+	}
+	return stdout, &CommandError{
+		Command:  c.Command,
+		Args:     c.Args,
+		ExitCode: c.ExitCode,
+		Stdout:   stdout,
+		Stderr:   []byte(c.Stderr),
+		Err:      err,
+	}
+}
@@ -0,0 +1,212 @@
+package bluetooth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run `go test -update` to regenerate the .golden files after changing a backend. Check the diff before committing!
+var update = flag.Bool("update", false, "update .golden files")
+
+// transcriptResult is what we record in the golden files for transcripts.
+type transcriptResult struct {
+	Result any    `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// replayOperation runs a Transcript's Operation on m.
+func replayOperation(ctx context.Context, m BluetoothManager, operation string) (any, error) {
+	op, arg, _ := strings.Cut(operation, " ")
+	var mac MacAddress
+	if arg != "" && op != "Scan" {
+		var err error
+		if mac, err = ParseMacAddress(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op {
+	case "List":
+		return m.List(ctx)
+	case "Get":
+		return m.Get(ctx, mac)
+	case "IsConnected":
+		return m.IsConnected(ctx, mac)
+	case "Connect":
+		return nil, m.Connect(ctx, mac)
+	case "Disconnect":
+		return nil, m.Disconnect(ctx, mac)
+	case "Adapters":
+		return m.(AdapterManager).Adapters(ctx)
+	case "Scan":
+		duration, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, err
+		}
+		return m.(Scanner).Scan(ctx, duration)
+	}
+	return nil, errors.New("unknown operation " + op)
+}
+
+// TestReplayTranscripts replays every transcript in testdata/transcripts through its backend and compares what the
+// backend made of it with the matching .golden file. To turn a recording from a bug report into a test, add its
+// Operation and drop it in there.
+func TestReplayTranscripts(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "transcripts", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no transcripts found")
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			transcript, err := LoadTranscript(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			run := replayRunner(transcript)
+			var m BluetoothManager
+			switch transcript.Backend {
+			case "bluetoothctl":
+				m = newLinuxBluetoothctlBluetoothManager(run)
+			case "blueutil":
+				m = newMacosBlueutilBluetoothManager(run)
+			default:
+				t.Fatalf("can't replay transcripts for backend %q", transcript.Backend)
+			}
+
+			result, err := replayOperation(context.Background(), m, transcript.Operation)
+			var got transcriptResult
+			if err != nil {
+				got.Error = err.Error()
+			} else {
+				got.Result = result
+			}
+			j, err := json.MarshalIndent(got, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			j = append(j, '\n')
+
+			goldenPath := strings.TrimSuffix(path, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(goldenPath, j, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v (run `go test -update` to create it)", err)
+			}
+			if !bytes.Equal(j, want) {
+				t.Errorf("result doesn't match %s\ngot:\n%s\nwanted:\n%s", goldenPath, j, want)
+			}
+		})
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.json")
+	rec, err := newCommandRecorder(path, "bluetoothctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	run := rec.wrap(CommandRunnerFunc(func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		if args[0] == "connect" {
+			return []byte("Failed to connect\n"), &CommandError{
+				Command: cmd, Args: args, ExitCode: 1, Stderr: []byte("oops\n"), Err: errors.New("exit status 1"),
+			}
+		}
+		if args[0] == "scan" {
+			return nil, &CommandError{Command: cmd, Args: args, ExitCode: -1, Err: context.DeadlineExceeded}
+		}
+		return []byte("Device F8:4E:17:66:E8:55 WF-1000XM4\n"), nil
+	}))
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	calls := [][]string{{"devices"}, {"connect", "F8:4E:17:66:E8:55"}, {"scan", "on"}}
+	var recorded []result
+	for _, args := range calls {
+		output, err := run.Run(ctx, []byte("select 5C:F3:70:9B:2E:01\n"), "bluetoothctl", args...)
+		recorded = append(recorded, result{output, err})
+	}
+
+	transcript, err := LoadTranscript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript.Commands) != len(calls) {
+		t.Fatalf("got %d recorded commands, wanted %d", len(transcript.Commands), len(calls))
+	}
+	replay := replayRunner(transcript)
+	stdin := []byte("select 5C:F3:70:9B:2E:01\n")
+	// Replay out of order, the way concurrent commands might run.
+	for _, i := range []int{2, 0, 1} {
+		output, err := replay.Run(ctx, stdin, "bluetoothctl", calls[i]...)
+		if !bytes.Equal(output, recorded[i].output) || fmt.Sprint(err) != fmt.Sprint(recorded[i].err) {
+			t.Errorf("%v: got (%q, %v), wanted (%q, %v)", calls[i], output, err, recorded[i].output, recorded[i].err)
+		}
+	}
+	if _, err := replay.Run(ctx, stdin, "bluetoothctl", "devices"); err == nil {
+		t.Errorf("replayed a command more times than it was recorded")
+	}
+
+	// Errors have to classify the same way after a round trip.
+	_, err = replayRunner(transcript).Run(ctx, stdin, "bluetoothctl", "scan", "on")
+	if !errors.Is(bluetoothctlError(nil, err), ErrBackendTimeout) {
+		t.Errorf("got %v, wanted ErrBackendTimeout", err)
+	}
+}
+
+func TestRecordLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.json")
+	rec, err := newCommandRecorder(path, "bluetoothctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.maxSize = 1024
+	ctx := context.Background()
+	run := rec.wrap(CommandRunnerFunc(func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		return []byte("Device F8:4E:17:66:E8:55 WF-1000XM4\n"), nil
+	}))
+	for i := 0; i < 100; i++ {
+		if _, err := run.Run(ctx, nil, "bluetoothctl", "devices"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > rec.maxSize {
+		t.Errorf("got a %d byte transcript, wanted at most %d", info.Size(), rec.maxSize)
+	}
+	// What was recorded before the limit is still a valid transcript.
+	transcript, err := LoadTranscript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(transcript.Commands); n == 0 || n == 100 {
+		t.Errorf("got %d recorded commands, wanted some but not all", n)
+	}
+	if transcript.Backend != "bluetoothctl" {
+		t.Errorf("got backend %q, wanted bluetoothctl", transcript.Backend)
+	}
+}
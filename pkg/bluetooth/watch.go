@@ -0,0 +1,155 @@
+package bluetooth
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// A DeviceEventType says what happened to a device.
+type DeviceEventType string
+
+const (
+	DeviceAdded           DeviceEventType = "added"
+	DeviceRemoved         DeviceEventType = "removed"
+	DeviceConnected       DeviceEventType = "connected"
+	DeviceDisconnected    DeviceEventType = "disconnected"
+	DevicePropertyChanged DeviceEventType = "property_changed"
+)
+
+// A DeviceEvent is a change to one of the devices known to a BluetoothManager.
+type DeviceEvent struct {
+	Type    DeviceEventType
+	MacAddr MacAddress
+	// Name is the device's name, if the backend knows it.
+	Name string `json:",omitempty"`
+	// Property and Value are set for DevicePropertyChanged events. Property is the name of the BluetoothDevice field
+	// that changed, e.g. "Paired", and Value is its new value. For "Battery", Value is an int, or nil if the device
+	// stopped reporting its battery level.
+	Property string `json:",omitempty"`
+	Value    any    `json:",omitempty"`
+}
+
+// A DeviceWatcher can push changes to devices as they happen.
+type DeviceWatcher interface {
+	// Watch starts watching for changes and returns a channel of events. The channel is closed when ctx is done or
+	// the backend stops reporting events, e.g. because the process it was reading them from died. Devices that exist
+	// when Watch is called aren't reported as added.
+	Watch(ctx context.Context) (<-chan DeviceEvent, error)
+}
+
+// defaultPollInterval is how often pollDevices calls List for backends that don't implement DeviceWatcher.
+const defaultPollInterval = 5 * time.Second
+
+// pollDevices is the DeviceWatcher fallback for backends that can't push events. It calls List every interval and
+// reports the differences between successive results. Failed calls are logged and skipped.
+func pollDevices(ctx context.Context, m BluetoothManager, interval time.Duration) (<-chan DeviceEvent, error) {
+	devices, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan DeviceEvent)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			latest, err := m.List(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("polling for device changes: %v", err)
+				}
+				continue
+			}
+			for _, event := range diffDevices(devices, latest) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			devices = latest
+		}
+	}()
+	return events, nil
+}
+
+// diffDevices returns the events that describe how before turned into after.
+func diffDevices(before, after []BluetoothDevice) []DeviceEvent {
+	old := make(map[MacAddress]BluetoothDevice, len(before))
+	for _, device := range before {
+		old[device.MacAddr] = device
+	}
+	current := make(map[MacAddress]bool, len(after))
+
+	var events []DeviceEvent
+	for _, device := range after {
+		current[device.MacAddr] = true
+		previous, ok := old[device.MacAddr]
+		if !ok {
+			events = append(events, DeviceEvent{Type: DeviceAdded, MacAddr: device.MacAddr, Name: device.Name})
+			continue
+		}
+		events = append(events, diffDevice(previous, device)...)
+	}
+	for _, device := range before {
+		if !current[device.MacAddr] {
+			events = append(events, DeviceEvent{Type: DeviceRemoved, MacAddr: device.MacAddr, Name: device.Name})
+		}
+	}
+	return events
+}
+
+// diffDevice returns the events that describe how one device changed.
+func diffDevice(before, after BluetoothDevice) []DeviceEvent {
+	var events []DeviceEvent
+	if before.Connected != after.Connected {
+		event := DeviceEvent{Type: DeviceDisconnected, MacAddr: after.MacAddr, Name: after.Name}
+		if after.Connected {
+			event.Type = DeviceConnected
+		}
+		events = append(events, event)
+	}
+
+	properties := []struct {
+		name          string
+		before, after any
+	}{
+		{"Name", before.Name, after.Name},
+		{"Alias", before.Alias, after.Alias},
+		{"Class", before.Class, after.Class},
+		{"Icon", before.Icon, after.Icon},
+		{"Paired", before.Paired, after.Paired},
+		{"Trusted", before.Trusted, after.Trusted},
+		{"Blocked", before.Blocked, after.Blocked},
+		{"Battery", batteryValue(before), batteryValue(after)},
+	}
+	for _, p := range properties {
+		if p.before != p.after {
+			events = append(events, DeviceEvent{
+				Type:     DevicePropertyChanged,
+				MacAddr:  after.MacAddr,
+				Name:     after.Name,
+				Property: p.name,
+				Value:    p.after,
+			})
+		}
+	}
+	return events
+}
+
+// batteryValue returns the device's battery level as the Value of a "Battery" DevicePropertyChanged event: an int, or
+// nil if it isn't known.
+func batteryValue(d BluetoothDevice) any {
+	if d.Battery == nil {
+		return nil
+	}
+	return *d.Battery
+}
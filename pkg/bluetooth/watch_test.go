@@ -0,0 +1,100 @@
+package bluetooth
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiffDevices(t *testing.T) {
+	headphones := BluetoothDevice{Name: "WF-1000XM4", MacAddr: MustParseMacAddress("f8:4e:17:66:e8:55"), Paired: true}
+	speaker := BluetoothDevice{Name: "Bose QC35 II", MacAddr: MustParseMacAddress("cc:98:8b:20:7d:db"), Paired: true}
+	connected := headphones
+	connected.Connected = true
+	trusted := headphones
+	trusted.Trusted = true
+	battery := 85
+	charged := headphones
+	charged.Battery = &battery
+	sameCharge := headphones
+	sameCharge.Battery = new(int)
+	*sameCharge.Battery = 85
+
+	tests := []struct {
+		name          string
+		before, after []BluetoothDevice
+		want          []DeviceEvent
+	}{
+		{"unchanged", []BluetoothDevice{headphones}, []BluetoothDevice{headphones}, nil},
+		{"added", []BluetoothDevice{headphones}, []BluetoothDevice{headphones, speaker},
+			[]DeviceEvent{{Type: DeviceAdded, MacAddr: speaker.MacAddr, Name: speaker.Name}}},
+		{"removed", []BluetoothDevice{headphones, speaker}, []BluetoothDevice{headphones},
+			[]DeviceEvent{{Type: DeviceRemoved, MacAddr: speaker.MacAddr, Name: speaker.Name}}},
+		{"connected", []BluetoothDevice{headphones}, []BluetoothDevice{connected},
+			[]DeviceEvent{{Type: DeviceConnected, MacAddr: headphones.MacAddr, Name: headphones.Name}}},
+		{"disconnected", []BluetoothDevice{connected}, []BluetoothDevice{headphones},
+			[]DeviceEvent{{Type: DeviceDisconnected, MacAddr: headphones.MacAddr, Name: headphones.Name}}},
+		{"property changed", []BluetoothDevice{headphones}, []BluetoothDevice{trusted},
+			[]DeviceEvent{{Type: DevicePropertyChanged, MacAddr: headphones.MacAddr, Name: headphones.Name, Property: "Trusted", Value: true}}},
+		{"battery reported", []BluetoothDevice{headphones}, []BluetoothDevice{charged},
+			[]DeviceEvent{{Type: DevicePropertyChanged, MacAddr: headphones.MacAddr, Name: headphones.Name, Property: "Battery", Value: 85}}},
+		{"battery unchanged", []BluetoothDevice{charged}, []BluetoothDevice{sameCharge}, nil},
+		{"battery gone", []BluetoothDevice{charged}, []BluetoothDevice{headphones},
+			[]DeviceEvent{{Type: DevicePropertyChanged, MacAddr: headphones.MacAddr, Name: headphones.Name, Property: "Battery"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffDevices(tt.before, tt.after)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, wanted %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// listSequenceManager returns each of lists in turn from List, repeating the last one forever.
+type listSequenceManager struct {
+	BluetoothManager
+
+	mu    sync.Mutex
+	lists [][]BluetoothDevice
+}
+
+func (m *listSequenceManager) List(ctx context.Context) ([]BluetoothDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.lists[0]
+	if len(m.lists) > 1 {
+		m.lists = m.lists[1:]
+	}
+	return list, nil
+}
+
+func TestPollDevices(t *testing.T) {
+	headphones := BluetoothDevice{Name: "WF-1000XM4", MacAddr: MustParseMacAddress("f8:4e:17:66:e8:55")}
+	connected := headphones
+	connected.Connected = true
+	inner := &listSequenceManager{lists: [][]BluetoothDevice{{}, {headphones}, {connected}, {}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := pollDevices(ctx, inner, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []DeviceEventType
+	for event := range events {
+		got = append(got, event.Type)
+		if len(got) == 3 {
+			cancel()
+		}
+	}
+	want := []DeviceEventType{DeviceAdded, DeviceConnected, DeviceRemoved}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
@@ -3,21 +3,77 @@
 package config
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
 )
 
 const ConfigFileEnvVar = "DWMBT_CONFIG_FILE"
 const DefaultConfigPath = "/etc/dwmbt/config.json"
 
+// BackendEnvVar overrides the Backend set in the config file.
+const BackendEnvVar = "DWMBT_BLUETOOTH_BACKEND"
+
+// AdapterEnvVar overrides the Adapter set in the config file.
+const AdapterEnvVar = "DWMBT_BLUETOOTH_ADAPTER"
+
+// LogLevelEnvVar overrides the LogLevel set in the config file.
+const LogLevelEnvVar = "DWMBT_LOG_LEVEL"
+
+// RecordCommandsEnvVar overrides the RecordCommands set in the config file.
+const RecordCommandsEnvVar = "DWMBT_RECORD_COMMANDS"
+
 type Config struct {
 	ServeAddr string
-	AuthKey   string `json:",omitempty"` // TODO: implement auth
-	Peers     []struct {
+	// Backend names the Bluetooth backend to use (e.g. "bluez", "bluetoothctl" or "blueutil"). If it's empty, the
+	// first backend that works on this host is used.
+	Backend string `json:",omitempty"`
+	// Adapter pins dwmbt to the Bluetooth adapter with this address, for hosts with more than one. If it's empty, the
+	// system's default adapter is used.
+	Adapter string `json:",omitempty"`
+	// CacheInterval is how often the daemon refreshes its cached list of devices, as a duration like "30s". If it's
+	// empty, bluetooth.DefaultCacheInterval is used.
+	CacheInterval string `json:",omitempty"`
+	// ConnectAttempts is how many times to try connecting to a device that's busy or doesn't come up, and
+	// ConnectBackoff how long to wait before the first retry, as a duration like "500ms". It doubles for each retry
+	// after that. If they're unset, bluetooth.DefaultConnectPolicy is used.
+	ConnectAttempts int    `json:",omitempty"`
+	ConnectBackoff  string `json:",omitempty"`
+	// BluetoothctlSession makes the bluetoothctl backend keep one bluetoothctl running and send it commands, rather
+	// than starting a new one for every command. It makes requests much faster, but is new, so it's off by default.
+	BluetoothctlSession bool `json:",omitempty"`
+	// AllowDevices and DenyDevices limit which devices dwmbt will operate on, by MAC address or alias. If AllowDevices
+	// is empty, every device the host knows about is allowed. DenyDevices takes precedence.
+	AllowDevices []string `json:",omitempty"`
+	DenyDevices  []string `json:",omitempty"`
+	// LogLevel is the minimum level the daemon logs at: "debug", "info", "warn" or "error". The default is "info".
+	// At "debug", every external command the Bluetooth backend runs is logged.
+	LogLevel string `json:",omitempty"`
+	// RecordCommands is the path of a file to record the external commands run by the Bluetooth backend to. Attach
+	// the file to bug reports about devices being listed wrong.
+	RecordCommands string `json:",omitempty"`
+	// AuthKey is the secret requests to the daemon must be signed with, by its peers and by the commands that talk to
+	// it. If it's empty, anyone who can reach the daemon can control its devices.
+	AuthKey string `json:",omitempty"`
+	// HealthPath, if set, is a path like "/health" where the daemon answers GET requests without a signature, for
+	// monitoring. Every other request must be signed.
+	HealthPath string `json:",omitempty"`
+	Peers      []struct {
 		Addr        string
 		DisplayName string `json:",omitempty"`
-		AuthKey     string `json:",omitempty"`
+		// AuthKey is the peer's AuthKey, if it's different from ours.
+		AuthKey string `json:",omitempty"`
 	} `json:",omitempty"`
 }
 
@@ -58,9 +114,120 @@ func setConfigDefaults(c *Config) {
 	}
 }
 
+// LoadConfig loads the config file from GetConfigPath, if there is one, and applies environment overrides and defaults.
 func LoadConfig() (Config, error) {
-	// TODO: return LoadConfigFile(GetConfigPath())
-	c := Config{}
+	c, err := LoadConfigFile(GetConfigPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		c = Config{}
+	} else if err != nil {
+		return Config{}, err
+	}
+
+	if backend := os.Getenv(BackendEnvVar); backend != "" {
+		c.Backend = backend
+	}
+	if adapter := os.Getenv(AdapterEnvVar); adapter != "" {
+		c.Adapter = adapter
+	}
+	if level := os.Getenv(LogLevelEnvVar); level != "" {
+		c.LogLevel = level
+	}
+	if record := os.Getenv(RecordCommandsEnvVar); record != "" {
+		c.RecordCommands = record
+	}
+	if c.Adapter != "" {
+		if _, err := bluetooth.ParseMacAddress(c.Adapter); err != nil {
+			return Config{}, fmt.Errorf("invalid Adapter: %w", err)
+		}
+	}
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return Config{}, fmt.Errorf("invalid LogLevel: %w", err)
+		}
+	}
+	if c.CacheInterval != "" {
+		if interval, err := time.ParseDuration(c.CacheInterval); err != nil || interval <= 0 {
+			return Config{}, fmt.Errorf("invalid CacheInterval %q: must be a positive duration like \"30s\"", c.CacheInterval)
+		}
+	}
+	if c.ConnectAttempts < 0 {
+		return Config{}, fmt.Errorf("invalid ConnectAttempts %d: must be positive", c.ConnectAttempts)
+	}
+	if c.ConnectBackoff != "" {
+		if backoff, err := time.ParseDuration(c.ConnectBackoff); err != nil || backoff <= 0 {
+			return Config{}, fmt.Errorf("invalid ConnectBackoff %q: must be a positive duration like \"500ms\"", c.ConnectBackoff)
+		}
+	}
+	if c.HealthPath != "" && !strings.HasPrefix(c.HealthPath, "/") {
+		return Config{}, fmt.Errorf("invalid HealthPath %q: must start with \"/\"", c.HealthPath)
+	}
 	setConfigDefaults(&c)
 	return c, nil
 }
+
+// BluetoothOptions returns the options for bluetooth.NewBluetoothManagerWithOptions. LoadConfig has already checked
+// that Adapter and ConnectBackoff are valid.
+func (c Config) BluetoothOptions() bluetooth.Options {
+	opts := bluetooth.Options{
+		Backend:             c.Backend,
+		Policy:              bluetooth.DevicePolicy{Allow: c.AllowDevices, Deny: c.DenyDevices},
+		RecordCommands:      c.RecordCommands,
+		BluetoothctlSession: c.BluetoothctlSession,
+	}
+	opts.Connect.Attempts = c.ConnectAttempts
+	opts.Connect.Backoff, _ = time.ParseDuration(c.ConnectBackoff)
+	if c.Adapter != "" {
+		opts.Adapter, _ = bluetooth.ParseMacAddress(c.Adapter)
+	}
+	return opts
+}
+
+// CacheRefreshInterval returns CacheInterval as a time.Duration, or 0 (meaning the default) if it isn't set. LoadConfig
+// has already checked that it's valid.
+func (c Config) CacheRefreshInterval() time.Duration {
+	interval, _ := time.ParseDuration(c.CacheInterval)
+	return interval
+}
+
+// SlogLevel returns LogLevel as a slog.Level, or slog.LevelInfo if it isn't set. LoadConfig has already checked that
+// it's valid.
+func (c Config) SlogLevel() slog.Level {
+	level := slog.LevelInfo
+	if c.LogLevel != "" {
+		_ = level.UnmarshalText([]byte(c.LogLevel))
+	}
+	return level
+}
+
+// InstanceIDFile is the name of the file next to the config file that holds the daemon's instance ID.
+const InstanceIDFile = "instance-id"
+
+// LoadInstanceID returns the ID that identifies this daemon to its peers, so it can tell when a peer is itself. It's
+// generated the first time and saved next to the config file, so it stays the same across restarts. If the saved ID
+// can't be read, or a new one can't be saved, LoadInstanceID still returns a new ID, along with the error, which works
+// until the next restart.
+func LoadInstanceID() (string, error) {
+	path := filepath.Join(filepath.Dir(GetConfigPath()), InstanceIDFile)
+	b, readErr := os.ReadFile(path)
+	if readErr == nil && len(bytes.TrimSpace(b)) > 0 {
+		return string(bytes.TrimSpace(b)), nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	s := hex.EncodeToString(id)
+	if readErr != nil && !errors.Is(readErr, fs.ErrNotExist) {
+		// Don't overwrite a file we couldn't read.
+		return s, readErr
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return s, err
+	}
+	if err := os.WriteFile(path, []byte(s+"\n"), 0o600); err != nil {
+		return s, err
+	}
+	return s, nil
+}
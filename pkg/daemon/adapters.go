@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+func (d Daemon) handleAdapters(w http.ResponseWriter, r *http.Request) {
+	adapterManager, ok := bluetooth.Capability[bluetooth.AdapterManager](d.BluetoothManager)
+	if !ok {
+		writeError(w, bluetooth.ErrUnsupported, "error listing adapters")
+		return
+	}
+	adapters, err := adapterManager.Adapters(r.Context())
+	if err != nil {
+		writeError(w, err, "error listing adapters")
+		return
+	}
+	writeJSON(w, adapters)
+}
+
+func (d Daemon) handleAdapterPower(w http.ResponseWriter, r *http.Request) {
+	macAddr, ok := macAddrParam(w, r)
+	if !ok {
+		return
+	}
+	powered, err := strconv.ParseBool(r.FormValue("powered"))
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "powered param must be true or false")
+		return
+	}
+
+	adapterManager, ok := bluetooth.Capability[bluetooth.AdapterManager](d.BluetoothManager)
+	if !ok {
+		writeError(w, bluetooth.ErrUnsupported, "failed to set adapter power")
+		return
+	}
+	op := "power off"
+	if powered {
+		op = "power on"
+	}
+	d.startOperation(w, r, op, macAddr, func(ctx context.Context) error {
+		return adapterManager.SetAdapterPowered(ctx, macAddr, powered)
+	})
+}
@@ -0,0 +1,199 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requests between daemons are signed with an HMAC-SHA256 of the method, the path and query, a timestamp, a nonce and
+// a hash of the body, keyed with the receiving daemon's AuthKey. The signature, timestamp and nonce go in these
+// headers.
+const (
+	SignatureHeader = "X-Dwmbt-Signature"
+	TimestampHeader = "X-Dwmbt-Timestamp"
+	NonceHeader     = "X-Dwmbt-Nonce"
+)
+
+// DefaultAuthWindow is how far a signed request's timestamp can be from our clock, either way, before it's rejected.
+const DefaultAuthWindow = time.Minute
+
+// maxSignedBodySize is the largest request body we'll read to check its signature. Our requests are small forms.
+const maxSignedBodySize = 1 << 20
+
+// signature returns the hex-encoded signature of a request with the given parts.
+func signature(key []byte, method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, requestURI, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest sets the signature headers on req, whose body is body, as of now.
+func signRequest(req *http.Request, key []byte, body []byte, now time.Time, nonce string) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, signature(key, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+}
+
+// A SigningTransport is an http.RoundTripper that signs every request with Key before sending it with Base, or
+// http.DefaultTransport if Base is nil.
+type SigningTransport struct {
+	Key  string
+	Base http.RoundTripper
+}
+
+// NewSigningClient returns a new http.Client whose requests are signed with key. If key is empty, they aren't signed.
+func NewSigningClient(key string) *http.Client {
+	if key == "" {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: &SigningTransport{Key: key}}
+}
+
+func (t *SigningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	nonce, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers mustn't change the request they're given.
+	signed := req.Clone(req.Context())
+	if req.Body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+		signed.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	signRequest(signed, []byte(t.Key), body, time.Now(), nonce)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(signed)
+}
+
+// nonceCache remembers the nonces of the signed requests we've accepted until their timestamps fall out of the
+// window, so a captured request can't be replayed.
+type nonceCache struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// expires holds when each nonce can be forgotten.
+	expires map[string]time.Time
+}
+
+func newNonceCache(window time.Duration) *nonceCache {
+	return &nonceCache{window: window, expires: map[string]time.Time{}}
+}
+
+// add records the nonce of a request sent at timestamp, returning false if it's already been used.
+func (c *nonceCache) add(nonce string, timestamp, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, expires := range c.expires {
+		if now.After(expires) {
+			delete(c.expires, n)
+		}
+	}
+	if _, ok := c.expires[nonce]; ok {
+		return false
+	}
+	c.expires[nonce] = timestamp.Add(c.window)
+	return true
+}
+
+// verifyRequest checks the signature headers of r against key, and that it isn't a replay. It reads the body, which
+// authenticate has already capped at maxSignedBodySize, and replaces it so handlers can still read it.
+func (d Daemon) verifyRequest(r *http.Request, key []byte, now time.Time) error {
+	sig, timestamp, nonce := r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+	if sig == "" || timestamp == "" || nonce == "" {
+		return errors.New("request isn't signed")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	sent := time.Unix(unix, 0)
+	if skew := now.Sub(sent).Abs(); skew > d.AuthWindow {
+		return fmt.Errorf("timestamp is %v away from ours (check the clocks)", skew.Round(time.Second))
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't read body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	want := signature(key, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return errors.New("bad signature")
+	}
+	// Only remember nonces from validly signed requests, so nobody without the key can fill the cache.
+	if !d.nonces.add(nonce, sent, now) {
+		return errors.New("request has already been used")
+	}
+	return nil
+}
+
+// authenticate rejects requests that aren't signed with AuthKey, except for the health check at HealthPath. If there's
+// no AuthKey, every request is let through.
+func (d Daemon) authenticate(next http.Handler) http.Handler {
+	if d.AuthKey == "" {
+		return next
+	}
+	key := []byte(d.AuthKey)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.HealthPath != "" && r.Method == http.MethodGet && r.URL.Path == d.HealthPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The body has to be read to check the signature, before anything knows who sent it, so don't read much.
+		r.Body = http.MaxBytesReader(w, r.Body, maxSignedBodySize)
+		if err := d.verifyRequest(r, key, time.Now()); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeErrorResponse(w, http.StatusRequestEntityTooLarge, ErrCodeBadRequest, err.Error())
+				return
+			}
+			writeErrorResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleHealth reports that the daemon is up. It's served at HealthPath without authentication, so it mustn't say
+// anything else.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// peerClient returns the client for requests to peer, which signs them with the peer's AuthKey, or ours if it doesn't
+// have its own.
+func (d Daemon) peerClient(peer Peer) *http.Client {
+	if peer.AuthKey != "" {
+		return NewSigningClient(peer.AuthKey)
+	}
+	return NewSigningClient(d.AuthKey)
+}
@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/bluetoothtest"
+)
+
+// newAuthHandler returns the handler of a daemon that wants requests signed with key, with a health check at /health,
+// and the given peers.
+func newAuthHandler(t *testing.T, key string, btm bluetooth.BluetoothManager, peers ...Peer) http.Handler {
+	t.Helper()
+	d := &Daemon{
+		DisplayName:      "laptop",
+		BluetoothManager: btm,
+		Peers:            peers,
+		RequestTimeout:   time.Second,
+		PeerTimeout:      100 * time.Millisecond,
+		AuthKey:          key,
+		HealthPath:       "/health",
+	}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	return d.setupHandler()
+}
+
+// signedRequest returns a request signed with key as of sent. body is sent, but signed is what's signed.
+func signedRequest(method, target, key, body, signed string, sent time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	signRequest(r, []byte(key), []byte(signed), sent, nonce)
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := newAuthHandler(t, "secret", bluetoothtest.NewFakeManager(headphones, speaker))
+	now := time.Now()
+	late, early := now.Add(-2*time.Minute), now.Add(2*time.Minute)
+	form := "macAddr=" + speaker.MacAddr.String()
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"signed", signedRequest("GET", "/_self/list", "secret", "", "", now, "1"), http.StatusOK},
+		{"signed POST", signedRequest("POST", "/_self/connect", "secret", form, form, now, "2"), http.StatusAccepted},
+		{"unsigned", httptest.NewRequest("GET", "/_self/list", nil), http.StatusUnauthorized},
+		{"unsigned unknown path", httptest.NewRequest("GET", "/nope", nil), http.StatusUnauthorized},
+		{"wrong key", signedRequest("GET", "/_self/list", "guess", "", "", now, "3"), http.StatusUnauthorized},
+		{"old", signedRequest("GET", "/_self/list", "secret", "", "", late, "4"), http.StatusUnauthorized},
+		{"future", signedRequest("GET", "/_self/list", "secret", "", "", early, "5"), http.StatusUnauthorized},
+		{
+			"body changed",
+			signedRequest("POST", "/_self/connect", "secret", form, "macAddr=x", now, "6"),
+			http.StatusUnauthorized,
+		},
+		{"health", httptest.NewRequest("GET", "/health", nil), http.StatusOK},
+		{"POST health", httptest.NewRequest("POST", "/health", nil), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, wanted %d (body %q)", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusUnauthorized && errorCode(w) != ErrCodeUnauthorized {
+				t.Errorf("got error code %q, wanted %q", errorCode(w), ErrCodeUnauthorized)
+			}
+		})
+	}
+
+	// Changing the path or query of a signed request breaks the signature too.
+	r := signedRequest("GET", "/_self/list", "secret", "", "", now, "7")
+	r.URL.RawQuery = "refresh=true"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a changed query, wanted 401", w.Code)
+	}
+}
+
+func TestAuthenticateLargeBody(t *testing.T) {
+	h := newAuthHandler(t, "secret", bluetoothtest.NewFakeManager(headphones))
+	body := "macAddr=" + strings.Repeat("x", maxSignedBodySize)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signedRequest("POST", "/_self/connect", "secret", body, body, time.Now(), "1"))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, wanted 413 (body %q)", w.Code, w.Body.String())
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	d := &Daemon{BluetoothManager: bluetoothtest.NewFakeManager(), AuthKey: "secret"}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	server := d.newServer()
+	if server.ReadHeaderTimeout == 0 || server.ReadTimeout == 0 {
+		t.Errorf("got ReadHeaderTimeout %v and ReadTimeout %v, wanted both set", server.ReadHeaderTimeout,
+			server.ReadTimeout)
+	}
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	h := newAuthHandler(t, "secret", bluetoothtest.NewFakeManager(headphones))
+	now := time.Now()
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, signedRequest("GET", "/_self/list", "secret", "", "", now, "same"))
+		if w.Code != want {
+			t.Errorf("request %d: got status %d, wanted %d", i+1, w.Code, want)
+		}
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache(time.Minute)
+	sent := time.Now()
+	if !c.add("a", sent, sent) {
+		t.Errorf("got false for a new nonce, wanted true")
+	}
+	if c.add("a", sent, sent.Add(30*time.Second)) {
+		t.Errorf("got true for a reused nonce, wanted false")
+	}
+	// Once the timestamp is out of the window the request would be rejected anyway, so the nonce can go.
+	c.add("b", sent, sent.Add(2*time.Minute))
+	if _, ok := c.expires["a"]; ok {
+		t.Errorf("nonce kept after it expired")
+	}
+}
+
+func TestSignedPeers(t *testing.T) {
+	desktop := newTestPeer(t, "desktop", newAuthHandler(t, "desktop-key", bluetoothtest.NewFakeManager(speaker)))
+	desktop.AuthKey = "desktop-key"
+	// This one shares our key.
+	tablet := newTestPeer(t, "tablet", newAuthHandler(t, "laptop-key", bluetoothtest.NewFakeManager()))
+	stranger := newTestPeer(t, "stranger", newAuthHandler(t, "other-key", bluetoothtest.NewFakeManager()))
+
+	h := newAuthHandler(t, "laptop-key", bluetoothtest.NewFakeManager(headphones), desktop, tablet, stranger)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signedRequest("GET", "/list", "laptop-key", "", "", time.Now(), "1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, wanted 200 (body %q)", w.Code, w.Body.String())
+	}
+	var resp ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+
+	got := map[string]PeerStatus{}
+	for _, host := range resp.Hosts {
+		got[host.Host] = host.Status
+	}
+	want := map[string]PeerStatus{
+		"laptop":   PeerStatusOK,
+		"desktop":  PeerStatusOK,
+		"tablet":   PeerStatusOK,
+		"stranger": PeerStatusAuthFailed,
+	}
+	for host, status := range want {
+		if got[host] != status {
+			t.Errorf("%s: got status %q, wanted %q", host, got[host], status)
+		}
+	}
+}
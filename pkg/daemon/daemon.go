@@ -3,12 +3,11 @@ package daemon
 import (
 	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"log"
 	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
@@ -19,29 +18,132 @@ const (
 	DefaultShutdownTimeout = 5 * time.Second
 )
 
+// defaultPeerTimeoutFraction is the fraction of the request timeout a peer gets to answer by default, which leaves
+// time to send a partial answer when one doesn't.
+const defaultPeerTimeoutFraction = 0.75
+
+// A Peer is another dwmbt daemon whose devices we can see and control.
 type Peer struct {
+	// Addr is the peer's host and port, e.g. "desktop.lan:8080".
 	Addr        string
 	DisplayName string
+	// AuthKey is the key the peer checks our requests' signatures with. If it's empty, the daemon's own AuthKey is
+	// used.
+	AuthKey string
 }
 
 type Daemon struct {
-	ServeAddr        string
+	ServeAddr string
+	// InstanceID identifies this daemon to its peers. It should stay the same across restarts, but if it's empty, a
+	// random one is used.
+	InstanceID string
+	// DisplayName is this host's name in responses that cover every host. It defaults to the hostname.
+	DisplayName      string
 	BluetoothManager bluetooth.BluetoothManager
 	Peers            []Peer
 	RequestTimeout   time.Duration
-	ShutdownTimeout  time.Duration
+	// PeerTimeout is how long each host gets to answer when a request fans out to every host. It should be shorter
+	// than RequestTimeout, and defaults to three quarters of it.
+	PeerTimeout time.Duration
+	// PeerCheckInterval is how often RunServer checks that the peers are compatible dwmbt daemons.
+	PeerCheckInterval time.Duration
+	// TakeTimeout is how long POST /take has to move a device to this host. It defaults to long enough for a peer to
+	// disconnect the device and for BluetoothManager to connect it with Connect.
+	TakeTimeout time.Duration
+	// Connect is the ConnectPolicy BluetoothManager's backend connects with. Only the default TakeTimeout uses it.
+	Connect bluetooth.ConnectPolicy
+	// OperationTimeout, OperationRetention and MaxOperations limit the background operations started by
+	// state-changing requests. See Operation.
+	OperationTimeout   time.Duration
+	OperationRetention time.Duration
+	MaxOperations      int
+	ShutdownTimeout    time.Duration
+	// AuthKey is the key requests to this daemon must be signed with, and that it signs requests to peers with by
+	// default. If it's empty, requests aren't checked at all.
+	AuthKey string
+	// AuthWindow is how far a signed request's timestamp can be from our clock.
+	AuthWindow time.Duration
+	// HealthPath, if set, is where the daemon answers GET requests without checking their signature, for monitoring.
+	HealthPath string
+
+	operations *operationTracker
+	peerCheck  *peerChecker
+	nonces     *nonceCache
 }
 
-func InitDaemon(d *Daemon) {
+func InitDaemon(d *Daemon) error {
 	if d.BluetoothManager == nil {
-		d.BluetoothManager = bluetooth.NewBluetoothManager()
+		btm, err := bluetooth.NewBluetoothManager("")
+		if err != nil {
+			return err
+		}
+		d.BluetoothManager = btm
 	}
 	if d.RequestTimeout == 0 {
 		d.RequestTimeout = DefaultRequestTimeout
 	}
+	if d.PeerTimeout == 0 {
+		d.PeerTimeout = time.Duration(float64(d.RequestTimeout) * defaultPeerTimeoutFraction)
+	}
+	if d.DisplayName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		d.DisplayName = hostname
+	}
 	if d.ShutdownTimeout == 0 {
 		d.ShutdownTimeout = DefaultShutdownTimeout
 	}
+	if d.OperationTimeout == 0 {
+		d.OperationTimeout = DefaultOperationTimeout
+	}
+	if d.OperationRetention == 0 {
+		d.OperationRetention = DefaultOperationRetention
+	}
+	if d.MaxOperations == 0 {
+		d.MaxOperations = DefaultMaxOperations
+	}
+	if d.TakeTimeout == 0 {
+		d.TakeTimeout = takeTimeout(d.RequestTimeout, d.PeerTimeout, d.OperationTimeout, d.Connect)
+	}
+	if d.PeerCheckInterval == 0 {
+		d.PeerCheckInterval = DefaultPeerCheckInterval
+	}
+	if d.InstanceID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		d.InstanceID = id
+	}
+	if d.AuthWindow == 0 {
+		d.AuthWindow = DefaultAuthWindow
+	}
+	if d.nonces == nil {
+		d.nonces = newNonceCache(d.AuthWindow)
+	}
+	if d.operations == nil {
+		d.operations = newOperationTracker(d)
+	}
+	if d.peerCheck == nil {
+		d.peerCheck = newPeerChecker()
+	}
+	return nil
+}
+
+// DefaultTakeTimeout returns the TakeTimeout of a daemon with the default timeouts whose backend connects with the
+// given policy.
+func DefaultTakeTimeout(connect bluetooth.ConnectPolicy) time.Duration {
+	peerTimeout := time.Duration(float64(DefaultRequestTimeout) * defaultPeerTimeoutFraction)
+	return takeTimeout(DefaultRequestTimeout, peerTimeout, DefaultOperationTimeout, connect)
+}
+
+// takeTimeout returns how long the steps of POST /take can take between them: checking the device and finding the
+// peers that have it, a peer starting and finishing a disconnect operation and confirming the device is gone, and
+// connecting it here, each attempt of which gets a request's worth of time.
+func takeTimeout(request, peer, operation time.Duration, connect bluetooth.ConnectPolicy) time.Duration {
+	return request + peer + request + operation + peer + connect.MaxDuration(request)
 }
 
 func (d Daemon) setupMux() http.Handler {
@@ -49,103 +151,171 @@ func (d Daemon) setupMux() http.Handler {
 
 	// /_self/ endpoints only get data about our own devices
 
-	// GET /_self/list lists Bluetooth devices connected to this host
-	mux.HandleFunc("GET /_self/list", func(w http.ResponseWriter, r *http.Request) {
-		devices, err := d.BluetoothManager.List(r.Context())
-		if err != nil {
-			slog.Error("d.BluetoothManager.List", "err", err)
-			http.Error(w, "error listing bluetooth devices", http.StatusInternalServerError)
-			return
-		}
+	// GET /_self/info describes this daemon: who it is, what version of dwmbt and of the API between daemons it runs,
+	// and what its Bluetooth backend can do. Daemons check each other with it before talking.
+	mux.HandleFunc("GET /_self/info", d.handleInfo)
 
-		j, err := json.MarshalIndent(devices, "", "  ")
-		if err != nil {
-			slog.Error("json.MarshalIndent", "err", err)
-			http.Error(w, "error formatting json", http.StatusInternalServerError)
-			return
-		}
+	// GET /_self/list lists Bluetooth devices connected to this host. It takes an optional form parameter `refresh`
+	// (true or false) that bypasses the device cache, if there is one.
+	mux.HandleFunc("GET /_self/list", d.handleSelfList)
 
-		_, err = w.Write(j)
-		if err != nil {
-			slog.Error("w.Write", "err", err)
-			return
-		}
-	})
+	// State-changing /_self/ endpoints reply straight away with 202 Accepted and an Operation, and do the work in the
+	// background, so a host asking several peers to do something doesn't have to wait for each of them in turn. They
+	// take an optional form parameter `callback`, a URL on one of our peers that the finished Operation is POSTed to.
+
+	// GET /operations/{id} reports the status of an operation.
+	mux.HandleFunc("GET /operations/{id}", d.handleOperation)
 
 	// POST /_self/disconnect takes a form parameter `macAddr` and disconnects the device with that MAC address if
-	// possible.
+	// possible. If the device isn't connected, there's nothing to do, so it answers 200 OK with an Operation that has
+	// already succeeded rather than starting one.
 	mux.HandleFunc("POST /_self/disconnect", func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseForm()
-		if err != nil {
-			slog.Error("r.ParseForm", "err", err)
-			http.Error(w, "could not parse request", http.StatusBadRequest)
-			return
-		}
-		macAddr := r.FormValue("macAddr")
-		if macAddr == "" {
-			http.Error(w, "macAddr param missing or blank", http.StatusBadRequest)
+		macAddr, ok := macAddrParam(w, r)
+		if !ok {
 			return
 		}
 
 		// confirm the device is known and connected
-		_, err = d.BluetoothManager.Get(r.Context(), macAddr)
-		if errors.Is(err, bluetooth.ErrInvalidMac) {
-			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		device, err := d.BluetoothManager.Get(r.Context(), macAddr)
+		if err != nil {
+			writeError(w, err, "failed to get device")
 			return
 		}
-		if err != nil {
-			// TODO: this probably means the device wasn't found, so we should
-			// check the result and return a 404 instead of an internal server
-			// error unless something actually went wrong
-			slog.Error("d.BluetoothManager.Get", "err", err)
-			http.Error(w, "failed to get device", http.StatusInternalServerError)
+		if !device.Connected {
+			writeNoOp(w, "disconnect", macAddr, "not connected")
 			return
 		}
+		d.startOperation(w, r, "disconnect", macAddr, func(ctx context.Context) error {
+			return d.BluetoothManager.Disconnect(ctx, macAddr)
+		})
+	})
 
-		// TODO: the TimeoutHandler used to wrap the mux should prevent this
-		// from hanging forever, but it would be better to support a more async
-		// approach. For example, if host A tells hosts B, C, and D to
-		// disconnect device X, instead of waiting for the requests to complete
-		// on each host, B, C, and D should reply immediately with either "that
-		// device isn't connected" or "okay, disconnecting" and, in the latter
-		// case, start disconnection on their end. Then, when disconnection
-		// finishes, they should send another message to A saying "device X has
-		// been disconnected".
-		err = d.BluetoothManager.Disconnect(r.Context(), macAddr)
-		if err != nil {
-			http.Error(w, "failed to disconnect", http.StatusInternalServerError)
+	// POST /_self/connect takes a form parameter `macAddr` and connects the device with that MAC address. The
+	// operation finishes once it's actually connected.
+	mux.HandleFunc("POST /_self/connect", func(w http.ResponseWriter, r *http.Request) {
+		macAddr, ok := macAddrParam(w, r)
+		if !ok {
 			return
 		}
-		fmt.Fprintf(w, "disconnected %q\n", macAddr) // TODO: return JSON
+		d.startOperation(w, r, "connect", macAddr, func(ctx context.Context) error {
+			return d.BluetoothManager.Connect(ctx, macAddr)
+		})
 	})
 
+	// POST /_self/pair, /_self/trust, /_self/untrust, /_self/remove, /_self/block and /_self/unblock take a form
+	// parameter `macAddr` and do what they say to the device with that MAC address. They return 501 Not Implemented if
+	// the Bluetooth backend doesn't support the operation.
+	for _, action := range d.deviceActions() {
+		mux.HandleFunc("POST /_self/"+action.name, d.handleDeviceAction(action))
+	}
+
+	// GET /_self/adapters lists this host's Bluetooth adapters.
+	mux.HandleFunc("GET /_self/adapters", d.handleAdapters)
+
+	// POST /_self/adapters/power takes form parameters `macAddr` and `powered` (true or false) and turns the adapter
+	// with that address on or off.
+	mux.HandleFunc("POST /_self/adapters/power", d.handleAdapterPower)
+
 	// top-level endpoints get data about our own devices and all peers
 
-	// GET /list returns a list of all devices connected to this instance and its active peers.
-	mux.HandleFunc("GET /list", func(w http.ResponseWriter, r *http.Request) {
-		// TODO: list devices connected to this instance and all peers
-		http.Error(w, "TODO", http.StatusNotImplemented)
-	})
+	// GET /list returns a list of all devices connected to this instance and its active peers, grouped by host, with
+	// each peer's status. Peers that fail or time out are reported rather than failing the whole request.
+	mux.HandleFunc("GET /list", d.handleList)
 
 	return mux
 }
 
+// setupHandler wraps the mux in timeout handlers so requests won't hang forever, and checks that requests are signed.
+// Scans are expected to take longer than other requests, so they get their own, longer timeout.
+func (d Daemon) setupHandler() http.Handler {
+	h := http.NewServeMux()
+	h.Handle("/", http.TimeoutHandler(d.setupMux(), d.RequestTimeout, "timeout"))
+	// POST /_self/scan takes an optional form parameter `duration` (e.g. "10s") and returns the devices found by
+	// scanning for that long.
+	scanTimeout := MaxScanDuration + d.RequestTimeout
+	h.Handle("POST /_self/scan", http.TimeoutHandler(http.HandlerFunc(d.handleScan), scanTimeout, "timeout"))
+	// POST /take takes a form parameter `macAddr` and moves the device with that MAC address to this host,
+	// disconnecting it from whichever peers have it first. Connecting can take a few attempts, so it gets its own,
+	// longer timeout too.
+	h.Handle("POST /take", http.TimeoutHandler(http.HandlerFunc(d.handleTake), d.TakeTimeout, "timeout"))
+	// GET HealthPath says the daemon is up. It's the only endpoint that doesn't need a signed request.
+	if d.HealthPath != "" {
+		h.HandleFunc("GET "+d.HealthPath, handleHealth)
+	}
+	return d.authenticate(h)
+}
+
+// writeJSON sends v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus sends v as an indented JSON response with the given status.
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		slog.Error("json.MarshalIndent", "err", err)
+		writeErrorResponse(w, http.StatusInternalServerError, ErrCodeInternal, "error formatting json")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(j)
+	if err != nil {
+		slog.Error("w.Write", "err", err)
+		return
+	}
+}
+
+// macAddrParam parses the `macAddr` form parameter. If it's missing or invalid, macAddrParam writes an error response
+// and returns false.
+func macAddrParam(w http.ResponseWriter, r *http.Request) (bluetooth.MacAddress, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		slog.Error("r.ParseForm", "err", err)
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "could not parse request")
+		return bluetooth.MacAddress{}, false
+	}
+	if r.FormValue("macAddr") == "" {
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "macAddr param missing or blank")
+		return bluetooth.MacAddress{}, false
+	}
+	macAddr, err := bluetooth.ParseMacAddress(r.FormValue("macAddr"))
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeInvalidMac, "invalid MAC address")
+		return bluetooth.MacAddress{}, false
+	}
+	return macAddr, true
+}
+
+// newServer returns the server for the daemon's handler. Requests are signed over their body, so the whole request has
+// to be read before we know who sent it; the read timeouts stop slow clients from tying up connections meanwhile.
+func (d Daemon) newServer() *http.Server {
+	return &http.Server{
+		Addr:              d.ServeAddr,
+		Handler:           d.setupHandler(),
+		ReadHeaderTimeout: d.RequestTimeout,
+		ReadTimeout:       d.RequestTimeout,
+	}
+}
+
 func (d *Daemon) RunServer(ctx context.Context) {
 	if d == nil {
 		log.Panic("daemon is nil")
 	}
-	InitDaemon(d)
+	if err := InitDaemon(d); err != nil {
+		log.Panicf("InitDaemon failed: %v", err)
+	}
 
-	mux := d.setupMux()
+	server := d.newServer()
 
-	// Wrap the mux in a timeout handler so requests won't hang forever.
-	h := http.TimeoutHandler(mux, d.RequestTimeout, "timeout")
-	server := &http.Server{
-		Addr:    d.ServeAddr,
-		Handler: h,
+	slog.Info("starting server", "server", server)
+	if d.AuthKey == "" {
+		slog.Warn("no AuthKey set - anyone who can reach the daemon can control its devices")
 	}
 
-	slog.Info("starting server", "server", server)
+	go d.checkPeers(ctx)
 
 	go func() {
 		ln, err := net.Listen("tcp", server.Addr)
@@ -172,4 +342,9 @@ func (d *Daemon) RunServer(ctx context.Context) {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		slog.Error("server.Close", "err", err)
 	}
+	// Let operations that are already running finish, so a device isn't left half-connected, and their callbacks
+	// get sent.
+	if err := d.operations.waitContext(shutdownCtx); err != nil {
+		slog.Warn("stopped waiting for operations to finish", "err", err)
+	}
 }
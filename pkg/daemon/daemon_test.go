@@ -0,0 +1,324 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/bluetoothtest"
+)
+
+var (
+	headphones = bluetooth.BluetoothDevice{
+		Name: "WF-1000XM4", MacAddr: bluetooth.MustParseMacAddress("f8:4e:17:66:e8:55"), Paired: true, Connected: true,
+	}
+	speaker = bluetooth.BluetoothDevice{
+		Name: "Bose QC35 II", MacAddr: bluetooth.MustParseMacAddress("cc:98:8b:20:7d:db"), Paired: true,
+	}
+	nearby = bluetooth.DiscoveredDevice{Name: "MX Keys", MacAddr: bluetooth.MustParseMacAddress("4c:87:5d:2a:11:9f")}
+)
+
+// newTestDaemon returns a daemon serving btm, with a short request timeout so timeout tests are quick.
+func newTestDaemon(t *testing.T, btm bluetooth.BluetoothManager) *Daemon {
+	t.Helper()
+	d := &Daemon{BluetoothManager: btm, RequestTimeout: 100 * time.Millisecond}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// newTestHandler returns the handler of a daemon from newTestDaemon.
+func newTestHandler(t *testing.T, btm bluetooth.BluetoothManager) http.Handler {
+	t.Helper()
+	return newTestDaemon(t, btm).setupHandler()
+}
+
+// serve sends a request to h, with form as the query string for GETs and the body for anything else.
+func serve(h http.Handler, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == http.MethodGet {
+		r = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+	} else {
+		r = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// operationError returns the error code of the finished operation whose start w is the response to.
+func operationError(t *testing.T, d *Daemon, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var started Operation
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatalf("couldn't parse operation %q: %v", w.Body.String(), err)
+	}
+	op, ok := d.operations.get(started.ID)
+	if !ok || !op.Done() {
+		t.Fatalf("operation %s isn't finished", started.ID)
+	}
+	return op.Error
+}
+
+// errorCode returns the code from a JSON error response, or "" if the response isn't one.
+func errorCode(w *httptest.ResponseRecorder) string {
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return ""
+	}
+	return resp.Error
+}
+
+func TestHandlers(t *testing.T) {
+	mac := func(device bluetooth.BluetoothDevice) url.Values {
+		return url.Values{"macAddr": {device.MacAddr.String()}}
+	}
+	// POST /_self/disconnect checks the device exists before disconnecting it.
+	disconnectCalls := []bluetoothtest.Call{
+		{Op: bluetoothtest.OpGet, MacAddr: headphones.MacAddr},
+		{Op: bluetoothtest.OpDisconnect, MacAddr: headphones.MacAddr},
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		form       url.Values
+		setup      func(f *bluetoothtest.FakeManager)
+		wantStatus int
+		wantCode   string
+		wantCalls  []bluetoothtest.Call
+	}{
+		{"list", "GET", "/_self/list", nil, nil, http.StatusOK, "",
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpList}}},
+		{"list fails", "GET", "/_self/list", nil, func(f *bluetoothtest.FakeManager) {
+			f.FailOn(bluetoothtest.OpList, bluetooth.MacAddress{}, bluetooth.ErrAdapterPoweredOff)
+		}, http.StatusServiceUnavailable, ErrCodeAdapterPoweredOff, []bluetoothtest.Call{{Op: bluetoothtest.OpList}}},
+		{"list times out", "GET", "/_self/list", nil, func(f *bluetoothtest.FakeManager) {
+			f.SetLatency(bluetoothtest.OpList, time.Second)
+		}, http.StatusServiceUnavailable, "", []bluetoothtest.Call{{Op: bluetoothtest.OpList}}},
+		{"list with bad refresh param", "GET", "/_self/list", url.Values{"refresh": {"maybe"}}, nil,
+			http.StatusBadRequest, ErrCodeBadRequest, nil},
+		{"disconnect", "POST", "/_self/disconnect", mac(headphones), nil, http.StatusAccepted, "",
+			disconnectCalls},
+		{"disconnect fails", "POST", "/_self/disconnect", mac(headphones), func(f *bluetoothtest.FakeManager) {
+			f.FailOn(bluetoothtest.OpDisconnect, headphones.MacAddr, bluetooth.ErrDeviceBusy)
+		}, http.StatusAccepted, ErrCodeDeviceBusy, disconnectCalls},
+		{"disconnect when not connected", "POST", "/_self/disconnect", mac(speaker), nil, http.StatusOK, "",
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpGet, MacAddr: speaker.MacAddr}}},
+		{"disconnect without macAddr", "POST", "/_self/disconnect", nil, nil, http.StatusBadRequest, ErrCodeBadRequest, nil},
+		{"disconnect invalid macAddr", "POST", "/_self/disconnect", url.Values{"macAddr": {"not-a-mac"}}, nil,
+			http.StatusBadRequest, ErrCodeInvalidMac, nil},
+		{"disconnect unknown device", "POST", "/_self/disconnect", url.Values{"macAddr": {nearby.MacAddr.String()}}, nil,
+			http.StatusNotFound, ErrCodeDeviceNotFound, []bluetoothtest.Call{{Op: bluetoothtest.OpGet, MacAddr: nearby.MacAddr}}},
+		{"disconnect with bad callback", "POST", "/_self/disconnect",
+			url.Values{"macAddr": {headphones.MacAddr.String()}, "callback": {"file:///etc/passwd"}}, nil,
+			http.StatusBadRequest, ErrCodeBadRequest,
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpGet, MacAddr: headphones.MacAddr}}},
+		{"connect", "POST", "/_self/connect", mac(speaker), nil, http.StatusAccepted, "",
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpConnect, MacAddr: speaker.MacAddr}}},
+		{"pair", "POST", "/_self/pair", url.Values{"macAddr": {nearby.MacAddr.String()}}, nil, http.StatusAccepted, "",
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpPair, MacAddr: nearby.MacAddr}}},
+		{"block", "POST", "/_self/block", mac(speaker), nil, http.StatusAccepted, "",
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpBlock, MacAddr: speaker.MacAddr}}},
+		{"trust fails", "POST", "/_self/trust", mac(speaker), func(f *bluetoothtest.FakeManager) {
+			f.FailOn(bluetoothtest.OpTrust, speaker.MacAddr, bluetooth.ErrDeviceNotAllowed)
+		}, http.StatusAccepted, ErrCodeDeviceNotAllowed,
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpTrust, MacAddr: speaker.MacAddr}}},
+		{"adapters unsupported", "GET", "/_self/adapters", nil, nil, http.StatusNotImplemented, ErrCodeUnsupported, nil},
+		{"scan", "POST", "/_self/scan", url.Values{"duration": {"1s"}}, nil, http.StatusOK, "",
+			[]bluetoothtest.Call{{Op: bluetoothtest.OpScan}}},
+		{"scan too long", "POST", "/_self/scan", url.Values{"duration": {"1h"}}, nil,
+			http.StatusBadRequest, ErrCodeBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := bluetoothtest.NewFakeManager(headphones, speaker)
+			f.AddNearbyDevice(nearby)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			d := newTestDaemon(t, f)
+			w := serve(d.setupHandler(), tt.method, tt.path, tt.form)
+			d.operations.wait()
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, wanted %d (body %q)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			code := errorCode(w)
+			if w.Code == http.StatusAccepted {
+				// The error is in the finished operation.
+				code = operationError(t, d, w)
+			}
+			if code != tt.wantCode {
+				t.Errorf("got error code %q, wanted %q", code, tt.wantCode)
+			}
+			if calls := f.Calls(); !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("got calls %v, wanted %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDisconnectChangesState(t *testing.T) {
+	f := bluetoothtest.NewFakeManager(headphones)
+	d := newTestDaemon(t, f)
+	w := serve(d.setupHandler(), "POST", "/_self/disconnect", url.Values{"macAddr": {headphones.MacAddr.String()}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, wanted 202 (body %q)", w.Code, w.Body.String())
+	}
+	d.operations.wait()
+	if devices := f.Devices(); devices[0].Connected {
+		t.Errorf("device is still connected")
+	}
+}
+
+// basicManager hides every optional capability of the manager it wraps.
+type basicManager struct {
+	bluetooth.BluetoothManager
+}
+
+func TestUnsupportedActions(t *testing.T) {
+	f := bluetoothtest.NewFakeManager(headphones)
+	// The serializing manager implements every capability, but its backend doesn't.
+	h := newTestHandler(t, bluetooth.NewSerializingBluetoothManager(basicManager{f}))
+	form := url.Values{"macAddr": {headphones.MacAddr.String()}, "powered": {"true"}}
+	for _, path := range []string{"/_self/pair", "/_self/trust", "/_self/block", "/_self/adapters/power"} {
+		w := serve(h, "POST", path, form)
+		if w.Code != http.StatusNotImplemented || errorCode(w) != ErrCodeUnsupported {
+			t.Errorf("%s: got status %d (body %q), wanted 501", path, w.Code, w.Body.String())
+		}
+	}
+	if calls := f.Calls(); len(calls) != 0 {
+		t.Errorf("got calls %v, wanted none", calls)
+	}
+}
+
+func TestDisconnectNotConnected(t *testing.T) {
+	w := serve(newTestHandler(t, bluetoothtest.NewFakeManager(speaker)), "POST", "/_self/disconnect",
+		url.Values{"macAddr": {speaker.MacAddr.String()}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, wanted 200 (body %q)", w.Code, w.Body.String())
+	}
+	var op Operation
+	if err := json.Unmarshal(w.Body.Bytes(), &op); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+	if op.Status != OperationSucceeded || op.MacAddr != speaker.MacAddr || op.ID != "" {
+		t.Errorf("got %+v, wanted a succeeded operation on %v with no ID", op, speaker.MacAddr)
+	}
+}
+
+func TestListResponse(t *testing.T) {
+	charged := headphones
+	battery := 85
+	charged.Battery = &battery
+	w := serve(newTestHandler(t, bluetoothtest.NewFakeManager(charged, speaker)), "GET", "/_self/list", nil)
+	var got []bluetooth.BluetoothDevice
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+	if want := []bluetooth.BluetoothDevice{charged, speaker}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	if age := w.Header().Get("Age"); age != "" {
+		t.Errorf("got Age %q without a cache", age)
+	}
+}
+
+// TestSelfListBluetoothctlBattery runs the real bluetoothctl backend against canned output, to check the battery level
+// from `bluetoothctl info` makes it into the list on versions that support `devices Connected`.
+func TestSelfListBluetoothctlBattery(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the bluetoothctl backend only runs on Linux")
+	}
+	// The backend checks bluetoothctl is installed before it'll start, even though it's never run.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bluetoothctl"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	outputs := map[string]string{
+		"--version":         "bluetoothctl: 5.66\n",
+		"devices":           "Device F8:4E:17:66:E8:55 WF-1000XM4\nDevice CC:98:8B:20:7D:DB Bose QC35 II\n",
+		"devices Connected": "Device F8:4E:17:66:E8:55 WF-1000XM4\n",
+		"devices Paired":    "Device F8:4E:17:66:E8:55 WF-1000XM4\nDevice CC:98:8B:20:7D:DB Bose QC35 II\n",
+		"devices Trusted":   "",
+		"info F8:4E:17:66:E8:55": "Device F8:4E:17:66:E8:55 (public)\n\tName: WF-1000XM4\n\tAlias: WF-1000XM4\n" +
+			"\tPaired: yes\n\tTrusted: no\n\tBlocked: no\n\tConnected: yes\n\tBattery Percentage: 0x55 (85)\n",
+	}
+	run := func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+		output, ok := outputs[strings.Join(args, " ")]
+		if !ok {
+			return nil, fmt.Errorf("unexpected command %s %v", cmd, args)
+		}
+		return []byte(output), nil
+	}
+	btm, err := bluetooth.NewBluetoothManagerWithOptions(bluetooth.Options{
+		Backend: "bluetoothctl",
+		Runner:  bluetooth.CommandRunnerFunc(run),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(newTestHandler(t, btm), "GET", "/_self/list", nil)
+	var got []bluetooth.BluetoothDevice
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %v, wanted 2 devices", got)
+	}
+	if got[0].Battery == nil || *got[0].Battery != 85 {
+		t.Errorf("got battery %v for the connected device, wanted 85", got[0].Battery)
+	}
+	if got[1].Battery != nil {
+		t.Errorf("got battery %v for the disconnected device, wanted none", *got[1].Battery)
+	}
+}
+
+func TestListFromCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := bluetoothtest.NewFakeManager(headphones)
+	h := newTestHandler(t, bluetooth.NewCachingBluetoothManager(ctx, f, time.Hour))
+
+	w := serve(h, "GET", "/_self/list", nil)
+	if w.Header().Get("Age") == "" {
+		t.Errorf("got no Age header from a cached list")
+	}
+	listCalls := func() int {
+		n := 0
+		for _, call := range f.Calls() {
+			if call.Op == bluetoothtest.OpList {
+				n++
+			}
+		}
+		return n
+	}
+	before := listCalls()
+	serve(h, "GET", "/_self/list", nil)
+	if got := listCalls(); got != before {
+		t.Errorf("got %d List calls after a cached list, wanted %d", got, before)
+	}
+	serve(h, "GET", "/_self/list", url.Values{"refresh": {"true"}})
+	if got := listCalls(); got != before+1 {
+		t.Errorf("got %d List calls after a refresh, wanted %d", got, before+1)
+	}
+}
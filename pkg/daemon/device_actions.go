@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+// A deviceAction is one of the optional operations from the bluetooth capability interfaces, exposed as
+// POST /_self/<name>.
+type deviceAction struct {
+	name string
+	// run is nil if the backend doesn't support the action.
+	run func(ctx context.Context, macAddr bluetooth.MacAddress) error
+}
+
+// deviceActions returns the actions our BluetoothManager might support. The ones its backend doesn't implement the
+// capability interface for have a nil run.
+func (d Daemon) deviceActions() []deviceAction {
+	var pair, trust, untrust, remove, block, unblock func(context.Context, bluetooth.MacAddress) error
+	if p, ok := bluetooth.Capability[bluetooth.DevicePairer](d.BluetoothManager); ok {
+		pair = p.Pair
+	}
+	if t, ok := bluetooth.Capability[bluetooth.DeviceTruster](d.BluetoothManager); ok {
+		trust, untrust = t.Trust, t.Untrust
+	}
+	if r, ok := bluetooth.Capability[bluetooth.DeviceRemover](d.BluetoothManager); ok {
+		remove = r.Remove
+	}
+	if b, ok := bluetooth.Capability[bluetooth.DeviceBlocker](d.BluetoothManager); ok {
+		block, unblock = b.Block, b.Unblock
+	}
+
+	return []deviceAction{
+		{"pair", pair},
+		{"trust", trust},
+		{"untrust", untrust},
+		{"remove", remove},
+		{"block", block},
+		{"unblock", unblock},
+	}
+}
+
+// handleDeviceAction returns a handler that takes a form parameter `macAddr` and starts an operation that runs the
+// action on that device. If the backend doesn't support the action, it says so straight away.
+func (d Daemon) handleDeviceAction(action deviceAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		macAddr, ok := macAddrParam(w, r)
+		if !ok {
+			return
+		}
+		if action.run == nil {
+			writeError(w, bluetooth.ErrUnsupported, "failed to "+action.name)
+			return
+		}
+		d.startOperation(w, r, action.name, macAddr, func(ctx context.Context) error {
+			return action.run(ctx, macAddr)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+// Machine-readable error codes returned in the "error" field of JSON error responses.
+const (
+	ErrCodeBadRequest        = "bad_request"
+	ErrCodeInvalidMac        = "invalid_mac"
+	ErrCodeDeviceNotFound    = "device_not_found"
+	ErrCodeNotPaired         = "not_paired"
+	ErrCodeAdapterPoweredOff = "adapter_powered_off"
+	ErrCodeAdapterNotFound   = "adapter_not_found"
+	ErrCodeBackendTimeout    = "backend_timeout"
+	ErrCodeConnectionRefused = "connection_refused"
+	ErrCodeUnsupported       = "unsupported"
+	ErrCodeUnknownDevice     = "unknown_device"
+	ErrCodeDeviceNotAllowed  = "device_not_allowed"
+	ErrCodeDeviceBusy        = "device_busy"
+	ErrCodeConnectTimeout    = "connect_timeout"
+	ErrCodePeerFailed        = "peer_failed"
+	ErrCodeTooManyOperations = "too_many_operations"
+	ErrCodeOperationNotFound = "operation_not_found"
+	ErrCodeUnauthorized      = "unauthorized"
+	ErrCodeInternal          = "internal_error"
+)
+
+// An ErrorResponse is the JSON body we send when a request fails.
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// bluetoothErrors maps errors from the bluetooth package to an HTTP status and error code. Order matters: the first
+// match wins.
+var bluetoothErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{bluetooth.ErrInvalidMac, http.StatusBadRequest, ErrCodeInvalidMac},
+	{bluetooth.ErrUnknownDevice, http.StatusNotFound, ErrCodeUnknownDevice},
+	{bluetooth.ErrDeviceNotAllowed, http.StatusForbidden, ErrCodeDeviceNotAllowed},
+	{bluetooth.ErrDeviceNotFound, http.StatusNotFound, ErrCodeDeviceNotFound},
+	{bluetooth.ErrNotPaired, http.StatusConflict, ErrCodeNotPaired},
+	{bluetooth.ErrAdapterPoweredOff, http.StatusServiceUnavailable, ErrCodeAdapterPoweredOff},
+	{bluetooth.ErrAdapterNotFound, http.StatusServiceUnavailable, ErrCodeAdapterNotFound},
+	{bluetooth.ErrDeviceBusy, http.StatusConflict, ErrCodeDeviceBusy},
+	{bluetooth.ErrConnectTimeout, http.StatusGatewayTimeout, ErrCodeConnectTimeout},
+	{bluetooth.ErrBackendTimeout, http.StatusGatewayTimeout, ErrCodeBackendTimeout},
+	{bluetooth.ErrConnectionRefused, http.StatusBadGateway, ErrCodeConnectionRefused},
+	{bluetooth.ErrUnsupported, http.StatusNotImplemented, ErrCodeUnsupported},
+}
+
+// classifyError returns the HTTP status and error code for an error returned by a BluetoothManager.
+func classifyError(err error) (int, string) {
+	for _, e := range bluetoothErrors {
+		if errors.Is(err, e.err) {
+			return e.status, e.code
+		}
+	}
+	return http.StatusInternalServerError, ErrCodeInternal
+}
+
+// writeError sends a JSON error response for an error returned by a BluetoothManager. msg describes what we were
+// trying to do, e.g. "failed to disconnect".
+func writeError(w http.ResponseWriter, err error, msg string) {
+	status, code := classifyError(err)
+	if status == http.StatusInternalServerError {
+		slog.Error(msg, "err", err)
+	}
+	writeErrorResponse(w, status, code, msg+": "+err.Error())
+}
+
+// writeErrorResponse sends a JSON error response with the given status and code.
+func writeErrorResponse(w http.ResponseWriter, status int, code string, msg string) {
+	j, err := json.Marshal(ErrorResponse{Error: code, Message: msg})
+	if err != nil {
+		slog.Error("json.Marshal", "err", err)
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(j)
+}
@@ -0,0 +1,41 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{fmt.Errorf("%w: aa:bb:cc:dd:ee:ff", bluetooth.ErrDeviceNotFound), http.StatusNotFound, ErrCodeDeviceNotFound},
+		{bluetooth.ErrInvalidMac, http.StatusBadRequest, ErrCodeInvalidMac},
+		{bluetooth.ErrNotPaired, http.StatusConflict, ErrCodeNotPaired},
+		{bluetooth.ErrAdapterPoweredOff, http.StatusServiceUnavailable, ErrCodeAdapterPoweredOff},
+		{fmt.Errorf("%w: 5c:f3:70:9b:2e:01", bluetooth.ErrAdapterNotFound), http.StatusServiceUnavailable, ErrCodeAdapterNotFound},
+		{bluetooth.ErrBackendTimeout, http.StatusGatewayTimeout, ErrCodeBackendTimeout},
+		{bluetooth.ErrConnectionRefused, http.StatusBadGateway, ErrCodeConnectionRefused},
+		{bluetooth.ErrUnsupported, http.StatusNotImplemented, ErrCodeUnsupported},
+		{fmt.Errorf("%w: aa:bb:cc:dd:ee:ff", bluetooth.ErrUnknownDevice), http.StatusNotFound, ErrCodeUnknownDevice},
+		{fmt.Errorf("%w: aa:bb:cc:dd:ee:ff is denied", bluetooth.ErrDeviceNotAllowed), http.StatusForbidden, ErrCodeDeviceNotAllowed},
+		{fmt.Errorf("giving up on connecting to aa:bb:cc:dd:ee:ff after 3 attempts: %w", bluetooth.ErrDeviceBusy), http.StatusConflict, ErrCodeDeviceBusy},
+		{fmt.Errorf("%w: aa:bb:cc:dd:ee:ff still wasn't connected 5s after connecting", bluetooth.ErrConnectTimeout), http.StatusGatewayTimeout, ErrCodeConnectTimeout},
+		{errors.New("something else"), http.StatusInternalServerError, ErrCodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantCode, func(t *testing.T) {
+			status, code := classifyError(tt.err)
+			if status != tt.wantStatus || code != tt.wantCode {
+				t.Errorf("got (%d, %q), wanted (%d, %q)", status, code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
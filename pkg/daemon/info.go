@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+const (
+	// ServiceName is what GET /_self/info reports as the service, so a peer can tell it's talking to dwmbt and not
+	// some other HTTP server.
+	ServiceName = "dwmbt"
+	// APIVersion is the version of the HTTP API daemons use to talk to each other. It goes up when a change would
+	// confuse older peers.
+	APIVersion = 1
+	// MinAPIVersion is the oldest API version this build can still talk to.
+	MinAPIVersion = 1
+	// DefaultPeerCheckInterval is how often the daemon checks that its peers are still compatible.
+	DefaultPeerCheckInterval = time.Minute
+)
+
+// Version is the version of dwmbt. Release builds set it with -ldflags "-X"; otherwise it comes from the module
+// version, if there is one.
+var Version = "dev"
+
+func version() string {
+	if Version != "dev" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return Version
+}
+
+// An APIVersionRange is the range of API versions a daemon can talk.
+type APIVersionRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Overlaps reports whether there's an API version both ranges include.
+func (r APIVersionRange) Overlaps(other APIVersionRange) bool {
+	return r.Min <= other.Max && other.Min <= r.Max
+}
+
+// InstanceInfo is the response to GET /_self/info.
+type InstanceInfo struct {
+	Service string `json:"service"`
+	// InstanceID identifies the daemon. It stays the same across restarts.
+	InstanceID  string          `json:"instanceId"`
+	Hostname    string          `json:"hostname"`
+	DisplayName string          `json:"displayName"`
+	Version     string          `json:"version"`
+	API         APIVersionRange `json:"api"`
+	// Backend is the name of the Bluetooth backend, e.g. "bluez".
+	Backend  string                 `json:"backend"`
+	Adapters []bluetooth.MacAddress `json:"adapters"`
+	// Capabilities lists the optional operations the backend supports. See bluetooth.BackendInfo.
+	Capabilities []string `json:"capabilities"`
+}
+
+// ourAPI is the range of API versions this build talks.
+var ourAPI = APIVersionRange{Min: MinAPIVersion, Max: APIVersion}
+
+func (d Daemon) handleInfo(w http.ResponseWriter, r *http.Request) {
+	backend := bluetooth.DescribeBackend(d.BluetoothManager)
+	info := InstanceInfo{
+		Service:      ServiceName,
+		InstanceID:   d.InstanceID,
+		DisplayName:  d.DisplayName,
+		Version:      version(),
+		API:          ourAPI,
+		Backend:      backend.Name,
+		Adapters:     []bluetooth.MacAddress{},
+		Capabilities: backend.Capabilities,
+	}
+	info.Hostname, _ = os.Hostname()
+	if info.Capabilities == nil {
+		info.Capabilities = []string{}
+	}
+
+	if adapterManager, ok := d.BluetoothManager.(bluetooth.AdapterManager); ok {
+		adapters, err := adapterManager.Adapters(r.Context())
+		if err != nil && !errors.Is(err, bluetooth.ErrUnsupported) {
+			slog.Warn("error listing adapters", "err", err)
+		}
+		for _, adapter := range adapters {
+			info.Adapters = append(info.Adapters, adapter.MacAddr)
+		}
+	}
+	writeJSON(w, info)
+}
+
+// peerChecker keeps track of which peers are compatible dwmbt daemons, so we don't send requests to ones that aren't.
+type peerChecker struct {
+	mu sync.Mutex
+	// incompatible holds why each peer we know we can't talk to is incompatible, by address.
+	incompatible map[string]error
+}
+
+func newPeerChecker() *peerChecker {
+	return &peerChecker{incompatible: map[string]error{}}
+}
+
+// usable returns an error with PeerStatusIncompatible if the last check found the peer incompatible. Peers that
+// haven't been checked yet, or couldn't be reached, are given the benefit of the doubt.
+func (c *peerChecker) usable(peer Peer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err, ok := c.incompatible[peer.Addr]; ok {
+		return &PeerError{Peer: peer, Status: PeerStatusIncompatible, Err: err}
+	}
+	return nil
+}
+
+func (c *peerChecker) record(peer Peer, incompatible error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if incompatible != nil {
+		c.incompatible[peer.Addr] = incompatible
+	} else {
+		delete(c.incompatible, peer.Addr)
+	}
+}
+
+// checkPeers checks every peer now, and again every PeerCheckInterval until ctx is done.
+func (d Daemon) checkPeers(ctx context.Context) {
+	ticker := time.NewTicker(d.PeerCheckInterval)
+	defer ticker.Stop()
+	for {
+		d.checkAllPeers(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAllPeers checks every peer at once.
+func (d Daemon) checkAllPeers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, peer := range d.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.checkPeer(ctx, peer)
+		}()
+	}
+	wg.Wait()
+}
+
+// checkPeer asks the peer for its InstanceInfo and records whether it's a dwmbt daemon we can talk to. If we can't get
+// an answer at all, what we knew before stands.
+func (d Daemon) checkPeer(ctx context.Context, peer Peer) {
+	var info InstanceInfo
+	err := d.peerGetJSON(ctx, peer, "/_self/info", nil, &info)
+	var peerErr *PeerError
+	if errors.As(err, &peerErr) && peerErr.Status != PeerStatusError {
+		slog.Warn("couldn't check peer", "peer", peer.Addr, "err", err)
+		return
+	}
+
+	var incompatible error
+	switch {
+	case err != nil:
+		// It answered, but not with an InstanceInfo.
+		incompatible = fmt.Errorf("not a dwmbt daemon, or one too old to say: %w", err)
+	case info.Service != ServiceName:
+		incompatible = fmt.Errorf("not a dwmbt daemon (service %q)", info.Service)
+	case info.InstanceID == d.InstanceID:
+		incompatible = errors.New("that's this daemon")
+	case !ourAPI.Overlaps(info.API):
+		incompatible = fmt.Errorf("peer %s speaks API versions %d-%d, and we speak %d-%d",
+			info.Version, info.API.Min, info.API.Max, ourAPI.Min, ourAPI.Max)
+	}
+	if incompatible != nil {
+		slog.Warn("refusing to talk to incompatible peer", "peer", peer.Addr, "reason", incompatible)
+	}
+	d.peerCheck.record(peer, incompatible)
+}
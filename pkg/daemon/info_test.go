@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/bluetoothtest"
+)
+
+func TestInfo(t *testing.T) {
+	d := newTestDaemon(t, bluetoothtest.NewFakeManager(headphones))
+	w := serve(d.setupHandler(), "GET", "/_self/info", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, wanted 200 (body %q)", w.Code, w.Body.String())
+	}
+	var info InstanceInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+
+	if info.Service != ServiceName {
+		t.Errorf("got service %q, wanted %q", info.Service, ServiceName)
+	}
+	if info.InstanceID == "" || info.InstanceID != d.InstanceID {
+		t.Errorf("got instance ID %q, wanted %q", info.InstanceID, d.InstanceID)
+	}
+	if info.API != ourAPI {
+		t.Errorf("got API versions %+v, wanted %+v", info.API, ourAPI)
+	}
+	if info.Version == "" {
+		t.Errorf("got no version")
+	}
+	if want := []string{"pair", "trust", "remove", "block", "scan"}; !reflect.DeepEqual(info.Capabilities, want) {
+		t.Errorf("got capabilities %v, wanted %v", info.Capabilities, want)
+	}
+}
+
+func TestAPIVersionRangeOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b APIVersionRange
+		want bool
+	}{
+		{APIVersionRange{1, 1}, APIVersionRange{1, 1}, true},
+		{APIVersionRange{1, 2}, APIVersionRange{2, 3}, true},
+		{APIVersionRange{2, 3}, APIVersionRange{1, 2}, true},
+		{APIVersionRange{1, 3}, APIVersionRange{2, 2}, true},
+		{APIVersionRange{1, 1}, APIVersionRange{2, 3}, false},
+		{APIVersionRange{2, 3}, APIVersionRange{1, 1}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Overlaps(tt.b); got != tt.want {
+			t.Errorf("%+v.Overlaps(%+v): got %v, wanted %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPeers(t *testing.T) {
+	desktop := newTestPeer(t, "desktop", newTestHandler(t, bluetoothtest.NewFakeManager(speaker)))
+	// Only /_self/info should reach the incompatible peers once they've been checked.
+	var listed atomic.Int32
+	infoPeer := func(name string, info InstanceInfo) Peer {
+		return newTestPeer(t, name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/_self/info" {
+				listed.Add(1)
+				writeJSON(w, []any{})
+				return
+			}
+			writeJSON(w, info)
+		}))
+	}
+	future := infoPeer("future", InstanceInfo{Service: ServiceName, InstanceID: "future", API: APIVersionRange{99, 100}})
+	other := infoPeer("other", InstanceInfo{Service: "something else"})
+	notDwmbt := newTestPeer(t, "web", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_self/info" {
+			listed.Add(1)
+		}
+		http.NotFound(w, r)
+	}))
+	gone := Peer{Addr: closedAddr(t), DisplayName: "gone"}
+
+	d := &Daemon{
+		InstanceID:       "laptop",
+		DisplayName:      "laptop",
+		BluetoothManager: bluetoothtest.NewFakeManager(headphones),
+		RequestTimeout:   time.Second,
+		PeerTimeout:      100 * time.Millisecond,
+	}
+	self := infoPeer("self", InstanceInfo{Service: ServiceName, InstanceID: "laptop", API: ourAPI})
+	d.Peers = []Peer{desktop, future, other, notDwmbt, self, gone}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	d.checkAllPeers(context.Background())
+
+	w := serve(d.setupHandler(), "GET", "/list", nil)
+	var resp ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+	got := map[string]PeerStatus{}
+	for _, h := range resp.Hosts {
+		got[h.Host] = h.Status
+	}
+	want := map[string]PeerStatus{
+		"laptop":  PeerStatusOK,
+		"desktop": PeerStatusOK,
+		"future":  PeerStatusIncompatible,
+		"other":   PeerStatusIncompatible,
+		"web":     PeerStatusIncompatible,
+		"self":    PeerStatusIncompatible,
+		// We couldn't check it, so it's still tried.
+		"gone": PeerStatusUnreachable,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	if n := listed.Load(); n != 0 {
+		t.Errorf("incompatible peers got %d requests besides /_self/info, wanted 0", n)
+	}
+}
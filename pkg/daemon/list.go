@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+// handleSelfList lists this host's Bluetooth devices. If the BluetoothManager is a bluetooth.DeviceCache, the list
+// comes from its snapshot and the response's Age header says how old that is in seconds. Setting the `refresh` form
+// parameter to true refreshes the snapshot first.
+func (d Daemon) handleSelfList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		slog.Error("r.ParseForm", "err", err)
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "could not parse request")
+		return
+	}
+	refresh := false
+	if s := r.FormValue("refresh"); s != "" {
+		refresh, err = strconv.ParseBool(s)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "refresh param must be true or false")
+			return
+		}
+	}
+
+	cache, cached := d.BluetoothManager.(bluetooth.DeviceCache)
+	if refresh && cached {
+		if err := cache.Refresh(r.Context()); err != nil {
+			writeError(w, err, "error listing bluetooth devices")
+			return
+		}
+	}
+	devices, err := d.BluetoothManager.List(r.Context())
+	if err != nil {
+		writeError(w, err, "error listing bluetooth devices")
+		return
+	}
+	if cached {
+		if age, ok := cache.SnapshotAge(); ok {
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+		}
+	}
+	writeJSON(w, devices)
+}
+
+// HostDevices is one host's part of the response to GET /list.
+type HostDevices struct {
+	// Host is the host's display name.
+	Host string `json:"host"`
+	// Addr is the peer's address. It's empty for this host.
+	Addr string `json:"addr,omitempty"`
+	// Self is true for this host.
+	Self   bool       `json:"self,omitempty"`
+	Status PeerStatus `json:"status"`
+	// Error explains what went wrong if Status isn't ok.
+	Error   string                      `json:"error,omitempty"`
+	Devices []bluetooth.BluetoothDevice `json:"devices"`
+}
+
+// ListResponse is the response to GET /list.
+type ListResponse struct {
+	Hosts []HostDevices `json:"hosts"`
+}
+
+// handleList lists the devices of this host and every peer, asking them all at once. Each peer gets PeerTimeout to
+// answer, which is shorter than the request timeout, so a slow or dead peer is reported as such rather than holding
+// up the whole response.
+func (d Daemon) handleList(w http.ResponseWriter, r *http.Request) {
+	hosts := make([]HostDevices, 1+len(d.Peers))
+	var wg sync.WaitGroup
+	wg.Add(len(hosts))
+	go func() {
+		defer wg.Done()
+		hosts[0] = d.listSelf(r.Context())
+	}()
+	for i, peer := range d.Peers {
+		go func() {
+			defer wg.Done()
+			hosts[i+1] = d.listPeer(r.Context(), peer)
+		}()
+	}
+	wg.Wait()
+	writeJSON(w, ListResponse{Hosts: hosts})
+}
+
+func (d Daemon) listSelf(ctx context.Context) HostDevices {
+	ctx, cancel := context.WithTimeout(ctx, d.PeerTimeout)
+	defer cancel()
+
+	host := HostDevices{Host: d.DisplayName, Self: true, Status: PeerStatusOK}
+	devices, err := d.BluetoothManager.List(ctx)
+	if err != nil {
+		host.Status = PeerStatusError
+		if errors.Is(err, bluetooth.ErrBackendTimeout) || errors.Is(err, context.DeadlineExceeded) {
+			host.Status = PeerStatusTimeout
+		}
+		host.Error = err.Error()
+		slog.Warn("error listing bluetooth devices", "err", err)
+	}
+	host.Devices = nonNil(devices)
+	return host
+}
+
+func (d Daemon) listPeer(ctx context.Context, peer Peer) HostDevices {
+	host := HostDevices{Host: peer.Name(), Addr: peer.Addr, Status: PeerStatusOK}
+	var devices []bluetooth.BluetoothDevice
+	if err := d.peerGetJSON(ctx, peer, "/_self/list", nil, &devices); err != nil {
+		var peerErr *PeerError
+		if errors.As(err, &peerErr) {
+			host.Status = peerErr.Status
+		} else {
+			host.Status = PeerStatusError
+		}
+		host.Error = err.Error()
+		slog.Warn("error listing peer's devices", "peer", peer.Addr, "err", err)
+	}
+	host.Devices = nonNil(devices)
+	return host
+}
+
+// nonNil returns devices, or an empty slice if it's nil, so it's encoded as [] rather than null.
+func nonNil(devices []bluetooth.BluetoothDevice) []bluetooth.BluetoothDevice {
+	if devices == nil {
+		return []bluetooth.BluetoothDevice{}
+	}
+	return devices
+}
@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/bluetoothtest"
+)
+
+// newTestPeer starts a server for h and returns it as a peer.
+func newTestPeer(t *testing.T, name string, h http.Handler) Peer {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return Peer{Addr: strings.TrimPrefix(server.URL, "http://"), DisplayName: name}
+}
+
+// newClusterHandler returns the handler of a daemon called "laptop" serving btm, with the given peers.
+func newClusterHandler(t *testing.T, btm bluetooth.BluetoothManager, peers ...Peer) http.Handler {
+	t.Helper()
+	d := &Daemon{
+		DisplayName:      "laptop",
+		BluetoothManager: btm,
+		Peers:            peers,
+		RequestTimeout:   time.Second,
+		PeerTimeout:      100 * time.Millisecond,
+	}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	return d.setupHandler()
+}
+
+// listAll sends GET /list to a daemon serving btm with the given peers, and returns its response.
+func listAll(t *testing.T, btm bluetooth.BluetoothManager, peers ...Peer) ListResponse {
+	t.Helper()
+	w := serve(newClusterHandler(t, btm, peers...), "GET", "/list", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, wanted 200 (body %q)", w.Code, w.Body.String())
+	}
+	var resp ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+func TestList(t *testing.T) {
+	desktop := newTestPeer(t, "desktop", newTestHandler(t, bluetoothtest.NewFakeManager(speaker)))
+	slow := newTestPeer(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	locked := newTestPeer(t, "locked", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeErrorResponse(w, http.StatusUnauthorized, "unauthorized", "bad signature")
+	}))
+	broken := newTestPeer(t, "broken", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>"))
+	}))
+	gone := Peer{Addr: closedAddr(t), DisplayName: "gone"}
+
+	start := time.Now()
+	resp := listAll(t, bluetoothtest.NewFakeManager(headphones), desktop, slow, locked, broken, gone)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %v, wanted the slow peer to time out after 100ms", elapsed)
+	}
+
+	type host struct {
+		name    string
+		self    bool
+		status  PeerStatus
+		devices []bluetooth.BluetoothDevice
+	}
+	var got []host
+	for _, h := range resp.Hosts {
+		got = append(got, host{h.Host, h.Self, h.Status, h.Devices})
+		if (h.Status == PeerStatusOK) != (h.Error == "") {
+			t.Errorf("%s: got status %q with error %q", h.Host, h.Status, h.Error)
+		}
+	}
+	none := []bluetooth.BluetoothDevice{}
+	want := []host{
+		{"laptop", true, PeerStatusOK, []bluetooth.BluetoothDevice{headphones}},
+		{"desktop", false, PeerStatusOK, []bluetooth.BluetoothDevice{speaker}},
+		{slow.Addr, false, PeerStatusTimeout, none},
+		{"locked", false, PeerStatusAuthFailed, none},
+		{"broken", false, PeerStatusError, none},
+		{"gone", false, PeerStatusUnreachable, none},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwanted %+v", got, want)
+	}
+}
+
+func TestListLocalTimeout(t *testing.T) {
+	f := bluetoothtest.NewFakeManager(headphones)
+	f.SetLatency(bluetoothtest.OpList, time.Second)
+	desktop := newTestPeer(t, "desktop", newTestHandler(t, bluetoothtest.NewFakeManager(speaker)))
+
+	resp := listAll(t, f, desktop)
+	if len(resp.Hosts) != 2 {
+		t.Fatalf("got %d hosts, wanted 2", len(resp.Hosts))
+	}
+	if got := resp.Hosts[0].Status; got != PeerStatusTimeout {
+		t.Errorf("got status %q for this host, wanted %q", got, PeerStatusTimeout)
+	}
+	if got := resp.Hosts[1].Devices; !reflect.DeepEqual(got, []bluetooth.BluetoothDevice{speaker}) {
+		t.Errorf("got %v from the peer, wanted %v", got, speaker)
+	}
+}
+
+// closedAddr returns the address of a server that's no longer listening.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+	return addr
+}
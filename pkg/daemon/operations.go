@@ -0,0 +1,306 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+const (
+	// DefaultOperationTimeout is how long an operation can run before it's canceled.
+	DefaultOperationTimeout = 30 * time.Second
+	// DefaultOperationRetention is how long a finished operation's result is kept for GET /operations/{id}.
+	DefaultOperationRetention = 10 * time.Minute
+	// DefaultMaxOperations is how many operations are kept at once, running or finished.
+	DefaultMaxOperations = 1000
+)
+
+// errTooManyOperations is returned when starting an operation would mean forgetting one that's still running.
+var errTooManyOperations = errors.New("too many operations in progress")
+
+// An OperationStatus says how far an operation has got.
+type OperationStatus string
+
+const (
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+)
+
+// An Operation is a change to a device that runs in the background. State-changing /_self/ endpoints start one and
+// return it with 202 Accepted, and GET /operations/{id} reports how it's going. If the request that started it had a
+// `callback` form parameter, a URL on one of our peers, the finished Operation is POSTed to that URL as JSON.
+type Operation struct {
+	ID string `json:"id"`
+	// Op is what the operation does, e.g. "disconnect".
+	Op      string               `json:"op"`
+	MacAddr bluetooth.MacAddress `json:"macAddr"`
+	Status  OperationStatus      `json:"status"`
+	// Error and Message are set like in an ErrorResponse if the operation failed. If there was nothing to do, Message
+	// says why.
+	Error    string     `json:"error,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Done reports whether the operation has finished, one way or the other.
+func (op Operation) Done() bool {
+	return op.Status != OperationRunning
+}
+
+// operationTracker runs operations in the background and remembers their results. It keeps at most max operations;
+// finished ones are forgotten after retention, or sooner, oldest first, to make room for new ones.
+type operationTracker struct {
+	timeout   time.Duration
+	retention time.Duration
+	max       int
+	// callbackTimeout is how long a callback URL gets to accept a finished operation.
+	callbackTimeout time.Duration
+	// peerClient returns the client for callbacks to a peer, which signs them like any other request to it.
+	peerClient func(Peer) *http.Client
+
+	mu sync.Mutex
+	// ops holds the operations by ID, and order their IDs from oldest to newest.
+	ops     map[string]*Operation
+	order   []string
+	running sync.WaitGroup
+}
+
+func newOperationTracker(d *Daemon) *operationTracker {
+	return &operationTracker{
+		timeout:         d.OperationTimeout,
+		retention:       d.OperationRetention,
+		max:             d.MaxOperations,
+		callbackTimeout: d.PeerTimeout,
+		peerClient:      d.peerClient,
+		ops:             map[string]*Operation{},
+	}
+}
+
+// An operationCallback is where to send an operation once it's finished.
+type operationCallback struct {
+	peer Peer
+	url  string
+}
+
+// start runs fn as a new operation, after which callback, if it isn't nil, is sent the result.
+func (t *operationTracker) start(
+	op string, macAddr bluetooth.MacAddress, callback *operationCallback, fn func(context.Context) error,
+) (Operation, error) {
+	id, err := newID()
+	if err != nil {
+		return Operation{}, err
+	}
+
+	t.mu.Lock()
+	t.expire(time.Now())
+	if len(t.ops) >= t.max && !t.evictOldestFinished() {
+		t.mu.Unlock()
+		return Operation{}, errTooManyOperations
+	}
+	o := &Operation{ID: id, Op: op, MacAddr: macAddr, Status: OperationRunning, Started: time.Now()}
+	t.ops[id] = o
+	t.order = append(t.order, id)
+	started := *o
+	t.running.Add(1)
+	t.mu.Unlock()
+
+	go func() {
+		defer t.running.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		defer cancel()
+		err := fn(ctx)
+
+		t.mu.Lock()
+		finished := time.Now()
+		o.Finished = &finished
+		o.Status = OperationSucceeded
+		if err != nil {
+			o.Status = OperationFailed
+			_, o.Error = classifyError(err)
+			o.Message = fmt.Sprintf("failed to %s: %v", op, err)
+		}
+		result := *o
+		t.mu.Unlock()
+
+		if err != nil {
+			slog.Warn("operation failed", "id", id, "op", op, "macAddr", macAddr, "err", err)
+		}
+		if callback != nil {
+			t.sendCallback(*callback, result)
+		}
+	}()
+	return started, nil
+}
+
+// get returns the operation with the given ID, or false if there isn't one or it has expired.
+func (t *operationTracker) get(id string) (Operation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	o, ok := t.ops[id]
+	if !ok {
+		return Operation{}, false
+	}
+	return *o, true
+}
+
+// wait waits for every running operation to finish.
+func (t *operationTracker) wait() {
+	t.running.Wait()
+}
+
+// waitContext is wait, but gives up when ctx is done.
+func (t *operationTracker) waitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expire forgets the operations that finished more than retention ago. t.mu must be held.
+func (t *operationTracker) expire(now time.Time) {
+	kept := t.order[:0]
+	for _, id := range t.order {
+		o := t.ops[id]
+		if o.Finished != nil && now.Sub(*o.Finished) > t.retention {
+			delete(t.ops, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	t.order = kept
+}
+
+// evictOldestFinished forgets the oldest finished operation, returning false if they're all still running. t.mu must
+// be held.
+func (t *operationTracker) evictOldestFinished() bool {
+	for i, id := range t.order {
+		if t.ops[id].Done() {
+			delete(t.ops, id)
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// sendCallback POSTs the finished operation to callback. Failures are only logged: the operation's result can still
+// be fetched with GET /operations/{id}.
+func (t *operationTracker) sendCallback(callback operationCallback, op Operation) {
+	j, err := json.Marshal(op)
+	if err != nil {
+		slog.Error("json.Marshal", "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback.url, bytes.NewReader(j))
+	if err != nil {
+		slog.Warn("bad operation callback", "id", op.ID, "callback", callback.url, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.peerClient(callback.peer).Do(req)
+	if err != nil {
+		slog.Warn("operation callback failed", "id", op.ID, "callback", callback.url, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("operation callback failed", "id", op.ID, "callback", callback.url, "status", resp.Status)
+	}
+}
+
+// newID returns a random ID for an operation or a daemon.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// callbackParam parses the optional `callback` form parameter. It must be a URL on one of our peers, with the same
+// scheme, host and port as its Addr, so the daemon can't be used to send requests anywhere else, and so callbacks can
+// be signed with the peer's key. If it's invalid, callbackParam writes an error response and returns false.
+func (d Daemon) callbackParam(w http.ResponseWriter, r *http.Request) (*operationCallback, bool) {
+	callback := r.FormValue("callback")
+	if callback == "" {
+		return nil, true
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "callback must be an http or https URL")
+		return nil, false
+	}
+	for _, peer := range d.Peers {
+		base, err := url.Parse(peer.url(""))
+		if err == nil && base.Scheme == u.Scheme && strings.EqualFold(base.Host, u.Host) {
+			return &operationCallback{peer: peer, url: callback}, true
+		}
+	}
+	writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "callback must be a URL on one of our peers")
+	return nil, false
+}
+
+// startOperation starts fn as an operation and responds with it, or with an error if it couldn't be started. The
+// request's form must already have been parsed, e.g. by macAddrParam.
+func (d Daemon) startOperation(
+	w http.ResponseWriter, r *http.Request, op string, macAddr bluetooth.MacAddress, fn func(context.Context) error,
+) {
+	callback, ok := d.callbackParam(w, r)
+	if !ok {
+		return
+	}
+	o, err := d.operations.start(op, macAddr, callback, fn)
+	if errors.Is(err, errTooManyOperations) {
+		writeErrorResponse(w, http.StatusTooManyRequests, ErrCodeTooManyOperations, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, err, "failed to start "+op)
+		return
+	}
+	w.Header().Set("Location", "/operations/"+o.ID)
+	writeJSONStatus(w, http.StatusAccepted, o)
+}
+
+// writeNoOp responds with 200 OK and an Operation that has already succeeded, for a request that had nothing to do.
+// It has no ID, since there's nothing to check on later.
+func writeNoOp(w http.ResponseWriter, op string, macAddr bluetooth.MacAddress, message string) {
+	now := time.Now()
+	writeJSON(w, Operation{
+		Op: op, MacAddr: macAddr, Status: OperationSucceeded, Message: message, Started: now, Finished: &now,
+	})
+}
+
+// handleOperation reports the status of an operation.
+func (d Daemon) handleOperation(w http.ResponseWriter, r *http.Request) {
+	o, ok := d.operations.get(r.PathValue("id"))
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, ErrCodeOperationNotFound, "no such operation (it may have expired)")
+		return
+	}
+	writeJSON(w, o)
+}
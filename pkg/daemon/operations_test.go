@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/bluetoothtest"
+)
+
+// startTestOperation sends a state-changing request that should start an operation, and returns it.
+func startTestOperation(t *testing.T, h http.Handler, path string, form url.Values) Operation {
+	t.Helper()
+	w := serve(h, "POST", path, form)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, wanted 202 (body %q)", w.Code, w.Body.String())
+	}
+	var op Operation
+	if err := json.Unmarshal(w.Body.Bytes(), &op); err != nil {
+		t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+	}
+	if got, want := w.Header().Get("Location"), "/operations/"+op.ID; got != want {
+		t.Errorf("got Location %q, wanted %q", got, want)
+	}
+	return op
+}
+
+// getTestOperation fetches an operation, returning the response's status and the operation.
+func getTestOperation(h http.Handler, id string) (int, Operation) {
+	w := serve(h, "GET", "/operations/"+id, nil)
+	var op Operation
+	_ = json.Unmarshal(w.Body.Bytes(), &op)
+	return w.Code, op
+}
+
+func TestOperationStatus(t *testing.T) {
+	f := bluetoothtest.NewFakeManager(headphones, speaker)
+	f.FailOn(bluetoothtest.OpDisconnect, headphones.MacAddr, bluetooth.ErrBackendTimeout)
+	d := newTestDaemon(t, f)
+	h := d.setupHandler()
+
+	failed := startTestOperation(t, h, "/_self/disconnect", url.Values{"macAddr": {headphones.MacAddr.String()}})
+	connected := startTestOperation(t, h, "/_self/connect", url.Values{"macAddr": {speaker.MacAddr.String()}})
+	if failed.Status != OperationRunning || failed.Op != "disconnect" || failed.MacAddr != headphones.MacAddr {
+		t.Errorf("got %+v, wanted a running disconnect of %v", failed, headphones.MacAddr)
+	}
+	d.operations.wait()
+
+	tests := []struct {
+		id         string
+		wantStatus OperationStatus
+		wantError  string
+	}{
+		{failed.ID, OperationFailed, ErrCodeBackendTimeout},
+		{connected.ID, OperationSucceeded, ""},
+	}
+	for _, tt := range tests {
+		code, op := getTestOperation(h, tt.id)
+		if code != http.StatusOK {
+			t.Errorf("got status %d, wanted 200", code)
+		}
+		if op.Status != tt.wantStatus || op.Error != tt.wantError || op.Finished == nil {
+			t.Errorf("got %+v, wanted status %q and error %q", op, tt.wantStatus, tt.wantError)
+		}
+	}
+
+	w := serve(h, "GET", "/operations/nonexistent", nil)
+	if w.Code != http.StatusNotFound || errorCode(w) != ErrCodeOperationNotFound {
+		t.Errorf("got %d %q, wanted 404 %q", w.Code, errorCode(w), ErrCodeOperationNotFound)
+	}
+}
+
+func TestOperationCallback(t *testing.T) {
+	received := make(chan Operation, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(SignatureHeader) == "" {
+			t.Errorf("got an unsigned callback")
+		}
+		var op Operation
+		if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+			t.Errorf("couldn't parse callback: %v", err)
+		}
+		received <- op
+	}))
+	defer callback.Close()
+	peer := Peer{Addr: strings.TrimPrefix(callback.URL, "http://"), AuthKey: "peer-key"}
+
+	d := &Daemon{BluetoothManager: bluetoothtest.NewFakeManager(speaker), Peers: []Peer{peer}}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	h := d.setupHandler()
+	started := startTestOperation(t, h, "/_self/connect",
+		url.Values{"macAddr": {speaker.MacAddr.String()}, "callback": {callback.URL + "/done"}})
+
+	select {
+	case op := <-received:
+		if op.ID != started.ID || op.Status != OperationSucceeded {
+			t.Errorf("got %+v, wanted operation %s to have succeeded", op, started.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the callback")
+	}
+
+	// Anywhere that isn't one of our peers is refused, so the daemon can't be made to send requests for anyone.
+	for _, target := range []string{
+		"http://169.254.169.254/latest/meta-data",
+		"https://" + peer.Addr + "/done",
+		"http://localhost:1/done",
+		"file:///etc/passwd",
+	} {
+		w := serve(h, "POST", "/_self/connect", url.Values{"macAddr": {speaker.MacAddr.String()}, "callback": {target}})
+		if w.Code != http.StatusBadRequest || errorCode(w) != ErrCodeBadRequest {
+			t.Errorf("%s: got %d %q, wanted 400 %q", target, w.Code, errorCode(w), ErrCodeBadRequest)
+		}
+	}
+	d.operations.wait()
+}
+
+func TestOperationLimits(t *testing.T) {
+	f := bluetoothtest.NewFakeManager(headphones, speaker)
+	f.SetLatency(bluetoothtest.OpConnect, 50*time.Millisecond)
+	d := &Daemon{BluetoothManager: f, MaxOperations: 2, OperationRetention: time.Hour}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	h := d.setupHandler()
+	connect := func(device bluetooth.BluetoothDevice) *httptest.ResponseRecorder {
+		return serve(h, "POST", "/_self/connect", url.Values{"macAddr": {device.MacAddr.String()}})
+	}
+
+	first := startTestOperation(t, h, "/_self/connect", url.Values{"macAddr": {headphones.MacAddr.String()}})
+	startTestOperation(t, h, "/_self/connect", url.Values{"macAddr": {speaker.MacAddr.String()}})
+	// Both operations are still running, so there's no room for a third.
+	if w := connect(speaker); w.Code != http.StatusTooManyRequests || errorCode(w) != ErrCodeTooManyOperations {
+		t.Errorf("got %d %q, wanted 429 %q", w.Code, errorCode(w), ErrCodeTooManyOperations)
+	}
+
+	// Once they've finished, the oldest makes way for a new one.
+	d.operations.wait()
+	startTestOperation(t, h, "/_self/connect", url.Values{"macAddr": {speaker.MacAddr.String()}})
+	if code, _ := getTestOperation(h, first.ID); code != http.StatusNotFound {
+		t.Errorf("got status %d for the oldest operation, wanted 404", code)
+	}
+	d.operations.wait()
+}
+
+func TestOperationRetention(t *testing.T) {
+	d := &Daemon{BluetoothManager: bluetoothtest.NewFakeManager(speaker), OperationRetention: time.Millisecond}
+	if err := InitDaemon(d); err != nil {
+		t.Fatal(err)
+	}
+	h := d.setupHandler()
+
+	op := startTestOperation(t, h, "/_self/connect", url.Values{"macAddr": {speaker.MacAddr.String()}})
+	d.operations.wait()
+	time.Sleep(10 * time.Millisecond)
+	if code, _ := getTestOperation(h, op.ID); code != http.StatusNotFound {
+		t.Errorf("got status %d for an expired operation, wanted 404", code)
+	}
+}
+
+func TestOperationWaitContext(t *testing.T) {
+	f := bluetoothtest.NewFakeManager(speaker)
+	f.SetLatency(bluetoothtest.OpConnect, 50*time.Millisecond)
+	d := newTestDaemon(t, f)
+	startTestOperation(t, d.setupHandler(), "/_self/connect", url.Values{"macAddr": {speaker.MacAddr.String()}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := d.operations.waitContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, wanted to give up waiting", err)
+	}
+	if err := d.operations.waitContext(context.Background()); err != nil {
+		t.Errorf("got %v, wanted the operation to finish", err)
+	}
+}
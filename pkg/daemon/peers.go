@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A PeerStatus says how a request to a peer went.
+type PeerStatus string
+
+const (
+	PeerStatusOK PeerStatus = "ok"
+	// PeerStatusTimeout means the peer didn't answer within the daemon's PeerTimeout.
+	PeerStatusTimeout PeerStatus = "timeout"
+	// PeerStatusUnreachable means we couldn't connect to the peer at all.
+	PeerStatusUnreachable PeerStatus = "unreachable"
+	// PeerStatusAuthFailed means the peer rejected our credentials.
+	PeerStatusAuthFailed PeerStatus = "auth_failed"
+	// PeerStatusError means the peer answered, but with an error or a response we couldn't understand.
+	PeerStatusError PeerStatus = "error"
+	// PeerStatusIncompatible means the peer isn't a dwmbt daemon, or doesn't speak a version of the API we do, so we
+	// don't send it requests. See GET /_self/info.
+	PeerStatusIncompatible PeerStatus = "incompatible"
+)
+
+// A PeerError is returned when a request to a peer fails.
+type PeerError struct {
+	Peer   Peer
+	Status PeerStatus
+	Err    error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %s: %v", e.Peer.Addr, e.Status, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// Name returns the name to show for the peer: its DisplayName, or its address if it doesn't have one.
+func (p Peer) Name() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Addr
+}
+
+// url returns the URL of path on the peer. Addr is usually just a host and port, but can be a URL if the peer needs a
+// different scheme.
+func (p Peer) url(path string) string {
+	base := p.Addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// peerPollInterval is how often we check on something a peer is doing in the background.
+const peerPollInterval = 250 * time.Millisecond
+
+// peerGetJSON sends a GET request for path to the peer, with form as the query string, and decodes its JSON response
+// into v. The peer gets PeerTimeout to answer. Failures are returned as a *PeerError.
+func (d Daemon) peerGetJSON(ctx context.Context, peer Peer, path string, form url.Values, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, d.PeerTimeout)
+	defer cancel()
+	_, body, err := d.peerRequest(ctx, peer, http.MethodGet, path, form)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &PeerError{Peer: peer, Status: PeerStatusError, Err: fmt.Errorf("invalid response: %w", err)}
+	}
+	return nil
+}
+
+// peerOperation sends form to path on the peer as a POST request, and if the peer starts an Operation, waits for it to
+// finish. The peer gets RequestTimeout to answer, and OperationTimeout to finish. Failures, including the operation
+// failing, are returned as a *PeerError.
+func (d Daemon) peerOperation(ctx context.Context, peer Peer, path string, form url.Values) error {
+	postCtx, cancel := context.WithTimeout(ctx, d.RequestTimeout)
+	defer cancel()
+	status, body, err := d.peerRequest(postCtx, peer, http.MethodPost, path, form)
+	if err != nil {
+		return err
+	}
+	// Peers answer 200 OK if there was nothing to do, as do old peers that don't run operations in the background.
+	if status != http.StatusAccepted {
+		return nil
+	}
+	var op Operation
+	if err := json.Unmarshal(body, &op); err != nil || op.ID == "" {
+		return &PeerError{Peer: peer, Status: PeerStatusError, Err: fmt.Errorf("invalid operation: %q", body)}
+	}
+
+	ctx, cancel = context.WithTimeout(ctx, d.OperationTimeout)
+	defer cancel()
+	for !op.Done() {
+		select {
+		case <-time.After(peerPollInterval):
+		case <-ctx.Done():
+			return &PeerError{Peer: peer, Status: PeerStatusTimeout, Err: fmt.Errorf("waiting for %s: %w", op.Op, ctx.Err())}
+		}
+		if err := d.peerGetJSON(ctx, peer, "/operations/"+op.ID, nil, &op); err != nil {
+			return err
+		}
+	}
+	if op.Status == OperationFailed {
+		return &PeerError{Peer: peer, Status: PeerStatusError, Err: errors.New(op.Message)}
+	}
+	return nil
+}
+
+// peerRequest sends a request to the peer, with form as the query string for GETs and the body for anything else, and
+// returns the status and body of its response if it's 200 OK or 202 Accepted. Requests to peers that the last check
+// found incompatible fail straight away.
+func (d Daemon) peerRequest(
+	ctx context.Context, peer Peer, method, path string, form url.Values,
+) (int, []byte, error) {
+	// Checking a peer is how it gets a chance to become compatible again.
+	if path != "/_self/info" {
+		if err := d.peerCheck.usable(peer); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	target := peer.url(path)
+	var body io.Reader
+	if method == http.MethodGet {
+		if len(form) > 0 {
+			target += "?" + form.Encode()
+		}
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return 0, nil, &PeerError{Peer: peer, Status: PeerStatusError, Err: err}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := d.peerClient(peer).Do(req)
+	if err != nil {
+		status := PeerStatusUnreachable
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = PeerStatusTimeout
+		}
+		return 0, nil, &PeerError{Peer: peer, Status: status, Err: err}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		status := PeerStatusError
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = PeerStatusTimeout
+		}
+		return 0, nil, &PeerError{Peer: peer, Status: status, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		status := PeerStatusError
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			status = PeerStatusAuthFailed
+		}
+		return 0, nil, &PeerError{Peer: peer, Status: status, Err: peerResponseError(resp, respBody)}
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// peerResponseError describes an error response from a peer, using the message from its ErrorResponse if it sent one.
+func peerResponseError(resp *http.Response, body []byte) error {
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Message != "" {
+		return fmt.Errorf("%s: %s", resp.Status, errResp.Message)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+const (
+	// DefaultScanDuration is how long POST /_self/scan scans for if the request doesn't say.
+	DefaultScanDuration = 5 * time.Second
+	// MaxScanDuration is the longest scan a request can ask for. Scanning slows down other Bluetooth traffic, so we
+	// don't want anyone leaving it running.
+	MaxScanDuration = 30 * time.Second
+)
+
+// handleScan runs device discovery for the duration given in the `duration` form parameter and returns the devices
+// that were found.
+func (d Daemon) handleScan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		slog.Error("r.ParseForm", "err", err)
+		writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest, "could not parse request")
+		return
+	}
+
+	duration := DefaultScanDuration
+	if s := r.FormValue("duration"); s != "" {
+		duration, err = time.ParseDuration(s)
+		if err != nil || duration <= 0 || duration > MaxScanDuration {
+			writeErrorResponse(w, http.StatusBadRequest, ErrCodeBadRequest,
+				fmt.Sprintf("duration must be a positive duration no longer than %s, e.g. \"10s\"", MaxScanDuration))
+			return
+		}
+	}
+
+	scanner, ok := bluetooth.Capability[bluetooth.Scanner](d.BluetoothManager)
+	if !ok {
+		writeError(w, bluetooth.ErrUnsupported, "failed to scan")
+		return
+	}
+	devices, err := scanner.Scan(r.Context(), duration)
+	if err != nil {
+		writeError(w, err, "failed to scan")
+		return
+	}
+	writeJSON(w, devices)
+}
@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+)
+
+// The steps of POST /take, as reported in TakeStep.Step.
+const (
+	// TakeStepCheck looks the device up on this host, and stops if it's unknown or already connected here.
+	TakeStepCheck = "check"
+	// TakeStepFind asks a peer whether it has the device connected.
+	TakeStepFind = "find"
+	// TakeStepDisconnect asks a peer that has the device to disconnect it, and waits until it has.
+	TakeStepDisconnect = "disconnect"
+	// TakeStepConnect connects the device to this host.
+	TakeStepConnect = "connect"
+	// TakeStepRollback reconnects the device to a peer we disconnected it from, after a later step failed.
+	TakeStepRollback = "rollback"
+)
+
+// A TakeStep is one step of moving a device to this host.
+type TakeStep struct {
+	Step string `json:"step"`
+	// Host is the display name of the host the step ran against.
+	Host  string `json:"host"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// TakeResponse is the response to POST /take. If the device couldn't be taken, Error and Message are set like in an
+// ErrorResponse, and Steps says how far we got.
+type TakeResponse struct {
+	MacAddr bluetooth.MacAddress `json:"macAddr"`
+	Taken   bool                 `json:"taken"`
+	Steps   []TakeStep           `json:"steps"`
+	Error   string               `json:"error,omitempty"`
+	Message string               `json:"message,omitempty"`
+}
+
+func (resp *TakeResponse) step(step, host string, err error) bool {
+	s := TakeStep{Step: step, Host: host, OK: err == nil}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	resp.Steps = append(resp.Steps, s)
+	return err == nil
+}
+
+// handleTake moves a device to this host. It asks every peer whether it has the device connected, has the ones that
+// do disconnect it, and then connects it here. If any of that fails, the peers we disconnected it from are asked to
+// connect it again, so a failed take doesn't leave the device connected nowhere.
+//
+// Peers we can't reach are skipped: if one of them does have the device, connecting it here fails and we roll back.
+func (d Daemon) handleTake(w http.ResponseWriter, r *http.Request) {
+	macAddr, ok := macAddrParam(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	resp := TakeResponse{MacAddr: macAddr}
+	fail := func(status int, code string, err error) {
+		resp.Error = code
+		resp.Message = "failed to take device: " + err.Error()
+		writeJSONStatus(w, status, resp)
+	}
+
+	// Make sure we know the device before taking it from anyone.
+	device, err := d.BluetoothManager.Get(ctx, macAddr)
+	if !resp.step(TakeStepCheck, d.DisplayName, err) {
+		status, code := classifyError(err)
+		fail(status, code, err)
+		return
+	}
+	if device.Connected {
+		resp.Taken = true
+		writeJSON(w, resp)
+		return
+	}
+
+	var released []Peer
+	for _, peer := range d.findHolders(ctx, &resp, macAddr) {
+		err := d.releaseDevice(ctx, peer, macAddr)
+		if !resp.step(TakeStepDisconnect, peer.Name(), err) {
+			d.rollbackTake(ctx, &resp, macAddr, released)
+			fail(http.StatusBadGateway, ErrCodePeerFailed, err)
+			return
+		}
+		released = append(released, peer)
+	}
+
+	err = d.BluetoothManager.Connect(ctx, macAddr)
+	if !resp.step(TakeStepConnect, d.DisplayName, err) {
+		d.rollbackTake(ctx, &resp, macAddr, released)
+		status, code := classifyError(err)
+		fail(status, code, err)
+		return
+	}
+	resp.Taken = true
+	writeJSON(w, resp)
+}
+
+// findHolders asks every peer at once for its devices, records a find step for each, and returns the peers that have
+// the device connected.
+func (d Daemon) findHolders(ctx context.Context, resp *TakeResponse, macAddr bluetooth.MacAddress) []Peer {
+	holding := make([]bool, len(d.Peers))
+	errs := make([]error, len(d.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range d.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			holding[i], errs[i] = d.peerHasConnected(ctx, peer, macAddr)
+		}()
+	}
+	wg.Wait()
+
+	var holders []Peer
+	for i, peer := range d.Peers {
+		resp.step(TakeStepFind, peer.Name(), errs[i])
+		if holding[i] {
+			holders = append(holders, peer)
+		}
+	}
+	return holders
+}
+
+// peerHasConnected reports whether the peer has the device connected. It asks the peer to refresh its device list
+// first, since a cached one could be out of date.
+func (d Daemon) peerHasConnected(ctx context.Context, peer Peer, macAddr bluetooth.MacAddress) (bool, error) {
+	var devices []bluetooth.BluetoothDevice
+	if err := d.peerGetJSON(ctx, peer, "/_self/list", url.Values{"refresh": {"true"}}, &devices); err != nil {
+		return false, err
+	}
+	for _, device := range devices {
+		if device.MacAddr == macAddr {
+			return device.Connected, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseDevice asks the peer to disconnect the device, and waits until it has, and the peer's device list agrees.
+func (d Daemon) releaseDevice(ctx context.Context, peer Peer, macAddr bluetooth.MacAddress) error {
+	form := url.Values{"macAddr": {macAddr.String()}}
+	if err := d.peerOperation(ctx, peer, "/_self/disconnect", form); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.PeerTimeout)
+	defer cancel()
+	for {
+		connected, err := d.peerHasConnected(ctx, peer, macAddr)
+		if err != nil {
+			return err
+		}
+		if !connected {
+			return nil
+		}
+		select {
+		case <-time.After(peerPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("peer %s still has %v connected after disconnecting it", peer.Name(), macAddr)
+		}
+	}
+}
+
+// rollbackTake asks the peers we disconnected the device from to connect it again. It carries on even if the request
+// has timed out, since leaving the device disconnected everywhere is the worst outcome.
+func (d Daemon) rollbackTake(ctx context.Context, resp *TakeResponse, macAddr bluetooth.MacAddress, released []Peer) {
+	ctx = context.WithoutCancel(ctx)
+	form := url.Values{"macAddr": {macAddr.String()}}
+	for _, peer := range released {
+		err := d.peerOperation(ctx, peer, "/_self/connect", form)
+		if !resp.step(TakeStepRollback, peer.Name(), err) {
+			slog.Error("couldn't give device back to peer", "peer", peer.Addr, "macAddr", macAddr, "err", err)
+		}
+	}
+}
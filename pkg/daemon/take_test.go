@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth"
+	"github.com/pushittoprod/bt-daemon/pkg/bluetooth/bluetoothtest"
+)
+
+func TestTake(t *testing.T) {
+	disconnected := headphones
+	disconnected.Connected = false
+	// step is a TakeStep without its error message.
+	type step struct {
+		step string
+		host string
+		ok   bool
+	}
+
+	tests := []struct {
+		name string
+		// local and desktop are the devices on this host and on its peer.
+		local, desktop []bluetooth.BluetoothDevice
+		setup          func(local, desktop *bluetoothtest.FakeManager)
+		// unreachable adds a peer that isn't running.
+		unreachable   bool
+		wantStatus    int
+		wantCode      string
+		wantSteps     []step
+		wantLocal     bool
+		wantOnDesktop bool
+	}{
+		{
+			name:       "takes from a peer",
+			local:      []bluetooth.BluetoothDevice{disconnected},
+			desktop:    []bluetooth.BluetoothDevice{headphones},
+			wantStatus: http.StatusOK,
+			wantSteps: []step{
+				{TakeStepCheck, "laptop", true},
+				{TakeStepFind, "desktop", true},
+				{TakeStepDisconnect, "desktop", true},
+				{TakeStepConnect, "laptop", true},
+			},
+			wantLocal: true,
+		},
+		{
+			name:       "already connected here",
+			local:      []bluetooth.BluetoothDevice{headphones},
+			desktop:    []bluetooth.BluetoothDevice{disconnected},
+			wantStatus: http.StatusOK,
+			wantSteps:  []step{{TakeStepCheck, "laptop", true}},
+			wantLocal:  true,
+		},
+		{
+			name:       "connected nowhere",
+			local:      []bluetooth.BluetoothDevice{disconnected},
+			desktop:    []bluetooth.BluetoothDevice{disconnected},
+			wantStatus: http.StatusOK,
+			wantSteps: []step{
+				{TakeStepCheck, "laptop", true},
+				{TakeStepFind, "desktop", true},
+				{TakeStepConnect, "laptop", true},
+			},
+			wantLocal: true,
+		},
+		{
+			name:        "skips unreachable peers",
+			local:       []bluetooth.BluetoothDevice{disconnected},
+			desktop:     []bluetooth.BluetoothDevice{headphones},
+			unreachable: true,
+			wantStatus:  http.StatusOK,
+			wantSteps: []step{
+				{TakeStepCheck, "laptop", true},
+				{TakeStepFind, "desktop", true},
+				{TakeStepFind, "gone", false},
+				{TakeStepDisconnect, "desktop", true},
+				{TakeStepConnect, "laptop", true},
+			},
+			wantLocal: true,
+		},
+		{
+			name:       "unknown here",
+			desktop:    []bluetooth.BluetoothDevice{headphones},
+			wantStatus: http.StatusNotFound,
+			wantCode:   ErrCodeDeviceNotFound,
+			wantSteps:  []step{{TakeStepCheck, "laptop", false}},
+			// We don't touch the peers at all.
+			wantOnDesktop: true,
+		},
+		{
+			name:    "peer won't let go",
+			local:   []bluetooth.BluetoothDevice{disconnected},
+			desktop: []bluetooth.BluetoothDevice{headphones},
+			setup: func(local, desktop *bluetoothtest.FakeManager) {
+				desktop.FailOn(bluetoothtest.OpDisconnect, headphones.MacAddr, bluetooth.ErrBackendTimeout)
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCode:   ErrCodePeerFailed,
+			wantSteps: []step{
+				{TakeStepCheck, "laptop", true},
+				{TakeStepFind, "desktop", true},
+				{TakeStepDisconnect, "desktop", false},
+			},
+			wantOnDesktop: true,
+		},
+		{
+			name:    "rolls back when connecting fails",
+			local:   []bluetooth.BluetoothDevice{disconnected},
+			desktop: []bluetooth.BluetoothDevice{headphones},
+			setup: func(local, desktop *bluetoothtest.FakeManager) {
+				local.FailOn(bluetoothtest.OpConnect, headphones.MacAddr, bluetooth.ErrConnectTimeout)
+			},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   ErrCodeConnectTimeout,
+			wantSteps: []step{
+				{TakeStepCheck, "laptop", true},
+				{TakeStepFind, "desktop", true},
+				{TakeStepDisconnect, "desktop", true},
+				{TakeStepConnect, "laptop", false},
+				{TakeStepRollback, "desktop", true},
+			},
+			wantOnDesktop: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := bluetoothtest.NewFakeManager(tt.local...)
+			desktop := bluetoothtest.NewFakeManager(tt.desktop...)
+			if tt.setup != nil {
+				tt.setup(local, desktop)
+			}
+			peers := []Peer{newTestPeer(t, "desktop", newTestHandler(t, desktop))}
+			if tt.unreachable {
+				peers = append(peers, Peer{Addr: closedAddr(t), DisplayName: "gone"})
+			}
+
+			w := serve(newClusterHandler(t, local, peers...), "POST", "/take",
+				url.Values{"macAddr": {headphones.MacAddr.String()}})
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, wanted %d (body %q)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			var resp TakeResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("couldn't parse response %q: %v", w.Body.String(), err)
+			}
+			if resp.Error != tt.wantCode {
+				t.Errorf("got error code %q, wanted %q", resp.Error, tt.wantCode)
+			}
+			if resp.Taken != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("got taken %v with status %d", resp.Taken, w.Code)
+			}
+			var steps []step
+			for _, s := range resp.Steps {
+				steps = append(steps, step{s.Step, s.Host, s.OK})
+			}
+			if !reflect.DeepEqual(steps, tt.wantSteps) {
+				t.Errorf("got steps %+v, wanted %+v", steps, tt.wantSteps)
+			}
+
+			if got := isConnected(local); got != tt.wantLocal {
+				t.Errorf("got connected here %v, wanted %v", got, tt.wantLocal)
+			}
+			if got := isConnected(desktop); got != tt.wantOnDesktop {
+				t.Errorf("got connected on desktop %v, wanted %v", got, tt.wantOnDesktop)
+			}
+		})
+	}
+}
+
+// isConnected reports whether the headphones are connected to f.
+func isConnected(f *bluetoothtest.FakeManager) bool {
+	for _, device := range f.Devices() {
+		if device.MacAddr == headphones.MacAddr {
+			return device.Connected
+		}
+	}
+	return false
+}
+
+func TestDefaultTakeTimeout(t *testing.T) {
+	d := newTestDaemon(t, bluetoothtest.NewFakeManager())
+	// A take has to wait for a peer's disconnect operation, and then for every attempt to connect here.
+	if least := d.OperationTimeout + d.Connect.MaxDuration(d.RequestTimeout); d.TakeTimeout <= least {
+		t.Errorf("got TakeTimeout %v, wanted more than %v", d.TakeTimeout, least)
+	}
+	if got := DefaultTakeTimeout(bluetooth.DefaultConnectPolicy); got <= DefaultOperationTimeout {
+		t.Errorf("got DefaultTakeTimeout %v, wanted more than the operation timeout", got)
+	}
+}